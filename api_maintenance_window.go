@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type MaintenanceWindowsResponse struct {
+	Windows []MaintenanceWindow `json:"windows"`
+	Message string              `json:"message"`
+	Error   string              `json:"error"`
+}
+
+// Fetches every maintenance window from the DB and returns them as JSON
+func ListMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	var res MaintenanceWindowsResponse
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	windows, err := c.GetAllMaintenanceWindows()
+	if err != nil {
+		res.Error = err.Error()
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusInternalServerError)
+		return
+	}
+
+	for _, mw := range windows {
+		res.Windows = append(res.Windows, *mw)
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Fetches a single maintenance window from the DB and returns it as JSON
+func ShowMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	var res MaintenanceWindowsResponse
+
+	vars := mux.Vars(r)
+	name := vars["window"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	mw, err := c.GetMaintenanceWindow(name)
+	if err != nil {
+		res.Error = err.Error()
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusNotFound)
+		return
+	}
+
+	res.Windows = append(res.Windows, *mw)
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Creates a new maintenance window in the database
+func CreateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	var res MaintenanceWindowsResponse
+	var mw MaintenanceWindow
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024*10))
+	// If something went wrong, return an error in the JSON response
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = r.Body.Close()
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = json.Unmarshal(body, &mw)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = mw.Validate()
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Make sure that this window doesn't already exist
+	fmw, err := c.GetMaintenanceWindow(mw.Name)
+	if fmw != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("Maintenance window ", mw.Name, " already exists. Use PUT /maintenance-windows/", mw.Name, " to update.")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if err != nil {
+		logger.Debug("No existing maintenance window", "window", mw.Name, "err", err)
+	}
+
+	err = c.StoreMaintenanceWindow(&mw)
+	if err != nil {
+		logger.Error("Could not store maintenance window", "window", mw.Name, "err", err)
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	scheduleWindowEnd(&mw)
+
+	res.Message = fmt.Sprint("Maintenance window ", mw.Name, " created")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Replaces an existing maintenance window.  Notifications that it's holding back are delivered at its new end.
+func UpdateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	var res MaintenanceWindowsResponse
+	var mw MaintenanceWindow
+
+	vars := mux.Vars(r)
+	name := vars["window"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024*10))
+	// If something went wrong, return an error in the JSON response
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = r.Body.Close()
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = json.Unmarshal(body, &mw)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// The window's name comes from the URI path
+	mw.Name = name
+
+	err = mw.Validate()
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Make sure the window actually exists before updating
+	fmw, err := c.GetMaintenanceWindow(name)
+	if fmw == nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("Maintenance window ", name, " does not exist. Use POST to create.")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if err != nil {
+		logger.Debug("Could not fetch maintenance window", "window", name, "err", err)
+	}
+
+	err = c.StoreMaintenanceWindow(&mw)
+	if err != nil {
+		logger.Error("Could not store maintenance window", "window", name, "err", err)
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	scheduleWindowEnd(&mw)
+
+	res.Windows = append(res.Windows, mw)
+	res.Message = fmt.Sprint("Maintenance window ", name, " updated")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Deletes the specified maintenance window from the database.  Notifications that it was holding back are
+// delivered straight away.
+func DeleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	var res MaintenanceWindowsResponse
+
+	vars := mux.Vars(r)
+	name := vars["window"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	mw, err := c.GetMaintenanceWindow(name)
+	if mw == nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("Maintenance window ", name, " does not exist and thus, cannot be deleted")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if err != nil {
+		logger.Debug("Could not fetch maintenance window", "window", name, "err", err)
+	}
+
+	err = c.DeleteMaintenanceWindow(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	deliverSuppressed(name)
+
+	res.Message = fmt.Sprint("Maintenance window ", name, " deleted")
+
+	json.NewEncoder(w).Encode(res)
+}
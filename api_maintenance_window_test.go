@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindows(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	plans := map[string]string{
+		"lancelot": `[{"method": "sms://+12108675309", "notify_every_period": "1h"}]`,
+		"galahad":  `[{"method": "email://galahad@camelot.example.com", "notify_every_period": "1h"}]`,
+	}
+	for u, plan := range plans {
+		w := testAPIRequest(t, "POST", "http://localhost/people", `{"username": "`+u+`", "fullname": "Sir `+strings.Title(u)+`"}`)
+		if w.Code != 200 {
+			t.Fatalf("CreatePerson request failed: %s", w.Body)
+		}
+		w = testAPIRequest(t, "POST", "http://localhost/plan/"+u, plan)
+		if w.Code != 200 {
+			t.Fatalf("CreateNotificationPlan request failed: %s", w.Body)
+		}
+	}
+	w := testAPIRequest(t, "POST", "http://localhost/teams", `{"name": "knights", "members": ["galahad"]}`)
+	if w.Code != 200 {
+		t.Fatalf("CreateTeam request failed: %s", w.Body)
+	}
+
+	now := time.Now()
+	window := func(name string, start, end time.Time, rest string) string {
+		return `{"name": "` + name + `", "start": "` + start.Format(time.RFC3339Nano) + `", "end": "` + end.Format(time.RFC3339Nano) + `"` + rest + `}`
+	}
+
+	invalid := []string{
+		window("backwards", now, now.Add(-time.Hour), ""),
+		window("nobody", now, now.Add(time.Hour), `, "people": ["mordred"]`),
+		window("noteam", now, now.Add(time.Hour), `, "teams": ["roundheads"]`),
+		window("badpattern", now, now.Add(time.Hour), `, "content_pattern": "("`),
+		`{"name": "forever", "start": "` + now.Format(time.RFC3339) + `"}`,
+	}
+	for _, body := range invalid {
+		w = testAPIRequest(t, "POST", "http://localhost/maintenance-windows", body)
+		if w.Code != 422 {
+			t.Errorf("Expected an invalid maintenance window to be rejected: %s", body)
+		}
+	}
+
+	w = testAPIRequest(t, "POST", "http://localhost/maintenance-windows", window("database", now.Add(-time.Minute), now.Add(time.Hour), `, "people": ["lancelot"], "content_pattern": "(?i)database"`))
+	if w.Code != 200 {
+		t.Fatalf("CreateMaintenanceWindow request failed: %s", w.Body)
+	}
+
+	notify := func(username, content string) NotifyPersonResponse {
+		w := testAPIRequest(t, "POST", "http://localhost/people/"+username+"/notify", `{"content": "`+content+`"}`)
+		if w.Code != 200 {
+			t.Fatalf("NotifyPerson request failed: %s", w.Body)
+		}
+		var res NotifyPersonResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+	status := func(id string) NotificationStatusResponse {
+		var res NotificationStatusResponse
+		w := testAPIRequest(t, "GET", "http://localhost/notifications/"+id, "")
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+
+	// Matching notifications are recorded, but nobody is woken up
+	res := notify("lancelot", "The database is down")
+	if !strings.Contains(res.Message, "suppressed by maintenance window database") {
+		t.Errorf("Expected the notification to be suppressed: %+v", res)
+	}
+	if s := status(res.UUID); s.State != StateEnded || s.Outcome != OutcomeSuppressed || s.Window != "database" {
+		t.Errorf("Unexpected status of a suppressed notification: %+v", s)
+	}
+
+	// Anything else is delivered as usual
+	res = notify("lancelot", "The castle is on fire")
+	waitFor(t, "SMS notification", func() bool { return len(mockProvider.SentSMS()) == 1 })
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+res.UUID, "")
+	waitFor(t, "acknowledgement", func() bool { return !notificationInProgress(res.UUID) })
+
+	// A window can hold notifications back until it's over, unless they're resolved first
+	w = testAPIRequest(t, "POST", "http://localhost/maintenance-windows", window("network", now.Add(-time.Minute), now.Add(time.Hour), `, "teams": ["knights"], "deliver": true`))
+	if w.Code != 200 {
+		t.Fatalf("CreateMaintenanceWindow request failed: %s", w.Body)
+	}
+
+	held := notify("galahad", "The drawbridge is stuck")
+	if s := status(held.UUID); s.State != StateSuppressed || s.DeliverAt == nil || s.Window != "network" {
+		t.Errorf("Unexpected status of a held notification: %+v", s)
+	}
+	resolved := notify("galahad", "The moat is empty")
+	w = testAPIRequest(t, "DELETE", "http://localhost/notifications/"+resolved.UUID, "")
+	if w.Code != 200 {
+		t.Errorf("Could not resolve a held notification: %s", w.Body)
+	}
+	if s := status(resolved.UUID); s.Outcome != OutcomeResolved {
+		t.Errorf("Unexpected status of a resolved notification: %+v", s)
+	}
+
+	// Ending the window early delivers what it held
+	w = testAPIRequest(t, "PUT", "http://localhost/maintenance-windows/network", window("", now.Add(-time.Minute), time.Now().Add(50*time.Millisecond), `, "teams": ["knights"], "deliver": true`))
+	if w.Code != 200 {
+		t.Fatalf("UpdateMaintenanceWindow request failed: %s", w.Body)
+	}
+
+	waitFor(t, "delivery", func() bool { return len(mockProvider.SentEmails()) == 1 })
+	if e := mockProvider.SentEmails()[0]; !strings.Contains(e.Plain, "[after maintenance] The drawbridge is stuck") {
+		t.Errorf("Expected the delivered e-mail to say it was held: %+v", e)
+	}
+	if s := status(held.UUID); s.State != StateNotifying || s.Window != "network" {
+		t.Errorf("Unexpected status of a delivered notification: %+v", s)
+	}
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+held.UUID, "")
+	waitFor(t, "acknowledgement", func() bool { return !notificationInProgress(held.UUID) })
+
+	if len(mockProvider.SentEmails()) != 1 {
+		t.Errorf("Expected the resolved notification never to be delivered: %+v", mockProvider.SentEmails())
+	}
+
+	// Group notifications are suppressed for the people in a window too
+	w = testAPIRequest(t, "POST", "http://localhost/maintenance-windows", window("drills", now.Add(-time.Minute), now.Add(time.Hour), `, "teams": ["knights"]`))
+	if w.Code != 200 {
+		t.Fatalf("CreateMaintenanceWindow request failed: %s", w.Body)
+	}
+
+	groupStatus := func(id string) NotificationGroupResponse {
+		var res NotificationGroupResponse
+		w := testAPIRequest(t, "GET", "http://localhost/notify/"+id, "")
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+
+	w = testAPIRequest(t, "POST", "http://localhost/notify", `{"content": "The castle is on fire", "usernames": ["lancelot"], "team": "knights"}`)
+	if w.Code != 200 {
+		t.Fatalf("NotifyGroup request failed: %s", w.Body)
+	}
+	var g NotificationGroupResponse
+	json.Unmarshal(w.Body.Bytes(), &g)
+	if !strings.Contains(g.Message, "1 of 2 members suppressed by maintenance windows or rate limits") {
+		t.Errorf("Expected one member to be suppressed: %+v", g)
+	}
+
+	waitFor(t, "SMS notification", func() bool { return len(mockProvider.SentSMS()) == 2 })
+	members := make(map[string]GroupMember)
+	for _, m := range groupStatus(g.UUID).Members {
+		members[m.Username] = m
+	}
+	if m := members["galahad"]; m.State != StateEnded || m.Outcome != OutcomeSuppressed {
+		t.Errorf("Unexpected status of a suppressed group member: %+v", m)
+	}
+	if len(mockProvider.SentEmails()) != 1 {
+		t.Errorf("Expected the suppressed group member not to be e-mailed: %+v", mockProvider.SentEmails())
+	}
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+members["lancelot"].UUID, "")
+	waitFor(t, "group completion", func() bool { return groupStatus(g.UUID).Completed != nil })
+	if gs := groupStatus(g.UUID); gs.Outcome != OutcomeAcknowledged {
+		t.Errorf("Unexpected outcome of a group with a suppressed member: %+v", gs)
+	}
+
+	// A group where everyone is suppressed is over straight away
+	w = testAPIRequest(t, "POST", "http://localhost/notify", `{"content": "The castle is on fire", "team": "knights"}`)
+	if w.Code != 200 {
+		t.Fatalf("NotifyGroup request failed: %s", w.Body)
+	}
+	json.Unmarshal(w.Body.Bytes(), &g)
+	if gs := groupStatus(g.UUID); gs.Completed == nil || gs.Outcome != OutcomeSuppressed {
+		t.Errorf("Unexpected status of a group where everyone was suppressed: %+v", gs)
+	}
+
+	w = testAPIRequest(t, "GET", "http://localhost/maintenance-windows", "")
+	if !strings.Contains(w.Body.String(), `"name":"database"`) || !strings.Contains(w.Body.String(), `"name":"drills"`) {
+		t.Errorf("Unexpected maintenance windows: %s", w.Body)
+	}
+	if strings.Contains(w.Body.String(), `"name":"network"`) {
+		t.Errorf("Expected a window that has ended and delivered everything to be removed: %s", w.Body)
+	}
+	w = testAPIRequest(t, "DELETE", "http://localhost/maintenance-windows/database", "")
+	if w.Code != 200 {
+		t.Errorf("DeleteMaintenanceWindow request failed: %s", w.Body)
+	}
+	w = testAPIRequest(t, "GET", "http://localhost/maintenance-windows/database", "")
+	if w.Code != 404 {
+		t.Errorf("Expected the deleted window to be gone: %s", w.Body)
+	}
+}
@@ -6,14 +6,29 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/twinj/uuid"
 )
 
 type NotificationRequest struct {
-	Content string            `json:"content"`
-	Plan    *NotificationPlan `json:"-"`
+	Content string `json:"content"`
+	ContentFields
+	Plan   *NotificationPlan `json:"-"`
+	Person *Person           `json:"-"`
+
+	// Set when a notification that was interrupted by a shutdown is resumed
+	Checkpoint *NotificationCheckpoint `json:"-"`
+
+	// Set when another person's plan gave up and handed this notification on to us
+	FallbackFor string `json:"-"`
+
+	// Set when this is one person's notification in a NotificationGroup
+	Group string `json:"-"`
+
+	// Set when a maintenance window held this notification back until it ended
+	Window string `json:"-"`
 }
 
 type NotifyPersonResponse struct {
@@ -51,6 +66,14 @@ func NotifyPerson(w http.ResponseWriter, r *http.Request) {
 
 	err = json.Unmarshal(body, &req)
 
+	err = prepareContent(&req.Content, &req.ContentFields)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
 	req.Plan, err = c.GetNotificationPlan(username)
 	if err != nil {
 		// res.Error = err.Error()
@@ -59,11 +82,70 @@ func NotifyPerson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// We need the Person to personalize their messages
+	req.Person, err = c.GetPerson(username)
+	if err != nil {
+		logger.Warn("Could not fetch person for notification", "username", username, "err", err)
+		req.Person = &Person{Username: username}
+	}
+
 	// Assign a UUID to this notification.  The UUID is used to track notifications-in-progress (NIP) and to stop
 	// them when requested.
-	uuid.SwitchFormat(uuid.CleanHyphen)
 	req.Plan.ID = uuid.NewV4()
 
+	// During maintenance, the notification is recorded but not delivered, at least until the window ends
+	if mw := openMaintenanceWindow(username, req.Content); mw != nil {
+		id := req.Plan.ID.String()
+		err := suppressNotification(mw, &req)
+		if err != nil {
+			logger.Error("Could not record suppressed notification", "username", username, "window", mw.Name, "err", err)
+			w.WriteHeader(422) // unprocessable entity
+			res.Error = err.Error()
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+
+		logger.Info("Notification suppressed by maintenance window", "uuid", id, "username", username, "window", mw.Name, "deliver", mw.Deliver)
+
+		res = NotifyPersonResponse{
+			Message:  fmt.Sprint("Notification suppressed by maintenance window ", mw.Name),
+			Content:  req.Content,
+			UUID:     id,
+			Username: username,
+		}
+		if mw.Deliver {
+			res.Message = fmt.Sprint(res.Message, ".  It will be delivered when the window ends unless it's stopped first.")
+		}
+
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// In a storm, the notification is folded into a summary that's sent when the rate limit's period is up
+	if limit := limiter.allow(username, c.CurrentConfig().RateLimits); limit != "" {
+		id := req.Plan.ID.String()
+		summary, err := throttleNotification(&req, limit)
+		if err != nil {
+			logger.Error("Could not record throttled notification", "username", username, "err", err)
+			w.WriteHeader(422) // unprocessable entity
+			res.Error = err.Error()
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+
+		logger.Warn("Notification throttled", "uuid", id, "username", username, "limit", limit, "summary", summary)
+
+		res = NotifyPersonResponse{
+			Message:  fmt.Sprint("Notification throttled (", limit, ").  It will be included in summary ", summary, " when the rate limit period is up."),
+			Content:  req.Content,
+			UUID:     id,
+			Username: username,
+		}
+
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
 	// Send our NotificationRequest to the notification engine
 	planChan <- &req
 
@@ -78,7 +160,9 @@ func NotifyPerson(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// Stop a notification-in-progress (NIP) by sending the UUID to the notification engine
+// Stop a notification-in-progress (NIP) by sending the UUID to the notification engine.  With a snooze
+// parameter, the notification is acknowledged for that long instead, and re-triggered afterwards unless it's
+// stopped (resolved) in the meantime.
 func StopNotification(w http.ResponseWriter, r *http.Request) {
 	var res NotifyPersonResponse
 
@@ -87,7 +171,18 @@ func StopNotification(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-	if _, exists := NIP.Stoppers[id]; !exists {
+	// A notification that's being held back by a maintenance window is resolved before it's ever delivered
+	if resolveSuppressed(id) {
+		recordAcknowledgement(id, AckChannelAPI)
+		res = NotifyPersonResponse{
+			Message: "Suppressed notification resolved",
+			UUID:    id,
+		}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	if !notificationInProgress(id) {
 		res = NotifyPersonResponse{
 			Error: "No active notifications for this UUID",
 			UUID:  id,
@@ -97,8 +192,18 @@ func StopNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Attempt to stop the notification by sending the UUID to the notification engine
-	stopChan <- id
+	snooze, err := ackSnooze(r)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res = NotifyPersonResponse{
+			Error: err.Error(),
+			UUID:  id,
+		}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	acknowledgeNotification(id, AckChannelAPI, snooze)
 
 	// TO DO: make sure that this is a valid UUID and obtain
 	//        confirmation of deletion
@@ -107,6 +212,9 @@ func StopNotification(w http.ResponseWriter, r *http.Request) {
 		Message: "Attempting to terminate notification",
 		UUID:    id,
 	}
+	if snooze > 0 {
+		res.Message = fmt.Sprint("Notification acknowledged.  It will be re-triggered in ", formatDuration(snooze), " unless it's resolved.")
+	}
 
 	json.NewEncoder(w).Encode(res)
 }
@@ -119,13 +227,143 @@ func StopNotificationClick(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 
-	if _, exists := NIP.Stoppers[id]; !exists {
+	if !notificationInProgress(id) {
 		http.Error(w, fmt.Sprint("UUID not found."), http.StatusNotFound)
 		return
 	}
 
-	// Attempt to stop the notification by sending the UUID to the notification engine
-	stopChan <- id
+	snooze, err := ackSnooze(r)
+	if err != nil {
+		http.Error(w, err.Error(), 422)
+		return
+	}
+
+	acknowledgeNotification(id, AckChannelEmailClick, snooze)
+
+	if snooze > 0 {
+		fmt.Fprintln(w, "<html><body><b>Thank you!</b><br><br>Chicken Little has received your acknowledgement.  If this message isn't resolved in", formatDuration(snooze)+", you will be notified again.</body></html>")
+		return
+	}
 
 	fmt.Fprintln(w, "<html><body><b>Thank you!</b><br><br>Chicken Little has received your acknowledgement and you will no longer be notified with this message.</body></html>")
 }
+
+// The snooze that an acknowledgement made through the API or an e-mail link was given, if any
+func ackSnooze(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("snooze")
+	if s == "" {
+		return 0, nil
+	}
+
+	return parseSnoozeDuration(s)
+}
+
+type NotificationStatusResponse struct {
+	UUID     string `json:"uuid"`
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	ContentFields
+	Step         int        `json:"step"`
+	State        string     `json:"state"`
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty"`
+	RetriggerAt  *time.Time `json:"retrigger_at,omitempty"`
+	Retriggers   int        `json:"retriggers"`
+	Escalations  int        `json:"escalations"`
+	Attempts     int        `json:"attempts"`
+	Outcome      string     `json:"outcome,omitempty"`
+	Ended        *time.Time `json:"ended,omitempty"`
+	FallbackFor  string     `json:"fallback_for,omitempty"`
+	FallbackUUID string     `json:"fallback_uuid,omitempty"`
+	Group        string     `json:"group,omitempty"`
+	TakenBy      string     `json:"taken_by,omitempty"`
+	Window       string     `json:"window,omitempty"`
+	Summary      string     `json:"summary,omitempty"`
+	DeliverAt    *time.Time `json:"deliver_at,omitempty"` // When a suppressed notification will be delivered
+	Message      string     `json:"message"`
+	Error        string     `json:"error"`
+}
+
+// Show the progress of a notification-in-progress (NIP): which plan step it's on and whether it's been
+// escalated or snoozed.  Notifications that are over are shown from their record, with their outcome.
+func ShowNotification(w http.ResponseWriter, r *http.Request) {
+	var res NotificationStatusResponse
+
+	vars := mux.Vars(r)
+	id := vars["uuid"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	NIP.Mu.Lock()
+	nr, exists := NIP.Requests[id]
+	status := NIP.Status[id]
+	if exists && status != nil {
+		res = NotificationStatusResponse{
+			UUID:          id,
+			Username:      nr.Plan.Username,
+			Content:       nr.Content,
+			ContentFields: nr.ContentFields,
+			Step:          NIP.Steps[id],
+			State:         status.State,
+			SnoozedUntil:  status.SnoozedUntil,
+			RetriggerAt:   status.RetriggerAt,
+			Retriggers:    status.Retriggers,
+			Escalations:   status.Escalations,
+			Attempts:      status.Attempts,
+			FallbackFor:   nr.FallbackFor,
+			Group:         nr.Group,
+			Window:        nr.Window,
+		}
+	}
+	NIP.Mu.Unlock()
+
+	if !exists || status == nil {
+		if rec, err := c.GetNotificationRecord(id); err == nil {
+			json.NewEncoder(w).Encode(NotificationStatusResponse{
+				UUID:          rec.UUID,
+				Username:      rec.Username,
+				Content:       rec.Content,
+				ContentFields: rec.ContentFields,
+				Step:          rec.Step,
+				State:         StateEnded,
+				Escalations:   rec.Escalations,
+				Retriggers:    rec.Retriggers,
+				Attempts:      rec.Attempts,
+				Outcome:       rec.Outcome,
+				Ended:         &rec.Ended,
+				FallbackFor:   rec.FallbackFor,
+				FallbackUUID:  rec.FallbackUUID,
+				Group:         rec.Group,
+				TakenBy:       rec.TakenBy,
+				Window:        rec.Window,
+				Summary:       rec.Summary,
+			})
+			return
+		}
+
+		if sn, err := c.GetSuppressedNotification(id); err == nil {
+			res = NotificationStatusResponse{
+				UUID:          sn.UUID,
+				Username:      sn.Username,
+				Content:       sn.Content,
+				ContentFields: sn.ContentFields,
+				State:         StateSuppressed,
+				Window:        sn.Window,
+			}
+			if mw, err := c.GetMaintenanceWindow(sn.Window); err == nil {
+				res.DeliverAt = &mw.End
+			}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+
+		res = NotificationStatusResponse{
+			Error: "No active notifications for this UUID",
+			UUID:  id,
+		}
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/twinj/uuid"
+)
+
+// NotifyGroupRequest asks for several people to be notified at once.  They can be listed by username, named
+// by team, or both.
+type NotifyGroupRequest struct {
+	Content string `json:"content"`
+	ContentFields
+	Usernames []string     `json:"usernames,omitempty"`
+	Team      string       `json:"team,omitempty"`
+	Mode      string       `json:"mode,omitempty"`    // GroupModeFirst (the default) or GroupModeAll
+	Timeout   planDuration `json:"timeout,omitempty"` // How long people have to acknowledge, if there's a limit
+}
+
+type NotificationGroupResponse struct {
+	UUID    string `json:"uuid"`
+	Content string `json:"content"`
+	ContentFields
+	Team           string        `json:"team,omitempty"`
+	Mode           string        `json:"mode"`
+	Members        []GroupMember `json:"members"`
+	Deadline       *time.Time    `json:"deadline,omitempty"`
+	AcknowledgedBy string        `json:"acknowledged_by,omitempty"`
+	Acknowledged   *time.Time    `json:"acknowledged,omitempty"`
+	Completed      *time.Time    `json:"completed,omitempty"`
+	Outcome        string        `json:"outcome,omitempty"`
+	Message        string        `json:"message"`
+	Error          string        `json:"error"`
+}
+
+// Notifies several people at once, each with their own plan, under a single group.  Depending on the group's
+// mode, either the first of them to acknowledge takes the group and everyone else's notifications are stopped,
+// or everyone is notified until they acknowledge it themselves.
+func NotifyGroup(w http.ResponseWriter, r *http.Request) {
+	var res NotificationGroupResponse
+	var req NotifyGroupRequest
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024*20))
+	// If something went wrong, return an error in the JSON response
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = r.Body.Close()
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err == nil {
+		warnNanosecondPeriods(body)
+		err = prepareContent(&req.Content, &req.ContentFields)
+	}
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	switch req.Mode {
+	case "":
+		req.Mode = GroupModeFirst
+	case GroupModeFirst, GroupModeAll:
+	default:
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "mode must be first or all"
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	if req.Timeout < 0 {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "timeout can't be negative"
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	usernames := req.Usernames
+	if req.Team != "" {
+		t, err := c.GetTeam(req.Team)
+		if err != nil {
+			w.WriteHeader(422) // unprocessable entity
+			res.Error = fmt.Sprint("Team ", req.Team, " does not exist")
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		usernames = append(usernames, t.Members...)
+	}
+
+	// Everyone is notified once, even if they're listed and in the team too
+	var members []string
+	seen := make(map[string]bool)
+	for _, u := range usernames {
+		if !seen[u] {
+			seen[u] = true
+			members = append(members, u)
+		}
+	}
+
+	if len(members) == 0 {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "Must provide usernames or a team with members"
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Fetch everyone's plans before we start notifying any of them
+	var reqs []*NotificationRequest
+	var noPlan []string
+	for _, u := range members {
+		plan, err := c.GetNotificationPlan(u)
+		if err != nil {
+			noPlan = append(noPlan, u)
+			continue
+		}
+
+		p, err := c.GetPerson(u)
+		if err != nil {
+			logger.Warn("Could not fetch person for notification", "username", u, "err", err)
+			p = &Person{Username: u}
+		}
+
+		reqs = append(reqs, &NotificationRequest{Content: req.Content, ContentFields: req.ContentFields, Plan: plan, Person: p})
+	}
+	if len(noPlan) > 0 {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("No notification plan for ", strings.Join(noPlan, ", "))
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	g := &NotificationGroup{
+		UUID:          uuid.NewV4().String(),
+		Content:       req.Content,
+		ContentFields: req.ContentFields,
+		Team:          req.Team,
+		Mode:          req.Mode,
+		Started:       time.Now(),
+	}
+	if req.Timeout > 0 {
+		deadline := g.Started.Add(time.Duration(req.Timeout))
+		g.Deadline = &deadline
+	}
+	for _, nr := range reqs {
+		nr.Plan.ID = uuid.NewV4()
+		nr.Group = g.UUID
+		g.Members = append(g.Members, GroupMember{Username: nr.Plan.Username, UUID: nr.Plan.ID.String()})
+	}
+
+	// The group has to be stored before anyone can acknowledge it
+	err = c.StoreNotificationGroup(g)
+	if err != nil {
+		logger.Error("Could not store notification group", "group", g.UUID, "err", err)
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	logger.Info("Notifying group", "group", g.UUID, "team", g.Team, "mode", g.Mode, "members", len(g.Members))
+
+	// Send our NotificationRequests to the notification engine, except for people in a maintenance window or over
+	// a rate limit
+	suppressed := 0
+	for _, nr := range reqs {
+		if holdBack(nr) {
+			suppressed++
+			continue
+		}
+
+		planChan <- nr
+	}
+
+	// If everyone was held back, nobody else will complete the group
+	if suppressed > 0 {
+		groupMemberEnded(g.UUID)
+	}
+
+	scheduleGroupExpiry(g)
+
+	res = NotificationGroupResponse{
+		UUID:          g.UUID,
+		Content:       g.Content,
+		ContentFields: g.ContentFields,
+		Team:          g.Team,
+		Mode:          g.Mode,
+		Members:       g.Members,
+		Deadline:      g.Deadline,
+		Message:       "Group notification initiated",
+	}
+	if suppressed > 0 {
+		res.Message = fmt.Sprint(res.Message, ".  ", suppressed, " of ", len(g.Members), " members suppressed by maintenance windows or rate limits.")
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Shows who a group notification went to, where each of their notifications is at, who took it, and whether
+// it's complete
+func ShowNotificationGroup(w http.ResponseWriter, r *http.Request) {
+	var res NotificationGroupResponse
+
+	vars := mux.Vars(r)
+	id := vars["uuid"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	g, err := c.GetNotificationGroup(id)
+	if err != nil {
+		res.UUID = id
+		res.Error = "No group notification with this UUID"
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusNotFound)
+		return
+	}
+
+	g.memberStatus()
+
+	res = NotificationGroupResponse{
+		UUID:           g.UUID,
+		Content:        g.Content,
+		ContentFields:  g.ContentFields,
+		Team:           g.Team,
+		Mode:           g.Mode,
+		Members:        g.Members,
+		Deadline:       g.Deadline,
+		AcknowledgedBy: g.AcknowledgedBy,
+		Acknowledged:   g.Acknowledged,
+		Completed:      g.Completed,
+		Outcome:        g.Outcome,
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifyGroup(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	people := map[string]string{
+		"lancelot": `[{"method": "sms://+12108675309", "notify_every_period": "1h"}]`,
+		"galahad":  `[{"method": "email://galahad@camelot.example.com", "notify_every_period": "1h"}]`,
+		"robin":    `[{"method": "phone://+12105551212", "notify_every_period": "1h"}]`,
+		"bedevere": "",
+	}
+	for u, plan := range people {
+		w := testAPIRequest(t, "POST", "http://localhost/people", `{"username": "`+u+`", "fullname": "Sir `+strings.Title(u)+`"}`)
+		if w.Code != 200 {
+			t.Fatalf("CreatePerson request failed: %s", w.Body)
+		}
+		if plan == "" {
+			continue
+		}
+		w = testAPIRequest(t, "POST", "http://localhost/plan/"+u, plan)
+		if w.Code != 200 {
+			t.Fatalf("CreateNotificationPlan request failed: %s", w.Body)
+		}
+	}
+
+	// Teams can only have members who exist
+	w := testAPIRequest(t, "POST", "http://localhost/teams", `{"name": "knights", "members": ["lancelot", "mordred"]}`)
+	if w.Code != 422 {
+		t.Errorf("Expected a team with an unknown member to be rejected: %s", w.Body)
+	}
+	w = testAPIRequest(t, "POST", "http://localhost/teams", `{"name": "knights", "members": ["lancelot", "galahad"]}`)
+	if w.Code != 200 {
+		t.Fatalf("CreateTeam request failed: %s", w.Body)
+	}
+
+	// Everyone needs a plan
+	w = testAPIRequest(t, "POST", "http://localhost/notify", `{"content": "The castle is on fire", "usernames": ["bedevere"], "team": "knights"}`)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "No notification plan for bedevere") {
+		t.Errorf("Expected a group with someone who has no plan to be rejected: %s", w.Body)
+	}
+
+	// Lancelot is in the team and listed, but is only notified once
+	w = testAPIRequest(t, "POST", "http://localhost/notify", `{"content": "The castle is on fire", "usernames": ["robin", "lancelot"], "team": "knights"}`)
+	if w.Code != 200 {
+		t.Fatalf("NotifyGroup request failed: %s", w.Body)
+	}
+
+	var res NotificationGroupResponse
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if len(res.Members) != 3 {
+		t.Fatalf("Expected 3 members, got %+v", res.Members)
+	}
+	uuids := make(map[string]string)
+	for _, m := range res.Members {
+		uuids[m.Username] = m.UUID
+	}
+
+	waitFor(t, "everyone to be contacted", func() bool {
+		return len(mockProvider.SentSMS()) == 1 && len(mockProvider.SentEmails()) == 1 && len(mockProvider.PlacedCalls()) == 1
+	})
+
+	// Lancelot acknowledges by SMS, so everyone else is told and stops being notified
+	code := regexp.MustCompile(`"(\d{3})"`).FindStringSubmatch(mockProvider.SentSMS()[0].Body)
+	if code == nil {
+		t.Fatalf("No acknowledgement code in SMS: %+v", mockProvider.SentSMS())
+	}
+	err := mockProvider.ReplySMS("+12108675309", code[1])
+	if err != nil {
+		t.Fatalf("Could not reply to SMS: %s", err)
+	}
+
+	for _, u := range []string{"lancelot", "galahad", "robin"} {
+		id := uuids[u]
+		waitFor(t, u+"'s notification to stop", func() bool { return !notificationInProgress(id) })
+	}
+
+	emails := mockProvider.SentEmails()
+	if len(emails) != 2 || emails[1].To != "galahad@camelot.example.com" || !strings.Contains(emails[1].Subject, "Sir Lancelot") {
+		t.Errorf("Expected galahad to be told by e-mail who took it, got %+v", emails)
+	}
+
+	// Robin was called, but is told by text
+	var told bool
+	for _, s := range mockProvider.SentSMS() {
+		if s.To == "+12105551212" && strings.Contains(s.Body, "Sir Lancelot has acknowledged") {
+			told = true
+		}
+	}
+	if !told {
+		t.Errorf("Expected robin to be told by SMS who took it, got %+v", mockProvider.SentSMS())
+	}
+
+	id := res.UUID
+	waitFor(t, "the group to complete", func() bool {
+		g, err := c.GetNotificationGroup(id)
+		return err == nil && g.Completed != nil
+	})
+
+	w = testAPIRequest(t, "GET", "http://localhost/notify/"+id, "")
+	res = NotificationGroupResponse{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if res.AcknowledgedBy != "lancelot" || res.Acknowledged == nil || res.Outcome != OutcomeAcknowledged {
+		t.Errorf("Unexpected group status: %s", w.Body)
+	}
+	for _, m := range res.Members {
+		want := OutcomeTaken
+		if m.Username == "lancelot" {
+			want = OutcomeAcknowledged
+		}
+		if m.State != StateEnded || m.Outcome != want {
+			t.Errorf("Expected %v's notification to be %v, got %+v", m.Username, want, m)
+		}
+	}
+
+	w = testAPIRequest(t, "GET", "http://localhost/notifications/"+uuids["galahad"], "")
+	if !strings.Contains(w.Body.String(), `"taken_by":"lancelot"`) {
+		t.Errorf("Unexpected notification status: %s", w.Body)
+	}
+
+	// When two people acknowledge at once, only one of them takes the group
+	notifyKnights := func() (string, map[string]string) {
+		w := testAPIRequest(t, "POST", "http://localhost/notify", `{"content": "The moat is empty", "team": "knights"}`)
+		if w.Code != 200 {
+			t.Fatalf("NotifyGroup request failed: %s", w.Body)
+		}
+		var res NotificationGroupResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		uuids := make(map[string]string)
+		for _, m := range res.Members {
+			uuids[m.Username] = m.UUID
+			id := m.UUID
+			waitFor(t, m.Username+"'s notification to start", func() bool { return notificationInProgress(id) })
+		}
+		return res.UUID, uuids
+	}
+
+	id, uuids = notifyKnights()
+	var wg sync.WaitGroup
+	for _, u := range []string{"lancelot", "galahad"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			testAPIRequest(t, "DELETE", "http://localhost/notifications/"+id, "")
+		}(uuids[u])
+	}
+	wg.Wait()
+	waitFor(t, "the group to complete", func() bool {
+		g, err := c.GetNotificationGroup(id)
+		return err == nil && g.Completed != nil
+	})
+
+	g, _ := c.GetNotificationGroup(id)
+	for u, mid := range uuids {
+		rec, err := c.GetNotificationRecord(mid)
+		if err != nil {
+			t.Fatalf("No notification record for %v: %s", u, err)
+		}
+		if u == g.AcknowledgedBy && rec.Outcome != OutcomeAcknowledged {
+			t.Errorf("Expected %v, who took the group, to have acknowledged: %+v", u, rec)
+		}
+		if u != g.AcknowledgedBy && (rec.Outcome != OutcomeTaken || rec.TakenBy != g.AcknowledgedBy) {
+			t.Errorf("Expected %v's notification to have been taken by %v: %+v", u, g.AcknowledgedBy, rec)
+		}
+	}
+
+	// Someone who acknowledges just after the group was taken ends up taken too, and is told who took it
+	n := len(mockProvider.SentSMS())
+	id, uuids = notifyKnights()
+	waitFor(t, "SMS notification", func() bool { return len(mockProvider.SentSMS()) > n })
+	g, _ = c.GetNotificationGroup(id)
+	now := time.Now()
+	g.AcknowledgedBy, g.Acknowledged = "galahad", &now
+	c.StoreNotificationGroup(g)
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+uuids["lancelot"], "")
+	lid := uuids["lancelot"]
+	waitFor(t, "lancelot's notification to stop", func() bool { return !notificationInProgress(lid) })
+
+	if rec, err := c.GetNotificationRecord(lid); err != nil || rec.Outcome != OutcomeTaken || rec.TakenBy != "galahad" {
+		t.Errorf("Expected lancelot's late acknowledgement to end as taken by galahad: %+v %v", rec, err)
+	}
+	sms := mockProvider.SentSMS()
+	if last := sms[len(sms)-1]; last.To != "+12108675309" || !strings.Contains(last.Body, "Sir Galahad has acknowledged") {
+		t.Errorf("Expected lancelot to be told that galahad took it, got %+v", last)
+	}
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+uuids["galahad"], "")
+	gid := uuids["galahad"]
+	waitFor(t, "galahad's notification to stop", func() bool { return !notificationInProgress(gid) })
+}
+
+func TestBroadcast(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	for _, u := range []string{"lancelot", "galahad", "robin"} {
+		w := testAPIRequest(t, "POST", "http://localhost/people", `{"username": "`+u+`", "fullname": "Sir `+strings.Title(u)+`"}`)
+		if w.Code != 200 {
+			t.Fatalf("CreatePerson request failed: %s", w.Body)
+		}
+		w = testAPIRequest(t, "POST", "http://localhost/plan/"+u, `[{"method": "email://`+u+`@camelot.example.com", "notify_every_period": "1h"}]`)
+		if w.Code != 200 {
+			t.Fatalf("CreateNotificationPlan request failed: %s", w.Body)
+		}
+	}
+
+	w := testAPIRequest(t, "POST", "http://localhost/notify", `{"content": "Assemble at the Round Table", "usernames": ["lancelot"], "mode": "some"}`)
+	if w.Code != 422 {
+		t.Errorf("Expected an unknown mode to be rejected: %s", w.Body)
+	}
+
+	notify := func(body string) NotificationGroupResponse {
+		w := testAPIRequest(t, "POST", "http://localhost/notify", body)
+		if w.Code != 200 {
+			t.Fatalf("NotifyGroup request failed: %s", w.Body)
+		}
+		var res NotificationGroupResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+	show := func(id string) NotificationGroupResponse {
+		w := testAPIRequest(t, "GET", "http://localhost/notify/"+id, "")
+		var res NotificationGroupResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+
+	// Everyone has to acknowledge for themselves
+	res := notify(`{"content": "Assemble at the Round Table", "usernames": ["lancelot", "galahad"], "mode": "all"}`)
+	waitFor(t, "everyone to be contacted", func() bool { return len(mockProvider.SentEmails()) == 2 })
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+res.Members[0].UUID, "")
+	waitFor(t, "lancelot's notification to stop", func() bool { return !notificationInProgress(res.Members[0].UUID) })
+
+	status := show(res.UUID)
+	if status.Completed != nil || status.Members[0].Outcome != OutcomeAcknowledged || status.Members[0].Ended == nil || status.Members[1].State != StateNotifying {
+		t.Errorf("Unexpected group status after one acknowledgement: %+v", status)
+	}
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+res.Members[1].UUID, "")
+	waitFor(t, "the group to complete", func() bool { return show(res.UUID).Completed != nil })
+
+	if status = show(res.UUID); status.Outcome != OutcomeAcknowledged || status.AcknowledgedBy != "" {
+		t.Errorf("Unexpected group status after everyone acknowledged: %+v", status)
+	}
+
+	// Whoever hasn't acknowledged by the timeout is given up on
+	res = notify(`{"content": "Assemble at the Round Table", "usernames": ["lancelot", "robin"], "mode": "all", "timeout": "100ms"}`)
+	if res.Deadline == nil {
+		t.Errorf("Expected a deadline: %+v", res)
+	}
+	waitFor(t, "everyone to be contacted", func() bool { return len(mockProvider.SentEmails()) == 4 })
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+res.Members[0].UUID, "")
+	waitFor(t, "the group to time out", func() bool { return show(res.UUID).Completed != nil })
+
+	status = show(res.UUID)
+	if status.Outcome != OutcomeUnacknowledged || status.Members[0].Outcome != OutcomeAcknowledged || status.Members[1].Outcome != OutcomeUnacknowledged {
+		t.Errorf("Unexpected group status after the timeout: %+v", status)
+	}
+	if len(mockProvider.SentEmails()) != 4 {
+		t.Errorf("Nobody should be told about a broadcast that timed out: %+v", mockProvider.SentEmails())
+	}
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -15,6 +15,48 @@ type NotificationPlanResponse struct {
 	NotificationPlan NotificationPlan `json:"people"`
 	Message          string           `json:"message"`
 	Error            string           `json:"error"`
+	Errors           []FieldError     `json:"errors,omitempty"`
+}
+
+// The body of a create or update request is either an array of steps or, to set the plan's on_exhausted
+// action too, an object with the steps in it.  Instead of steps, the object can name a plan template.
+type notificationPlanRequest struct {
+	Template    string             `json:"template,omitempty"`
+	Steps       []NotificationStep `json:"steps"`
+	OnExhausted *ExhaustedAction   `json:"on_exhausted,omitempty"`
+}
+
+func (pr *notificationPlanRequest) UnmarshalJSON(b []byte) error {
+	if t := bytes.TrimSpace(b); len(t) > 0 && t[0] == '[' {
+		return json.Unmarshal(t, &pr.Steps)
+	}
+
+	type request notificationPlanRequest
+	return json.Unmarshal(b, (*request)(pr))
+}
+
+// Returns the steps and on_exhausted action that a request gives Person p, filling them in from a template
+// if the request names one
+func (pr *notificationPlanRequest) resolve(p *Person) ([]NotificationStep, *ExhaustedAction, []FieldError) {
+	if pr.Template == "" {
+		return pr.Steps, pr.OnExhausted, nil
+	}
+
+	if len(pr.Steps) > 0 || pr.OnExhausted != nil {
+		return nil, nil, []FieldError{{Field: "template", Message: "can't be used with steps or on_exhausted"}}
+	}
+
+	pt, err := c.GetPlanTemplate(pr.Template)
+	if err != nil {
+		return nil, nil, []FieldError{{Field: "template", Message: fmt.Sprintf("there is no plan template named %v", pr.Template)}}
+	}
+
+	steps, errs := pt.StepsFor(p)
+	for i := range errs {
+		errs[i].Field = "template." + errs[i].Field
+	}
+
+	return steps, pt.OnExhausted, errs
 }
 
 // Return a JSON-formatted NotificationPlan for a Person
@@ -46,7 +88,7 @@ func DeleteNotificationPlan(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["person"]
 
-	np, err := c.GetNotificationPlan(username)
+	np, err := c.getStoredNotificationPlan(username)
 	if np == nil {
 		w.WriteHeader(422) // unprocessable entity
 		res.Error = fmt.Sprint("Notification plan for user ", username, " doesn't exist and thus, cannot be deleted")
@@ -54,7 +96,7 @@ func DeleteNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("GetNotificationPlan() failed for", username)
+		logger.Debug("No existing notification plan", "username", username, "err", err)
 	}
 
 	err = c.DeleteNotificationPlan(username)
@@ -72,7 +114,7 @@ func DeleteNotificationPlan(w http.ResponseWriter, r *http.Request) {
 // Create a NotificationPlan for a Person
 func CreateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 	var res NotificationPlanResponse
-	var p []NotificationStep
+	var pr notificationPlanRequest
 
 	vars := mux.Vars(r)
 	username := vars["person"]
@@ -94,7 +136,7 @@ func CreateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = json.Unmarshal(body, &p)
+	err = json.Unmarshal(body, &pr)
 
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
@@ -104,6 +146,8 @@ func CreateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	warnNanosecondPeriods(body)
+
 	if username == "" {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(422) // unprocessable entity
@@ -121,7 +165,21 @@ func CreateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("GetPerson() failed:", err)
+		logger.Debug("Could not fetch person", "username", username, "err", err)
+	}
+
+	// A template's placeholders are filled in from the person's contact info
+	if fp == nil {
+		fp = &Person{Username: username}
+	}
+	p, oe, errs := pr.resolve(fp)
+	if len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "Notification plan is invalid"
+		res.Errors = errs
+		json.NewEncoder(w).Encode(res)
+		return
 	}
 
 	// The NotificationPlan provided must have at least one NotificationStep
@@ -133,7 +191,27 @@ func CreateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	np, err := c.GetNotificationPlan(username)
+	// Every step needs a method we can use and timing that makes sense, and giving up needs somewhere to go
+	if errs := append(validateSteps(p), validateOnExhausted(oe, username)...); len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "Notification plan is invalid"
+		res.Errors = errs
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Make sure that any phone calls in the plan can be acknowledged
+	err = validateStepVoiceOptions(p, fp)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	np, err := c.getStoredNotificationPlan(username)
 	if np != nil && np.Username != "" {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(422) // unprocessable entity
@@ -142,14 +220,14 @@ func CreateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("GetNotificationPlan() failed for", username)
+		logger.Debug("No existing notification plan", "username", username, "err", err)
 	}
 
-	plan := NotificationPlan{Username: username, Steps: p}
+	plan := NotificationPlan{Username: username, Template: pr.Template, Steps: p, OnExhausted: oe}
 
 	err = c.StoreNotificationPlan(&plan)
 	if err != nil {
-		log.Println("Error storing notification plan:", err)
+		logger.Error("Could not store notification plan", "username", username, "err", err)
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(422) // unprocessable entity
 		res.Error = err.Error()
@@ -165,7 +243,7 @@ func CreateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 // Updates a NotificationPlan for a Person
 func UpdateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 	var res NotificationPlanResponse
-	var p []NotificationStep
+	var pr notificationPlanRequest
 
 	vars := mux.Vars(r)
 	username := vars["person"]
@@ -187,7 +265,7 @@ func UpdateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = json.Unmarshal(body, &p)
+	err = json.Unmarshal(body, &pr)
 
 	if err != nil {
 		w.WriteHeader(422) // unprocessable entity
@@ -196,6 +274,8 @@ func UpdateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	warnNanosecondPeriods(body)
+
 	if username == "" {
 		w.WriteHeader(422) // unprocessable entity
 		res.Error = "Must provide username in URL"
@@ -211,7 +291,21 @@ func UpdateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("GetPerson() failed:", err)
+		logger.Debug("Could not fetch person", "username", username, "err", err)
+	}
+
+	// A template's placeholders are filled in from the person's contact info
+	if fp == nil {
+		fp = &Person{Username: username}
+	}
+	p, oe, errs := pr.resolve(fp)
+	if len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "Notification plan is invalid"
+		res.Errors = errs
+		json.NewEncoder(w).Encode(res)
+		return
 	}
 
 	// The NotificationPlan provided must have at least one NotificationStep
@@ -223,7 +317,27 @@ func UpdateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	np, err := c.GetNotificationPlan(username)
+	// Every step needs a method we can use and timing that makes sense, and giving up needs somewhere to go
+	if errs := append(validateSteps(p), validateOnExhausted(oe, username)...); len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "Notification plan is invalid"
+		res.Errors = errs
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Make sure that any phone calls in the plan can be acknowledged
+	err = validateStepVoiceOptions(p, fp)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	np, err := c.getStoredNotificationPlan(username)
 	if (np != nil && np.Username == "") || np == nil {
 		w.WriteHeader(422) // unprocessable entity
 		res.Error = fmt.Sprint("Notification plan for user ", username, " doesn't exist. Use POST /plan/", username, " to create one first before attempting to update.")
@@ -231,15 +345,17 @@ func UpdateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("GetNotificationPlan() failed for", username)
+		logger.Debug("No existing notification plan", "username", username, "err", err)
 	}
 
-	// Replace the NotificationSteps of the fetched plan with those from this request
+	// Replace the template, NotificationSteps and on_exhausted action of the fetched plan with those from this request
+	np.Template = pr.Template
 	np.Steps = p
+	np.OnExhausted = oe
 
 	err = c.StoreNotificationPlan(np)
 	if err != nil {
-		log.Println("Error storing notification plan:", err)
+		logger.Error("Could not store notification plan", "username", username, "err", err)
 		w.WriteHeader(422) // unprocessable entity
 		res.Error = err.Error()
 		json.NewEncoder(w).Encode(res)
@@ -251,3 +367,19 @@ func UpdateNotificationPlan(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(res)
 }
+
+// Checks the voice options of every step in a plan for Person p
+func validateStepVoiceOptions(steps []NotificationStep, p *Person) error {
+	for n, s := range steps {
+		err := s.VoiceOptions.Validate()
+		if err != nil {
+			return fmt.Errorf("Step %v: %v", n+1, err)
+		}
+
+		if s.VoiceOptions != nil && s.VoiceOptions.RequirePIN && (p == nil || p.storedPIN() == "") {
+			return fmt.Errorf("Step %v: voice_options require_pin is set but the user has no pin", n+1)
+		}
+	}
+
+	return nil
+}
@@ -2,34 +2,53 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 const testCreateNotificationPlanJson = `
 [
   {
-    "method": "noop://2108675309",
-    "notify_every_period": 0,
-    "notify_until_period": 300000000000
+    "method": "sms://+12108675309",
+    "notify_every_period": "0s",
+    "notify_until_period": "5m"
   },
   {
-    "method": "noop://2105551212",
-    "notify_every_period": 900000000000,
-    "notify_until_period": 0
+    "method": "phone://+12105551212",
+    "notify_every_period": "15m",
+    "notify_until_period": "0s"
   }
 ]
 `
 
+// Periods in nanoseconds, like plans from older clients
 const testUpdateNotificationPlanJson = `
 [
   {
-    "method": "noop://2108675309",
+    "method": "sms://+12108675309",
+    "notify_every_period": 300000000000,
+    "notify_until_period": 0
+  }
+]
+`
+
+const testInvalidNotificationPlanJson = `
+[
+  {
+    "method": "sms://2108675309",
     "notify_every_period": 0,
-    "notify_until_period": 300000000000
+    "notify_until_period": 0
+  },
+  {
+    "method": "email://lancelot@camelot.example.com",
+    "notify_every_period": 0,
+    "notify_until_period": 0
   }
 ]
 `
@@ -92,6 +111,14 @@ func TestNotificationPlan(t *testing.T) {
 	if w.Code != 200 {
 		t.Errorf("ShowNotificationPlan request failed")
 	}
+	var shown NotificationPlanResponse
+	json.Unmarshal(w.Body.Bytes(), &shown)
+	if steps := shown.NotificationPlan.Steps; len(steps) != 2 || steps[0].NotifyUntilPeriod != 5*time.Minute || steps[1].NotifyEveryPeriod != 15*time.Minute {
+		t.Errorf("Unexpected notification plan: %+v", shown.NotificationPlan)
+	}
+	if !strings.Contains(w.Body.String(), `"notify_every_period":"15m"`) {
+		t.Errorf("Periods were not shown as durations: %s", w.Body)
+	}
 
 	// Test UpdateNotificaitonPlan: PUT /plan/lancelot
 	w = httptest.NewRecorder()
@@ -106,6 +133,24 @@ func TestNotificationPlan(t *testing.T) {
 		t.Errorf("UpdateNotificationPlan request failed")
 	}
 
+	// Test that invalid steps are rejected with an error for each field
+	w = httptest.NewRecorder()
+	p = bytes.NewBufferString(testInvalidNotificationPlanJson)
+	r, err = http.NewRequest("PUT", "http://localhost/plan/lancelot", p)
+	if err != nil {
+		t.Fatalf("Failed to create new HTTP Request: %s", err)
+	}
+	router.ServeHTTP(w, r)
+	// verify response
+	if w.Code != 422 {
+		t.Errorf("Invalid UpdateNotificationPlan request was not rejected: %d", w.Code)
+	}
+	var res NotificationPlanResponse
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if len(res.Errors) != 3 {
+		t.Errorf("Expected 3 field errors, got %+v", res.Errors)
+	}
+
 	// Test DeleteNotificationPlan: DELETE /plan/lancelot
 	w = httptest.NewRecorder()
 	r, err = http.NewRequest("DELETE", "http://localhost/plan/lancelot", nil)
@@ -119,3 +164,146 @@ func TestNotificationPlan(t *testing.T) {
 	}
 
 }
+
+func TestValidateSteps(t *testing.T) {
+	last := NotificationStep{Method: "email://lancelot@camelot.example.com", NotifyEveryPeriod: time.Minute}
+
+	tests := []struct {
+		name   string
+		steps  []NotificationStep
+		fields []string
+	}{
+		{"valid", []NotificationStep{
+			{Method: "sms://+12108675309", NotifyUntilPeriod: time.Minute},
+			{Method: "phone://+442071234567", NotifyUntilPeriod: time.Minute},
+			last,
+		}, nil},
+		{"number without country code", []NotificationStep{{Method: "sms://2108675309", NotifyUntilPeriod: time.Minute}, last}, []string{"steps[0].method"}},
+		{"number with punctuation", []NotificationStep{{Method: "phone://+1-210-867-5309", NotifyUntilPeriod: time.Minute}, last}, []string{"steps[0].method"}},
+		{"bad email", []NotificationStep{{Method: "email://lancelot", NotifyEveryPeriod: time.Minute}}, []string{"steps[0].method"}},
+		{"unsupported scheme", []NotificationStep{{Method: "pager://1234", NotifyUntilPeriod: time.Minute}, last}, []string{"steps[0].method"}},
+		{"no method", []NotificationStep{{NotifyUntilPeriod: time.Minute}, last}, []string{"steps[0].method"}},
+		{"negative period", []NotificationStep{{Method: "sms://+12108675309", NotifyUntilPeriod: -time.Minute}, last}, []string{"steps[0].notify_until_period"}},
+		{"last step doesn't repeat", []NotificationStep{{Method: "sms://+12108675309", NotifyUntilPeriod: time.Minute}}, []string{"steps[0].notify_every_period"}},
+		{"several methods", []NotificationStep{{Methods: []string{"sms://+12108675309", "email://lancelot@camelot.example.com"}, NotifyEveryPeriod: time.Minute}}, nil},
+		{"bad second method", []NotificationStep{{Methods: []string{"sms://+12108675309", "sms://867-5309"}, NotifyEveryPeriod: time.Minute}}, []string{"steps[0].methods[1]"}},
+		{"method and methods", []NotificationStep{{Method: "sms://+12108675309", Methods: []string{"sms://+12108675309"}, NotifyEveryPeriod: time.Minute}}, []string{"steps[0].methods"}},
+		{"middle step doesn't wait", []NotificationStep{{Method: "sms://+12108675309"}, last}, []string{"steps[0].notify_until_period"}},
+		{"period too short", []NotificationStep{{Method: "sms://+12108675309", NotifyUntilPeriod: 300}, {Method: "email://lancelot@camelot.example.com", NotifyEveryPeriod: 15 * time.Second}}, []string{"steps[0].notify_until_period", "steps[1].notify_every_period"}},
+		{"middle step gives up", []NotificationStep{{Method: "sms://+12108675309", NotifyUntilPeriod: time.Minute, MaxAttempts: 3, MaxDuration: time.Hour}, last}, []string{"steps[0].max_attempts", "steps[0].max_duration"}},
+	}
+
+	for _, tt := range tests {
+		errs := validateSteps(tt.steps)
+		if len(errs) != len(tt.fields) {
+			t.Errorf("%v: expected %d errors, got %+v", tt.name, len(tt.fields), errs)
+			continue
+		}
+		for i, f := range tt.fields {
+			if errs[i].Field != f {
+				t.Errorf("%v: expected an error for %v, got %+v", tt.name, f, errs[i])
+			}
+		}
+	}
+}
+
+func TestNotificationStepJSON(t *testing.T) {
+	tests := []struct {
+		json  string
+		every time.Duration
+		until time.Duration
+		err   bool
+	}{
+		{`{"notify_every_period": "1h30m", "notify_until_period": "45s"}`, 90 * time.Minute, 45 * time.Second, false},
+		{`{"notify_every_period": 300000000000, "notify_until_period": 0}`, 5 * time.Minute, 0, false},
+		{`{"notify_every_period": null}`, 0, 0, false},
+		{`{"notify_every_period": "5 minutes"}`, 0, 0, true},
+		{`{"notify_every_period": 1.5}`, 0, 0, true},
+		{`{"notify_every_period": true}`, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		var s NotificationStep
+		err := json.Unmarshal([]byte(tt.json), &s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tt.json)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %s", tt.json, err)
+			continue
+		}
+		if s.NotifyEveryPeriod != tt.every || s.NotifyUntilPeriod != tt.until {
+			t.Errorf("%v: got %v and %v", tt.json, s.NotifyEveryPeriod, s.NotifyUntilPeriod)
+		}
+	}
+
+	j, _ := json.Marshal(NotificationStep{Method: "sms://+12108675309", NotifyEveryPeriod: time.Hour, NotifyUntilPeriod: 90 * time.Second})
+	if want := `{"method":"sms://+12108675309","notify_every_period":"1h","notify_until_period":"1m30s"}`; string(j) != want {
+		t.Errorf("Expected %v, got %s", want, j)
+	}
+
+	// Nanoseconds are deprecated, and a bare number that was meant as minutes is far too short
+	b, restore := captureLogs(t, LoggingConfig{Level: "info"})
+	defer restore()
+
+	body := []byte(`[{"method": "sms://+12108675309", "notify_until_period": 15}, {"method": "sms://+12108675309", "notify_every_period": "1h"}]`)
+	var steps []NotificationStep
+	err := json.Unmarshal(body, &steps)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if errs := validateSteps(steps); len(errs) != 1 || errs[0].Field != "steps[0].notify_until_period" {
+		t.Errorf("Expected a 15ns period to be refused, got %+v", errs)
+	}
+
+	// Only requests are warned about, since stored plans are read all the time
+	if strings.Contains(b.String(), "deprecated") {
+		t.Errorf("Expected no deprecation warning when reading a plan, got %q", b)
+	}
+	warnNanosecondPeriods(body)
+	if !strings.Contains(b.String(), "deprecated") || !strings.Contains(b.String(), "notify_until_period=15 (15ns)") {
+		t.Errorf("Expected a deprecation warning, got %q", b)
+	}
+}
+
+func TestMigrateNotificationPlans(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir on exit
+		_ = os.RemoveAll(tempdir)
+	}()
+
+	c.DB.Open(tempdir + "/db")
+	defer c.DB.Close()
+
+	// Nothing to do before there are any plans
+	if n, err := c.MigrateNotificationPlans(); n != 0 || err != nil {
+		t.Errorf("Unexpected migration of an empty DB: %d, %v", n, err)
+	}
+
+	legacy := `{"username":"lancelot","steps":[{"method":"sms://+12108675309","notify_every_period":3600000000000,"notify_until_period":0}]}`
+	c.DB.Store("notificationplans", "lancelot", legacy)
+	c.StoreNotificationPlan(&NotificationPlan{Username: "galahad", Steps: []NotificationStep{{Method: "sms://+12105551212", NotifyEveryPeriod: time.Hour}}})
+
+	n, err := c.MigrateNotificationPlans()
+	if err != nil {
+		t.Fatalf("Migration failed: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 plan to be migrated, got %d", n)
+	}
+
+	jp, _ := c.DB.Fetch("notificationplans", "lancelot")
+	if !strings.Contains(jp, `"notify_every_period":"1h"`) {
+		t.Errorf("Plan was not migrated: %v", jp)
+	}
+
+	// It's a no-op the second time around
+	if n, _ := c.MigrateNotificationPlans(); n != 0 {
+		t.Errorf("Expected no plans to be migrated, got %d", n)
+	}
+}
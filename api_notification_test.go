@@ -7,10 +7,25 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
 
+const testParallelNotificationPlanJson = `
+[
+  {
+    "methods": ["sms://+12108675309", "email://lancelot@camelot.example.com"],
+    "notify_until_period": "1h"
+  },
+  {
+    "method": "phone://+12108675309",
+    "notify_every_period": "1h"
+  }
+]
+`
+
 const testCreateNotificationJson = `
 {
   "content": "Hello World",
@@ -35,9 +50,11 @@ func TestNotification(t *testing.T) {
 	c.DB.Open(dbfile)
 	defer c.DB.Close()
 
+	// Nothing is really sent for the plan's SMS and phone steps
+	defer startTestMockProvider()()
+
 	// The notification engine must be running, or we'll run into an deadlock
-	stopChan = make(chan string)
-	go StartNotificationEngine()
+	startTestNotificationEngine()
 
 	// prepare the API router
 	router := apiRouter()
@@ -120,4 +137,211 @@ func TestNotification(t *testing.T) {
 		t.Fatalf("StopNotificationClick request failed: %d", w.Code)
 	}
 
+	// Let the plan processor finish with the mock provider before it goes away
+	waitFor(t, "notification to stop", func() bool { return !notificationInProgress(uuid) })
+
+}
+
+func TestParallelMethods(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed: %s", w.Body)
+	}
+
+	uuid := testMockNotify(t, "lancelot", testParallelNotificationPlanJson)
+
+	// The SMS and e-mail go out together
+	waitFor(t, "SMS and e-mail", func() bool {
+		return len(mockProvider.SentSMS()) == 1 && len(mockProvider.SentEmails()) == 1
+	})
+
+	w = testAPIRequest(t, "GET", "http://localhost/plan/lancelot", "")
+	if !strings.Contains(w.Body.String(), `"methods":["sms://+12108675309","email://lancelot@camelot.example.com"]`) {
+		t.Errorf("Unexpected plan: %s", w.Body)
+	}
+
+	// Acknowledging either one stops them both, and the plan goes no further
+	err := mockProvider.ClickStopLink(mockProvider.SentEmails()[0].ID)
+	if err != nil {
+		t.Fatalf("Stop link failed: %s", err)
+	}
+	waitFor(t, "e-mail acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	if n := len(mockProvider.PlacedCalls()); n != 0 {
+		t.Errorf("Expected no phone calls after acknowledgement, got %d", n)
+	}
+	// The SMS code went with it
+	code := regexp.MustCompile(`Reply with "(\d+)"`).FindStringSubmatch(mockProvider.SentSMS()[0].Body)
+	if code == nil {
+		t.Fatalf("SMS contained no acknowledgement code: %s", mockProvider.SentSMS()[0].Body)
+	}
+	err = mockProvider.ReplySMS("+12108675309", code[1])
+	if err != nil {
+		t.Fatalf("SMS reply failed: %s", err)
+	}
+	waitFor(t, "SMS reply", func() bool { return len(mockProvider.SentSMS()) == 2 })
+	if m := mockProvider.SentSMS()[1].Body; !strings.Contains(m, "don't recognize") {
+		t.Errorf("Expected the SMS code to stop working: %s", m)
+	}
+}
+
+func TestRetrigger(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed: %s", w.Body)
+	}
+
+	uuid := testMockNotify(t, "lancelot", `[
+		{"method": "sms://+12108675309", "notify_until_period": "1h"},
+		{"method": "email://lancelot@camelot.example.com", "notify_every_period": "1h"}
+	]`)
+	waitFor(t, "SMS notification", func() bool { return len(mockProvider.SentSMS()) == 1 })
+
+	status := func() NotificationStatusResponse {
+		var res NotificationStatusResponse
+		w := testAPIRequest(t, "GET", "http://localhost/notifications/"+uuid, "")
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+
+	w = testAPIRequest(t, "DELETE", "http://localhost/notifications/"+uuid+"?snooze=soon", "")
+	if w.Code != 422 {
+		t.Errorf("Expected an invalid snooze to be rejected: %s", w.Body)
+	}
+
+	// An acknowledgement with a snooze leaves the notification waiting to be re-triggered
+	w = testAPIRequest(t, "DELETE", "http://localhost/notifications/"+uuid+"?snooze=100ms", "")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "re-triggered") {
+		t.Fatalf("StopNotification request failed: %s", w.Body)
+	}
+	waitFor(t, "acknowledgement", func() bool { return status().State == StateAcknowledged })
+	if s := status(); s.RetriggerAt == nil || s.Retriggers != 0 {
+		t.Errorf("Unexpected status after acknowledgement: %+v", s)
+	}
+
+	// Once it runs out, the plan starts over from its first step, saying so
+	waitFor(t, "re-trigger", func() bool { return len(mockProvider.SentSMS()) == 2 })
+	if m := mockProvider.SentSMS()[1].Body; !strings.HasPrefix(m, "[re-triggered] The castle is on fire") {
+		t.Errorf("Expected the re-triggered SMS to say so: %s", m)
+	}
+	if s := status(); s.State != StateNotifying || s.Step != 1 || s.Retriggers != 1 || s.RetriggerAt != nil {
+		t.Errorf("Unexpected status after re-trigger: %+v", s)
+	}
+
+	// SMS acknowledgements can carry a duration, too
+	code := regexp.MustCompile(`Reply with "(\d+)"`).FindStringSubmatch(mockProvider.SentSMS()[1].Body)
+	if code == nil {
+		t.Fatalf("SMS contained no acknowledgement code: %s", mockProvider.SentSMS()[1].Body)
+	}
+	err := mockProvider.ReplySMS("+12108675309", "ACK "+code[1]+" 1h")
+	if err != nil {
+		t.Fatalf("SMS reply failed: %s", err)
+	}
+	waitFor(t, "SMS acknowledgement", func() bool { return status().State == StateAcknowledged })
+	if m := mockProvider.SentSMS()[2].Body; !strings.Contains(m, "isn't resolved in 60 minutes") {
+		t.Errorf("Unexpected SMS reply: %s", m)
+	}
+
+	// Stopping it before then resolves it
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+uuid, "")
+	waitFor(t, "resolution", func() bool { return !notificationInProgress(uuid) })
+
+	if s := status(); s.Outcome != OutcomeResolved || s.Retriggers != 1 || s.Content != "[re-triggered] The castle is on fire" {
+		t.Errorf("Unexpected status after resolution: %+v", s)
+	}
+}
+
+func TestEscalateToLastStep(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	// Step quickly enough for the test
+	defer func(p time.Duration) { minStepPeriod = p }(minStepPeriod)
+	minStepPeriod = 0
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed: %s", w.Body)
+	}
+
+	uuid := testMockNotify(t, "lancelot", `[
+		{"method": "sms://+12108675309", "notify_until_period": "50ms"},
+		{"method": "email://lancelot@camelot.example.com", "notify_every_period": "1h"}
+	]`)
+	waitFor(t, "SMS notification", func() bool { return len(mockProvider.SentSMS()) == 1 })
+
+	// The first step's timer mustn't carry on into the last step after an escalation
+	controlChan <- NotificationControl{UUID: uuid, Action: EscalateAction}
+	waitFor(t, "escalation to e-mail", func() bool { return len(mockProvider.SentEmails()) == 1 })
+
+	time.Sleep(150 * time.Millisecond)
+	if !notificationInProgress(uuid) {
+		t.Fatalf("Notification stopped by the first step's timer after escalating to the last step")
+	}
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+uuid, "")
+	waitFor(t, "acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	// A last step that can't be carried out at all still ends the notification
+	c.StoreNotificationPlan(&NotificationPlan{Username: "lancelot", Steps: []NotificationStep{{Method: "sms://%zz", NotifyEveryPeriod: time.Hour}}})
+	w = testAPIRequest(t, "POST", "http://localhost/people/lancelot/notify", `{"content": "The castle is on fire"}`)
+	m := regexp.MustCompile(`"uuid":"([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if w.Code != 200 || m == nil {
+		t.Fatalf("NotifyPerson request failed: %s", w.Body)
+	}
+	waitFor(t, "notification to fail", func() bool {
+		rec, err := c.GetNotificationRecord(m[1])
+		return err == nil && rec.Outcome == OutcomeFailed
+	})
+	if notificationInProgress(m[1]) {
+		t.Errorf("Failed notification was left in progress")
+	}
 }
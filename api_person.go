@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/mail"
 
 	"github.com/chrissnell/victorops-go"
 	"github.com/gorilla/mux"
@@ -37,7 +37,7 @@ func ListPeople(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, v := range p {
-		res.People = append(res.People, *v)
+		res.People = append(res.People, v.public())
 	}
 
 	json.NewEncoder(w).Encode(res)
@@ -58,7 +58,7 @@ func ShowPerson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res.People = append(res.People, *p)
+	res.People = append(res.People, p.public())
 
 	json.NewEncoder(w).Encode(res)
 }
@@ -80,7 +80,7 @@ func DeletePerson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("GetPerson() failed for", username)
+		logger.Debug("Could not fetch person", "username", username, "err", err)
 	}
 
 	err = c.DeletePerson(username)
@@ -126,6 +126,9 @@ func CreatePerson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A PIN can only be set by giving it, never its hash
+	p.PINHash = ""
+
 	// If a username *and* fullname were not provided, return an error
 	if p.Username == "" || p.FullName == "" {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
@@ -135,6 +138,26 @@ func CreatePerson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Make sure their phone calls can be acknowledged
+	err = validateVoiceSettings(&p)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Plan templates fill in their methods from these
+	err = validateContactInfo(&p)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
 	// Make sure that this user doesn't already exist
 	fp, err := c.GetPerson(p.Username)
 	if fp != nil && fp.Username != "" {
@@ -145,13 +168,23 @@ func CreatePerson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("GetPerson() failed:", err)
+		logger.Debug("No existing person", "username", p.Username, "err", err)
+	}
+
+	err = p.hashPIN()
+	if err != nil {
+		logger.Error("Could not hash PIN", "username", p.Username, "err", err)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
 	}
 
 	// Store our new person in the DB
 	err = c.StorePerson(&p)
 	if err != nil {
-		log.Println("Error storing person:", err)
+		logger.Error("Could not store person", "username", p.Username, "err", err)
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(422) // unprocessable entity
 		res.Error = err.Error()
@@ -206,6 +239,16 @@ func UpdatePerson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Plan templates fill in their methods from these
+	err = validateContactInfo(&p)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
 	// Make sure the user actually exists before updating
 	fp, err := c.GetPerson(username)
 	if (fp != nil && fp.Username == "") || fp == nil {
@@ -216,16 +259,72 @@ func UpdatePerson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("GetPerson() failed for", username)
+		logger.Debug("Could not fetch person", "username", username, "err", err)
 	}
 
 	// Now that we know our user exists in the DB, copy the username from the URI path and add it to our struct
 	p.Username = username
 
+	// A PIN can't be read back, so they keep the one they have unless they give a new one or remove it
+	p.PINHash = ""
+	if p.PIN == "" && !p.RemovePIN {
+		p.PIN = fp.PIN
+		p.PINHash = fp.PINHash
+	}
+	p.RemovePIN = false
+
+	// Make sure their phone calls can be acknowledged
+	err = validateVoiceSettings(&p)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Their plan still has to work with their new contact info, and can't ask for a PIN they no longer have
+	np, err := c.getStoredNotificationPlan(username)
+	if err == nil {
+		steps := np.Steps
+		if np.Template != "" {
+			pt, err := c.GetPlanTemplate(np.Template)
+			if err == nil {
+				var errs []FieldError
+				steps, errs = pt.StepsFor(&p)
+				if len(errs) > 0 {
+					w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+					w.WriteHeader(422) // unprocessable entity
+					res.Error = fmt.Sprint("Notification plan for user ", username, " uses plan template ", np.Template, ": ", describeFieldErrors(errs))
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+			}
+		}
+
+		if err := validateStepVoiceOptions(steps, &p); err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(422) // unprocessable entity
+			res.Error = fmt.Sprint("Notification plan for user ", username, ": ", err)
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+	}
+
+	err = p.hashPIN()
+	if err != nil {
+		logger.Error("Could not hash PIN", "username", username, "err", err)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
 	// Store the updated user in the DB
 	err = c.StorePerson(&p)
 	if err != nil {
-		log.Println("Error storing person:", err)
+		logger.Error("Could not store person", "username", p.Username, "err", err)
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(422) // unprocessable entity
 		res.Error = err.Error()
@@ -233,9 +332,44 @@ func UpdatePerson(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res.People = append(res.People, p)
+	res.People = append(res.People, p.public())
 	res.Message = fmt.Sprint("User ", username, " updated")
 
 	json.NewEncoder(w).Encode(res)
 
 }
+
+// Checks a Person's PIN and voice options
+func validateVoiceSettings(p *Person) error {
+	err := validatePIN(p.PIN)
+	if err != nil {
+		return err
+	}
+
+	err = p.VoiceOptions.Validate()
+	if err != nil {
+		return err
+	}
+
+	if p.VoiceOptions != nil && p.VoiceOptions.RequirePIN && p.storedPIN() == "" {
+		return fmt.Errorf("Must provide a pin when voice_options require_pin is set")
+	}
+
+	return nil
+}
+
+// Checks a Person's phone number and e-mail address, if they have them
+func validateContactInfo(p *Person) error {
+	if p.Phone != "" && !e164Pattern.MatchString(p.Phone) {
+		return fmt.Errorf("phone must be in E.164 format, like +12108675309")
+	}
+
+	if p.Email != "" {
+		a, err := mail.ParseAddress(p.Email)
+		if err != nil || a.Name != "" || a.Address != p.Email {
+			return fmt.Errorf("email must be a valid e-mail address, like lancelot@camelot.example.com")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type PlanTemplateResponse struct {
+	Templates []PlanTemplate `json:"templates"`
+	People    []string       `json:"people,omitempty"` // Whose plans use the template
+	Message   string         `json:"message"`
+	Error     string         `json:"error"`
+	Errors    []FieldError   `json:"errors,omitempty"`
+}
+
+// Return every plan template
+func ListPlanTemplates(w http.ResponseWriter, r *http.Request) {
+	var res PlanTemplateResponse
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	pts, err := c.GetAllPlanTemplates()
+	if err != nil {
+		res.Error = err.Error()
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusNotFound)
+		return
+	}
+
+	for _, pt := range pts {
+		res.Templates = append(res.Templates, *pt)
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Return a plan template and the people who use it
+func ShowPlanTemplate(w http.ResponseWriter, r *http.Request) {
+	var res PlanTemplateResponse
+
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	pt, err := c.GetPlanTemplate(name)
+	if err != nil {
+		res.Error = err.Error()
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusNotFound)
+		return
+	}
+
+	res.Templates = append(res.Templates, *pt)
+	res.People, _ = c.PlanTemplateUsers(name)
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Create or replace a plan template.  Everyone whose plan uses it gets the new steps.
+func UpdatePlanTemplate(w http.ResponseWriter, r *http.Request) {
+	var res PlanTemplateResponse
+	var pr notificationPlanRequest
+
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024*15))
+	// If something went wrong, return an error in the JSON response
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = r.Body.Close()
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	warnNanosecondPeriods(body)
+
+	if pr.Template != "" {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "A plan template can't use another template"
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// The template must have at least one NotificationStep
+	if len(pr.Steps) == 0 {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "Must provide at least one notification step in JSON"
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	pt := PlanTemplate{Name: name, Steps: pr.Steps, OnExhausted: pr.OnExhausted}
+
+	if errs := pt.Validate(); len(errs) > 0 {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "Plan template is invalid"
+		res.Errors = errs
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// The new steps have to work for everyone who already uses the template
+	users, err := c.PlanTemplateUsers(name)
+	if err != nil {
+		logger.Debug("No notification plans", "err", err)
+	}
+
+	var errs []FieldError
+	for _, username := range users {
+		p, err := c.GetPerson(username)
+		if err != nil {
+			p = &Person{Username: username}
+		}
+
+		steps, serrs := pt.StepsFor(p)
+		if len(serrs) == 0 {
+			serrs = validateOnExhausted(pt.OnExhausted, username)
+		}
+		if len(serrs) == 0 {
+			if err := validateStepVoiceOptions(steps, p); err != nil {
+				serrs = []FieldError{{Field: "steps", Message: err.Error()}}
+			}
+		}
+
+		for _, e := range serrs {
+			errs = append(errs, FieldError{Field: e.Field, Message: fmt.Sprint("for ", username, ": ", e.Message)})
+		}
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "Plan template can't be used by everyone whose plan uses it"
+		res.Errors = errs
+		res.People = users
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = c.StorePlanTemplate(&pt)
+	if err != nil {
+		logger.Error("Could not store plan template", "template", name, "err", err)
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	logger.Info("Plan template updated", "template", name, "people", len(users))
+
+	res.Templates = append(res.Templates, pt)
+	res.People = users
+	res.Message = fmt.Sprint("Plan template ", name, " updated")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Delete a plan template, as long as nobody's plan uses it
+func DeletePlanTemplate(w http.ResponseWriter, r *http.Request) {
+	var res PlanTemplateResponse
+
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	pt, err := c.GetPlanTemplate(name)
+	if pt == nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("Plan template ", name, " doesn't exist and thus, cannot be deleted")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if err != nil {
+		logger.Debug("Could not fetch plan template", "template", name, "err", err)
+	}
+
+	users, err := c.PlanTemplateUsers(name)
+	if err != nil {
+		logger.Debug("No notification plans", "err", err)
+	}
+	if len(users) > 0 {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("Plan template ", name, " is used by ", strings.Join(users, ", "), ".  Give them other plans before deleting it.")
+		res.People = users
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = c.DeletePlanTemplate(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	res.Message = fmt.Sprint("Plan template ", name, " deleted")
+
+	json.NewEncoder(w).Encode(res)
+}
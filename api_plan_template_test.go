@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testPlanTemplateJson = `
+{
+  "steps": [
+    {
+      "method": "sms://{{phone}}",
+      "notify_every_period": "0s",
+      "notify_until_period": "5m"
+    },
+    {
+      "methods": ["phone://{{phone}}", "email://{{ email }}"],
+      "notify_every_period": "10m"
+    }
+  ]
+}
+`
+
+const testUpdatedPlanTemplateJson = `
+[
+  {
+    "method": "email://{{email}}",
+    "notify_every_period": "15m"
+  }
+]
+`
+
+const testEscalatingPlanTemplateJson = `
+{
+  "steps": [
+    {
+      "method": "email://{{email}}",
+      "notify_every_period": "15m",
+      "max_attempts": 2
+    }
+  ],
+  "on_exhausted": {"action": "escalate", "username": "galahad"}
+}
+`
+
+func TestPlanTemplates(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	people := []string{
+		`{"username": "lancelot", "fullname": "Sir Lancelot", "phone": "+12108675309", "email": "lancelot@camelot.example.com"}`,
+		`{"username": "galahad", "fullname": "Sir Galahad", "phone": "+12105551212", "email": "galahad@camelot.example.com"}`,
+		`{"username": "robin", "fullname": "Sir Robin", "email": "robin@camelot.example.com"}`,
+	}
+	for _, p := range people {
+		w := testAPIRequest(t, "POST", "http://localhost/people", p)
+		if w.Code != 200 {
+			t.Fatalf("CreatePerson request failed: %s", w.Body)
+		}
+	}
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", `{"username": "bedevere", "fullname": "Sir Bedevere", "phone": "555-1212"}`)
+	if w.Code != 422 {
+		t.Errorf("Expected a phone number that isn't E.164 to be rejected: %s", w.Body)
+	}
+
+	// Test UpdatePlanTemplate: PUT /plan-templates/standard
+	w = testAPIRequest(t, "PUT", "http://localhost/plan-templates/standard", testPlanTemplateJson)
+	if w.Code != 200 {
+		t.Fatalf("UpdatePlanTemplate request failed: %s", w.Body)
+	}
+
+	w = testAPIRequest(t, "PUT", "http://localhost/plan-templates/broken", `[{"method": "sms://{{pager}}", "notify_every_period": "5m"}]`)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "{{pager}} is not a placeholder") {
+		t.Errorf("Expected an unknown placeholder to be rejected: %s", w.Body)
+	}
+
+	// Plans that use the template get their methods from each person's contact info
+	for _, u := range []string{"lancelot", "galahad"} {
+		w = testAPIRequest(t, "POST", "http://localhost/plan/"+u, `{"template": "standard"}`)
+		if w.Code != 200 {
+			t.Fatalf("CreateNotificationPlan request failed: %s", w.Body)
+		}
+	}
+
+	np, err := c.GetNotificationPlan("galahad")
+	if err != nil {
+		t.Fatalf("Could not fetch plan: %s", err)
+	}
+	if len(np.Steps) != 2 || np.Steps[0].Method != "sms://+12105551212" || np.Steps[1].Methods[1] != "email://galahad@camelot.example.com" {
+		t.Errorf("Template was not filled in for galahad: %+v", np.Steps)
+	}
+
+	// Robin has no phone number
+	w = testAPIRequest(t, "POST", "http://localhost/plan/robin", `{"template": "standard"}`)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "robin has no phone number") {
+		t.Errorf("Expected a template that needs a phone number to be rejected for robin: %s", w.Body)
+	}
+
+	w = testAPIRequest(t, "POST", "http://localhost/plan/robin", `{"template": "nonesuch"}`)
+	if w.Code != 422 {
+		t.Errorf("Expected a template that doesn't exist to be rejected: %s", w.Body)
+	}
+
+	w = testAPIRequest(t, "GET", "http://localhost/plan-templates/standard", "")
+	var res PlanTemplateResponse
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if w.Code != 200 || len(res.People) != 2 || res.People[0] != "galahad" || res.People[1] != "lancelot" {
+		t.Errorf("Unexpected ShowPlanTemplate response: %s", w.Body)
+	}
+
+	// Nobody can lose contact info that their template needs
+	w = testAPIRequest(t, "PUT", "http://localhost/people/lancelot", `{"fullname": "Sir Lancelot", "email": "lancelot@camelot.example.com"}`)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "lancelot has no phone number") {
+		t.Errorf("Expected removing a phone number that a template needs to be rejected: %s", w.Body)
+	}
+
+	// Edits to the template reach everyone who uses it
+	w = testAPIRequest(t, "PUT", "http://localhost/plan-templates/standard", testUpdatedPlanTemplateJson)
+	if w.Code != 200 {
+		t.Fatalf("UpdatePlanTemplate request failed: %s", w.Body)
+	}
+
+	w = testAPIRequest(t, "GET", "http://localhost/plan/lancelot", "")
+	if !strings.Contains(w.Body.String(), `"template":"standard"`) || !strings.Contains(w.Body.String(), `"method":"email://lancelot@camelot.example.com","notify_every_period":"15m"`) {
+		t.Errorf("Template edit did not reach lancelot's plan: %s", w.Body)
+	}
+
+	// ...but not if it would break someone's plan
+	w = testAPIRequest(t, "PUT", "http://localhost/plan/robin", `{"template": "standard"}`)
+	if w.Code != 422 {
+		t.Errorf("Expected updating a plan that doesn't exist to fail: %s", w.Body)
+	}
+	w = testAPIRequest(t, "POST", "http://localhost/plan/robin", `{"template": "standard"}`)
+	if w.Code != 200 {
+		t.Fatalf("CreateNotificationPlan request failed: %s", w.Body)
+	}
+	w = testAPIRequest(t, "PUT", "http://localhost/plan-templates/standard", testPlanTemplateJson)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "for robin: uses {{phone}} but robin has no phone number") {
+		t.Errorf("Expected a template edit that robin can't use to be rejected: %s", w.Body)
+	}
+
+	// Templates can't be deleted while they're in use
+	w = testAPIRequest(t, "DELETE", "http://localhost/plan-templates/standard", "")
+	if w.Code != 422 {
+		t.Errorf("Expected deleting a template in use to fail: %s", w.Body)
+	}
+
+	for _, u := range []string{"lancelot", "galahad", "robin"} {
+		w = testAPIRequest(t, "PUT", "http://localhost/plan/"+u, `[{"method": "email://`+u+`@camelot.example.com", "notify_every_period": "1h"}]`)
+		if w.Code != 200 {
+			t.Fatalf("UpdateNotificationPlan request failed: %s", w.Body)
+		}
+	}
+
+	w = testAPIRequest(t, "DELETE", "http://localhost/plan-templates/standard", "")
+	if w.Code != 200 {
+		t.Errorf("DeletePlanTemplate request failed: %s", w.Body)
+	}
+
+	// A template's on_exhausted action is checked for each person it's applied to
+	w = testAPIRequest(t, "PUT", "http://localhost/plan-templates/escalating", testEscalatingPlanTemplateJson)
+	if w.Code != 200 {
+		t.Fatalf("UpdatePlanTemplate request failed: %s", w.Body)
+	}
+	w = testAPIRequest(t, "PUT", "http://localhost/plan/galahad", `{"template": "escalating"}`)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "can't be the person who didn't respond") {
+		t.Errorf("Expected a template that escalates to galahad to be rejected for galahad: %s", w.Body)
+	}
+	w = testAPIRequest(t, "PUT", "http://localhost/plan/lancelot", `{"template": "escalating"}`)
+	if w.Code != 200 {
+		t.Fatalf("UpdateNotificationPlan request failed: %s", w.Body)
+	}
+
+	// If the fallback loses their plan, the action is left out, but the rest of the template still applies
+	w = testAPIRequest(t, "DELETE", "http://localhost/plan/galahad", "")
+	if w.Code != 200 {
+		t.Fatalf("DeleteNotificationPlan request failed: %s", w.Body)
+	}
+	np, err = c.GetNotificationPlan("lancelot")
+	if err != nil || len(np.Steps) != 1 || np.OnExhausted != nil {
+		t.Errorf("Expected lancelot's plan without its on_exhausted action: %+v, %v", np, err)
+	}
+
+	// ...and the same goes for a plan stored without being checked
+	c.StoreNotificationPlan(&NotificationPlan{Username: "galahad", Template: "escalating"})
+	np, err = c.GetNotificationPlan("galahad")
+	if err != nil || np.Steps[0].Method != "email://galahad@camelot.example.com" || np.OnExhausted != nil {
+		t.Errorf("Expected galahad's plan without an on_exhausted action that escalates to galahad: %+v, %v", np, err)
+	}
+}
+
+func TestPlanTemplateStepsFor(t *testing.T) {
+	pt := &PlanTemplate{Steps: []NotificationStep{
+		{Method: "sms://{{phone}}"},
+		{Methods: []string{"email://{{email}}", "phone://{{phone}}"}},
+	}}
+
+	steps, errs := pt.StepsFor(&Person{Username: "robin", Email: "robin@camelot.example.com"})
+	if len(errs) != 2 || errs[0].Field != "steps[0].method" || errs[1].Field != "steps[1].methods[1]" {
+		t.Errorf("Expected errors for robin's missing phone number, got %+v", errs)
+	}
+	if steps[1].Methods[0] != "email://robin@camelot.example.com" {
+		t.Errorf("Unexpected steps: %+v", steps)
+	}
+
+	// The template itself is untouched
+	if pt.Steps[1].Methods[0] != "email://{{email}}" {
+		t.Errorf("StepsFor changed the template: %+v", pt.Steps)
+	}
+}
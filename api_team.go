@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type TeamsResponse struct {
+	Teams   []Team `json:"teams"`
+	Message string `json:"message"`
+	Error   string `json:"error"`
+}
+
+// Fetches every team from the DB and returns them as JSON
+func ListTeams(w http.ResponseWriter, r *http.Request) {
+	var res TeamsResponse
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	teams, err := c.GetAllTeams()
+	if err != nil {
+		res.Error = err.Error()
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusInternalServerError)
+		return
+	}
+
+	for _, t := range teams {
+		res.Teams = append(res.Teams, *t)
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Fetches a single team from the DB and returns it as JSON
+func ShowTeam(w http.ResponseWriter, r *http.Request) {
+	var res TeamsResponse
+
+	vars := mux.Vars(r)
+	name := vars["team"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	t, err := c.GetTeam(name)
+	if err != nil {
+		res.Error = err.Error()
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusNotFound)
+		return
+	}
+
+	res.Teams = append(res.Teams, *t)
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Creates a new team in the database
+func CreateTeam(w http.ResponseWriter, r *http.Request) {
+	var res TeamsResponse
+	var t Team
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024*10))
+	// If something went wrong, return an error in the JSON response
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = r.Body.Close()
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	if t.Name == "" {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = "Must provide a team name"
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = validateTeamMembers(t.Members)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Make sure that this team doesn't already exist
+	ft, err := c.GetTeam(t.Name)
+	if ft != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("Team ", t.Name, " already exists. Use PUT /teams/", t.Name, " to update.")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if err != nil {
+		logger.Debug("No existing team", "team", t.Name, "err", err)
+	}
+
+	err = c.StoreTeam(&t)
+	if err != nil {
+		logger.Error("Could not store team", "team", t.Name, "err", err)
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	res.Message = fmt.Sprint("Team ", t.Name, " created")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Replaces the members of an existing team
+func UpdateTeam(w http.ResponseWriter, r *http.Request) {
+	var res TeamsResponse
+	var t Team
+
+	vars := mux.Vars(r)
+	name := vars["team"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024*10))
+	// If something went wrong, return an error in the JSON response
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = r.Body.Close()
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = validateTeamMembers(t.Members)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Make sure the team actually exists before updating
+	ft, err := c.GetTeam(name)
+	if ft == nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("Team ", name, " does not exist. Use POST to create.")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if err != nil {
+		logger.Debug("Could not fetch team", "team", name, "err", err)
+	}
+
+	// The team's name comes from the URI path
+	t.Name = name
+
+	err = c.StoreTeam(&t)
+	if err != nil {
+		logger.Error("Could not store team", "team", name, "err", err)
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	res.Teams = append(res.Teams, t)
+	res.Message = fmt.Sprint("Team ", name, " updated")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Deletes the specified team from the database.  Its members are left alone.
+func DeleteTeam(w http.ResponseWriter, r *http.Request) {
+	var res TeamsResponse
+
+	vars := mux.Vars(r)
+	name := vars["team"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	t, err := c.GetTeam(name)
+	if t == nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("Team ", name, " does not exist and thus, cannot be deleted")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if err != nil {
+		logger.Debug("Could not fetch team", "team", name, "err", err)
+	}
+
+	err = c.DeleteTeam(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	res.Message = fmt.Sprint("Team ", name, " deleted")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Checks that a team has members and that they all exist
+func validateTeamMembers(members []string) error {
+	if len(members) == 0 {
+		return fmt.Errorf("Must provide at least one member")
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range members {
+		if seen[m] {
+			return fmt.Errorf("%v is listed more than once", m)
+		}
+		seen[m] = true
+
+		if _, err := c.GetPerson(m); err != nil {
+			return fmt.Errorf("User %v does not exist. Create the user first before adding them to a team.", m)
+		}
+	}
+
+	return nil
+}
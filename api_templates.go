@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type MessageTemplatesResponse struct {
+	Language  string           `json:"language"`
+	Templates MessageTemplates `json:"templates"`
+	Message   string           `json:"message"`
+	Error     string           `json:"error"`
+}
+
+// Return the message templates stored for a language
+func ShowMessageTemplates(w http.ResponseWriter, r *http.Request) {
+	var res MessageTemplatesResponse
+
+	vars := mux.Vars(r)
+	language := vars["language"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	mt, err := c.GetMessageTemplates(language)
+	if err != nil {
+		res.Error = err.Error()
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusNotFound)
+		return
+	}
+
+	res.Language = language
+	res.Templates = *mt
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Create or replace the message templates for a language
+func UpdateMessageTemplates(w http.ResponseWriter, r *http.Request) {
+	var res MessageTemplatesResponse
+	var mt MessageTemplates
+
+	vars := mux.Vars(r)
+	language := vars["language"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024*64))
+	// If something went wrong, return an error in the JSON response
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = r.Body.Close()
+	if err != nil {
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = json.Unmarshal(body, &mt)
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// Make sure the templates will actually render before we start sending them to people
+	err = mt.Validate()
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	err = c.StoreMessageTemplates(language, &mt)
+	if err != nil {
+		logger.Error("Could not store message templates", "language", language, "err", err)
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	res.Language = language
+	res.Templates = mt
+	res.Message = fmt.Sprint("Message templates for language ", language, " updated")
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Delete the message templates for a language.  Messages in that language fall back to the default templates.
+func DeleteMessageTemplates(w http.ResponseWriter, r *http.Request) {
+	var res MessageTemplatesResponse
+
+	vars := mux.Vars(r)
+	language := vars["language"]
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	mt, err := c.GetMessageTemplates(language)
+	if mt == nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = fmt.Sprint("Message templates for language ", language, " don't exist and thus, cannot be deleted")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if err != nil {
+		logger.Debug("Could not fetch message templates", "language", language, "err", err)
+	}
+
+	err = c.DeleteMessageTemplates(language)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	res.Message = fmt.Sprint("Message templates for language ", language, " deleted")
+
+	json.NewEncoder(w).Encode(res)
+}
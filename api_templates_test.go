@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const testUpdateMessageTemplatesJson = `
+{
+  "sms": "{{.Content}} - Répondez \"{{.AckCode}}\" pour confirmer",
+  "email_subject": "Message pour {{.FullName}} (étape {{.Step}})"
+}
+`
+
+const testInvalidMessageTemplatesJson = `
+{
+  "sms": "{{.Content}} - {{.NoSuchField}}"
+}
+`
+
+func TestMessageTemplates(t *testing.T) {
+	var w *httptest.ResponseRecorder
+	var r *http.Request
+	var p *bytes.Buffer
+	var err error
+
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	// prepare the API router
+	router := apiRouter()
+
+	// Test UpdateMessageTemplates: PUT /templates/fr
+	w = httptest.NewRecorder()
+	p = bytes.NewBufferString(testUpdateMessageTemplatesJson)
+	r, err = http.NewRequest("PUT", "http://localhost/templates/fr", p)
+	if err != nil {
+		t.Fatalf("Failed to create new HTTP Request: %s", err)
+	}
+	router.ServeHTTP(w, r)
+	// verify response
+	if w.Code != 200 {
+		t.Errorf("UpdateMessageTemplates request failed: %s", w.Body)
+	}
+
+	// Templates that can't be rendered should be rejected
+	w = httptest.NewRecorder()
+	p = bytes.NewBufferString(testInvalidMessageTemplatesJson)
+	r, err = http.NewRequest("PUT", "http://localhost/templates/de", p)
+	if err != nil {
+		t.Fatalf("Failed to create new HTTP Request: %s", err)
+	}
+	router.ServeHTTP(w, r)
+	// verify response
+	if w.Code != 422 {
+		t.Errorf("UpdateMessageTemplates accepted an invalid template: %d", w.Code)
+	}
+
+	// Test ShowMessageTemplates: GET /templates/fr
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "http://localhost/templates/fr", nil)
+	if err != nil {
+		t.Fatalf("Failed to create new HTTP Request: %s", err)
+	}
+	router.ServeHTTP(w, r)
+	// verify response
+	if w.Code != 200 {
+		t.Errorf("ShowMessageTemplates request failed")
+	}
+
+	// Config templates apply to every language but the DB templates for a language win
+	c.Config.Templates = map[string]MessageTemplates{
+		"default": {VoiceIntro: "Hello {{.Username}}", SMS: "config {{.Content}}"},
+	}
+	defer func() { c.Config.Templates = nil }()
+
+	d := &MessageData{Username: "lancelot", FullName: "Sir Lancelot", Language: "fr", Content: "Le château brûle", AckCode: "123", Step: 2}
+
+	if m := RenderMessage("sms", d); m != `Le château brûle - Répondez "123" pour confirmer` {
+		t.Errorf("Unexpected sms message: %s", m)
+	}
+	if m := RenderMessage("email_subject", d); m != "Message pour Sir Lancelot (étape 2)" {
+		t.Errorf("Unexpected email_subject message: %s", m)
+	}
+	if m := RenderMessage("voice_intro", d); m != "Hello lancelot" {
+		t.Errorf("Unexpected voice_intro message: %s", m)
+	}
+
+	// People without a language get the default templates
+	d.Language = ""
+	if m := RenderMessage("sms", d); m != "config Le château brûle" {
+		t.Errorf("Unexpected default sms message: %s", m)
+	}
+	if m := RenderMessage("voice_acknowledged", d); m != builtinTemplates.VoiceAcknowledged {
+		t.Errorf("Unexpected built-in voice_acknowledged message: %s", m)
+	}
+
+	// Test DeleteMessageTemplates: DELETE /templates/fr
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("DELETE", "http://localhost/templates/fr", nil)
+	if err != nil {
+		t.Fatalf("Failed to create new HTTP Request: %s", err)
+	}
+	router.ServeHTTP(w, r)
+	// verify response
+	if w.Code != 200 {
+		t.Errorf("DeleteMessageTemplates request failed")
+	}
+}
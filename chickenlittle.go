@@ -2,17 +2,20 @@ package main
 
 import (
 	"flag"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 
 	"github.com/gorilla/mux"
-	"gopkg.in/yaml.v2"
+	"github.com/twinj/uuid"
 )
 
 var (
 	cfgFile  *string
+	cfgPath  string // The absolute path of the config file, for reloading it
 	c        ChickenLittle
 	NIP      NotificationsInProgress
 	planChan = make(chan *NotificationRequest)
@@ -21,44 +24,134 @@ var (
 type ChickenLittle struct {
 	Config Config
 	DB     DB
+
+	configMu sync.RWMutex // Guards Config while it's being reloaded.  Use CurrentConfig() to read it.
 }
 
 func main() {
 
+	// Notification UUIDs are formatted once, here, because the uuid package's format is global and isn't safe to
+	// change while notifications are being started
+	uuid.SwitchFormat(uuid.CleanHyphen)
+
 	cfgFile = flag.String("config", "config.yaml", "Path to config file (default: ./config.yaml)")
+	checkOnly := flag.Bool("check-config", false, "Check the config file and stored notification plans for problems, then exit")
 	flag.Parse()
 
 	// Read our server configuration
-	filename, _ := filepath.Abs(*cfgFile)
-	cfgFile, err := ioutil.ReadFile(filename)
+	cfgPath, _ = filepath.Abs(*cfgFile)
+	cfg, err := readConfig(cfgPath)
+	if err != nil {
+		if ce, ok := err.(ConfigErrors); ok {
+			for _, e := range ce {
+				logger.Error("Invalid config in environment", "err", e)
+			}
+			logger.Fatal("Environment variables for the config have errors")
+		}
+		logger.Fatal("Could not read config.  Did you pass the -config flag?  Run with -h for help.", "err", err)
+	}
+	c.Config = cfg
+
+	if *checkOnly {
+		os.Exit(checkConfig(&c.Config))
+	}
+
+	// Refuse to start with a config that can't work
+	err = c.Config.Validate()
 	if err != nil {
-		log.Fatalln("Error opening config file.  Did you pass the -config flag?  Run with -h for help.\n", err)
+		for _, e := range err.(ConfigErrors) {
+			logger.Error("Invalid config", "err", e)
+		}
+		logger.Fatal("Config file has errors.  Run with -check-config after fixing them.")
 	}
-	err = yaml.Unmarshal(cfgFile, &c.Config)
+
+	err = configureLogging(c.Config.Logging)
 	if err != nil {
-		log.Fatalln("Error:", err)
+		logger.Fatal("Error setting up logging", "err", err)
 	}
 
-	// Open our BoltDB handle
+	// Open our BoltDB handle.  It's closed by shutdown().
 	c.DB.Open(c.Config.Service.DBFile)
-	defer c.DB.Close()
+
+	// Plans stored by older versions have their periods in nanoseconds
+	migrated, err := c.MigrateNotificationPlans()
+	if err != nil {
+		logger.Error("Could not migrate notification plans", "err", err)
+	} else if migrated > 0 {
+		logger.Info("Migrated notification plans to duration strings", "plans", migrated)
+	}
+
+	// Plans that this config can't carry out will fail when they're used, so we warn about them now
+	plans, err := c.GetAllNotificationPlans()
+	if err == nil {
+		if err := c.Config.CheckPlans(plans); err != nil {
+			for _, e := range err.(ConfigErrors) {
+				logger.Warn("Notification plan cannot be carried out", "err", e)
+			}
+		}
+	}
 
 	// Create our stop channel and launch the notification engine
 	stopChan = make(chan string)
 	go StartNotificationEngine()
 
-	// Set up our API endpoint router
-	go func() {
-		log.Fatal(http.ListenAndServe(c.Config.Service.APIListenAddr, apiRouter()))
-	}()
+	// Pick up any notifications that were interrupted the last time we shut down
+	resumeNotifications()
+
+	// Deliver what maintenance windows held back once they end
+	resumeMaintenanceWindows()
+
+	// Send the summaries of throttled notifications that were waiting
+	resumeThrottleSummaries()
+
+	servers := []*http.Server{
+		// Our API endpoint router
+		{Addr: c.Config.Service.APIListenAddr, Handler: apiRouter()},
+		// Our Twilio callback endpoint router
+		{Addr: c.Config.Service.CallbackListenAddr, Handler: callbackRouter()},
+		// Our Click endpoint router to handle stop requests from browsers
+		{Addr: c.Config.Service.ClickListenAddr, Handler: clickRouter()},
+	}
+
+	// Set up our fake Twilio/e-mail provider for offline testing
+	if c.Config.Integrations.Mock.Enabled {
+		logger.Warn("Mock integration enabled.  Notifications will not be delivered!")
+		servers = append(servers, &http.Server{Addr: c.Config.Integrations.Mock.ListenAddr, Handler: mockRouter()})
+	}
+
+	for _, s := range servers {
+		go func(s *http.Server) {
+			err := s.ListenAndServe()
+			if err != http.ErrServerClosed {
+				logger.Fatal("Server failed", "address", s.Addr, "err", err)
+			}
+		}(s)
+	}
 
-	// Set up our Twilio callback endpoint router
-	go func() {
-		log.Fatal(http.ListenAndServe(c.Config.Service.CallbackListenAddr, callbackRouter()))
-	}()
+	// Reload the config on SIGHUP until someone asks us to stop
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+
+	var sig os.Signal
+	for sig = range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		logger.Info("Received SIGHUP.  Reloading config.", "file", cfgPath)
+		_, err := reloadConfig(cfgPath)
+		if err != nil {
+			logger.Error("Config reload failed.  Keeping the old config.", "err", err)
+		}
+	}
+
+	timeout := c.CurrentConfig().Service.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
 
-	// Set up our Click endpoint router to handle stop requests from browsers
-	log.Fatal(http.ListenAndServe(c.Config.Service.ClickListenAddr, clickRouter()))
+	logger.Info("Shutting down.  Waiting for notifications to finish.", "signal", sig, "timeout", timeout)
+	shutdown(servers, timeout)
 }
 
 func apiRouter() *mux.Router {
@@ -91,12 +184,78 @@ func apiRouter() *mux.Router {
 	apiRouter.HandleFunc("/plan/{person}", UpdateNotificationPlan).
 		Methods("PUT")
 
+	apiRouter.HandleFunc("/teams", ListTeams).
+		Methods("GET")
+
+	apiRouter.HandleFunc("/teams", CreateTeam).
+		Methods("POST")
+
+	apiRouter.HandleFunc("/teams/{team}", ShowTeam).
+		Methods("GET")
+
+	apiRouter.HandleFunc("/teams/{team}", DeleteTeam).
+		Methods("DELETE")
+
+	apiRouter.HandleFunc("/teams/{team}", UpdateTeam).
+		Methods("PUT")
+
+	apiRouter.HandleFunc("/plan-templates", ListPlanTemplates).
+		Methods("GET")
+
+	apiRouter.HandleFunc("/plan-templates/{name}", ShowPlanTemplate).
+		Methods("GET")
+
+	apiRouter.HandleFunc("/plan-templates/{name}", UpdatePlanTemplate).
+		Methods("PUT")
+
+	apiRouter.HandleFunc("/plan-templates/{name}", DeletePlanTemplate).
+		Methods("DELETE")
+
+	apiRouter.HandleFunc("/maintenance-windows", ListMaintenanceWindows).
+		Methods("GET")
+
+	apiRouter.HandleFunc("/maintenance-windows", CreateMaintenanceWindow).
+		Methods("POST")
+
+	apiRouter.HandleFunc("/maintenance-windows/{window}", ShowMaintenanceWindow).
+		Methods("GET")
+
+	apiRouter.HandleFunc("/maintenance-windows/{window}", DeleteMaintenanceWindow).
+		Methods("DELETE")
+
+	apiRouter.HandleFunc("/maintenance-windows/{window}", UpdateMaintenanceWindow).
+		Methods("PUT")
+
 	apiRouter.HandleFunc("/people/{person}/notify", NotifyPerson).
 		Methods("POST")
 
+	apiRouter.HandleFunc("/notify", NotifyGroup).
+		Methods("POST")
+
+	apiRouter.HandleFunc("/notify/{uuid}", ShowNotificationGroup).
+		Methods("GET")
+
+	apiRouter.HandleFunc("/notifications/{uuid}", ShowNotification).
+		Methods("GET")
+
 	apiRouter.HandleFunc("/notifications/{uuid}", StopNotification).
 		Methods("DELETE")
 
+	apiRouter.HandleFunc("/templates/{language}", ShowMessageTemplates).
+		Methods("GET")
+
+	apiRouter.HandleFunc("/templates/{language}", UpdateMessageTemplates).
+		Methods("PUT")
+
+	apiRouter.HandleFunc("/templates/{language}", DeleteMessageTemplates).
+		Methods("DELETE")
+
+	apiRouter.HandleFunc("/metrics", ServeMetrics).
+		Methods("GET")
+
+	apiRouter.HandleFunc("/admin/reload", ReloadConfig).
+		Methods("POST")
+
 	return apiRouter
 }
 
@@ -115,6 +274,12 @@ func callbackRouter() *mux.Router {
 	callbackRouter.HandleFunc("/sms", ReceiveSMSReply).
 		Methods("POST")
 
+	callbackRouter.HandleFunc("/email/mailgun", ReceiveMailgunEmail).
+		Methods("POST")
+
+	callbackRouter.HandleFunc("/email/mime", ReceiveMIMEEmail).
+		Methods("POST")
+
 	return callbackRouter
 }
 
@@ -126,3 +291,39 @@ func clickRouter() *mux.Router {
 
 	return clickRouter
 }
+
+func mockRouter() *mux.Router {
+	mockRouter := mux.NewRouter().StrictSlash(true)
+
+	mockRouter.HandleFunc("/2010-04-01/Accounts/{account}/Messages.json", MockSendSMS).
+		Methods("POST")
+
+	mockRouter.HandleFunc("/2010-04-01/Accounts/{account}/Calls.json", MockMakePhoneCall).
+		Methods("POST")
+
+	mockRouter.HandleFunc("/2010-04-01/Accounts/{account}/Calls/{sid}", MockUpdatePhoneCall).
+		Methods("POST")
+
+	mockRouter.HandleFunc("/outbox", MockOutbox).
+		Methods("GET")
+
+	mockRouter.HandleFunc("/outbox", MockResetOutbox).
+		Methods("DELETE")
+
+	mockRouter.HandleFunc("/simulate/sms", MockSimulateSMSReply).
+		Methods("POST")
+
+	mockRouter.HandleFunc("/simulate/calls/{sid}/digits", MockSimulateDigits).
+		Methods("POST")
+
+	mockRouter.HandleFunc("/simulate/status/{sid}", MockSimulateStatus).
+		Methods("POST")
+
+	mockRouter.HandleFunc("/simulate/emails/{id}/reply", MockSimulateEmailReply).
+		Methods("POST")
+
+	mockRouter.HandleFunc("/simulate/emails/{id}/click", MockSimulateClick).
+		Methods("POST")
+
+	return mockRouter
+}
@@ -1,8 +1,15 @@
 package main
 
+import (
+	"time"
+)
+
 type Config struct {
-	Service      ServiceConfig `yaml:"service"`
-	Integrations Integrations  `yaml:"integrations"`
+	Service      ServiceConfig               `yaml:"service"`
+	Integrations Integrations                `yaml:"integrations"`
+	Templates    map[string]MessageTemplates `yaml:"templates"`
+	Logging      LoggingConfig               `yaml:"logging"`
+	RateLimits   RateLimitConfig             `yaml:"rate_limits"`
 }
 
 type ServiceConfig struct {
@@ -12,6 +19,26 @@ type ServiceConfig struct {
 	CallbackListenAddr string `yaml:"callback_listen_address"`
 	CallbackURLBase    string `yaml:"callback_url_base"`
 	DBFile             string `yaml:"db_file"`
+
+	// How long to wait for requests and notifications to finish when shutting down, e.g. "30s"
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// Log lines are written in logfmt (the default) or JSON, to stderr (the default), stdout or a file.
+// Phone numbers, e-mail addresses and message content are only logged at debug level.
+type LoggingConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	Format string `yaml:"format"` // logfmt or json
+	Output string `yaml:"output"` // stderr, stdout or the path to a file
+}
+
+// Limits on how many notifications can be started in a period, for each person and for everyone together.
+// Requests over a limit don't page anyone.  They're counted, and each person gets a single summary of what
+// they missed when the period is up.  A limit of 0 means there's no limit.
+type RateLimitConfig struct {
+	PerPerson int           `yaml:"per_person"`
+	Global    int           `yaml:"global"`
+	Period    time.Duration `yaml:"period"` // e.g. "10m".  Defaults to an hour.
 }
 
 type Integrations struct {
@@ -20,6 +47,9 @@ type Integrations struct {
 	Twilio    Twilio    `yaml:"twilio"`
 	Mailgun   Mailgun   `yaml:"mailgun"`
 	SMTP      SMTP      `yaml:"smtp"`
+	Mock      Mock      `yaml:"mock"`
+
+	InboundEmail InboundEmailConfig `yaml:"inbound_email"`
 }
 
 type Twilio struct {
@@ -43,6 +73,24 @@ type SMTP struct {
 	Sender   string `yaml:"sender"`
 }
 
+// When the mock integration is enabled, SMS, phone calls and e-mails are recorded in memory by a
+// built-in fake provider instead of being delivered.  Point the Twilio api_base_url at
+// http://<listen_address>/2010-04-01/Accounts/ to route Twilio requests to it.
+type Mock struct {
+	Enabled    bool   `yaml:"enabled"`
+	ListenAddr string `yaml:"listen_address"`
+}
+
+// When inbound e-mail is enabled, notification e-mails ask for replies at ack+<UUID>@<reply_domain>.
+// Mail for that domain needs to reach the callback listener at /email/mailgun (via a Mailgun route)
+// or /email/mime (as a raw MIME message).
+type InboundEmailConfig struct {
+	Enabled           bool   `yaml:"enabled"`
+	ReplyDomain       string `yaml:"reply_domain"`
+	MailgunSigningKey string `yaml:"mailgun_signing_key"`
+	MIMESecret        string `yaml:"mime_secret"` // Sent as a bearer token with raw MIME replies.  They're refused without it.
+}
+
 type VictorOps struct {
 	APIKey string `yaml:"api_key"`
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ConfigErrors lists every problem found in the config, so that they can all be fixed in one go
+type ConfigErrors []error
+
+func (ce ConfigErrors) Error() string {
+	msgs := make([]string, len(ce))
+	for i, err := range ce {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (ce *ConfigErrors) add(format string, a ...interface{}) {
+	*ce = append(*ce, fmt.Errorf(format, a...))
+}
+
+// Returns nil if there were no problems
+func (ce ConfigErrors) errorOrNil() error {
+	if len(ce) == 0 {
+		return nil
+	}
+	return ce
+}
+
+// Checks the config for settings that can't work.  The error is a ConfigErrors if there are any problems.
+func (cfg *Config) Validate() error {
+	var errs ConfigErrors
+
+	s := cfg.Service
+
+	// Every listener needs a valid address, and no two listeners can share a port
+	listeners := []struct{ name, addr string }{
+		{"service.api_listen_address", s.APIListenAddr},
+		{"service.callback_listen_address", s.CallbackListenAddr},
+		{"service.click_listen_address", s.ClickListenAddr},
+	}
+	if cfg.Integrations.Mock.Enabled {
+		listeners = append(listeners, struct{ name, addr string }{"integrations.mock.listen_address", cfg.Integrations.Mock.ListenAddr})
+	}
+
+	for i, l := range listeners {
+		if l.addr == "" {
+			errs.add("%v is not set", l.name)
+			continue
+		}
+		host, port, err := splitListenAddr(l.addr)
+		if err != nil {
+			errs.add("%v %q is not a valid address: %v", l.name, l.addr, err)
+			continue
+		}
+
+		for _, other := range listeners[:i] {
+			otherHost, otherPort, err := splitListenAddr(other.addr)
+			if err == nil && port == otherPort && port != "0" && hostsOverlap(host, otherHost) {
+				errs.add("%v and %v both listen on port %v", other.name, l.name, port)
+			}
+		}
+	}
+
+	checkURLBase(&errs, "service.callback_url_base", s.CallbackURLBase)
+	checkURLBase(&errs, "service.click_url_base", s.ClickURLBase)
+
+	if s.DBFile == "" {
+		errs.add("service.db_file is not set")
+	}
+	if s.ShutdownTimeout < 0 {
+		errs.add("service.shutdown_timeout can't be negative")
+	}
+
+	rl := cfg.RateLimits
+	if rl.PerPerson < 0 {
+		errs.add("rate_limits.per_person can't be negative")
+	}
+	if rl.Global < 0 {
+		errs.add("rate_limits.global can't be negative")
+	}
+	if rl.Period < 0 {
+		errs.add("rate_limits.period can't be negative")
+	}
+
+	// Twilio needs all of its settings or none of them
+	t := cfg.Integrations.Twilio
+	if t.AccountSID != "" || t.AuthToken != "" || t.CallFromNumber != "" {
+		if t.AccountSID == "" {
+			errs.add("integrations.twilio.account_sid is not set")
+		}
+		if t.AuthToken == "" {
+			errs.add("integrations.twilio.auth_token is not set")
+		}
+		if t.CallFromNumber == "" {
+			errs.add("integrations.twilio.call_from_number is not set")
+		}
+		if t.APIBaseURL == "" {
+			errs.add("integrations.twilio.api_base_url is not set")
+		}
+	}
+	if t.APIBaseURL != "" {
+		u, err := url.Parse(t.APIBaseURL)
+		switch {
+		case err != nil || !u.IsAbs() || u.Host == "":
+			errs.add("integrations.twilio.api_base_url %q is not an absolute URL", t.APIBaseURL)
+		case !strings.HasSuffix(t.APIBaseURL, "/"):
+			errs.add("integrations.twilio.api_base_url %q must end with a slash", t.APIBaseURL)
+		}
+	}
+
+	mg := cfg.Integrations.Mailgun
+	if mg.Enabled {
+		if mg.APIKey == "" {
+			errs.add("integrations.mailgun.api_key is not set")
+		}
+		if mg.Hostname == "" {
+			errs.add("integrations.mailgun.hostname is not set")
+		}
+	}
+
+	// We only use SMTP when Mailgun is disabled, but a half-configured server is a mistake either way
+	sm := cfg.Integrations.SMTP
+	if sm.Hostname != "" {
+		if sm.Port <= 0 || sm.Port > 65535 {
+			errs.add("integrations.smtp.port %v is not a valid port", sm.Port)
+		}
+		if sm.Sender == "" {
+			errs.add("integrations.smtp.sender is not set")
+		} else if _, err := mail.ParseAddress(sm.Sender); err != nil {
+			errs.add("integrations.smtp.sender %q is not a valid e-mail address", sm.Sender)
+		}
+	}
+
+	ie := cfg.Integrations.InboundEmail
+	if ie.Enabled {
+		if ie.ReplyDomain == "" {
+			errs.add("integrations.inbound_email.reply_domain is not set")
+		}
+		if s.CallbackURLBase == "" {
+			errs.add("integrations.inbound_email is enabled but service.callback_url_base is not set")
+		}
+		if ie.MailgunSigningKey == "" && ie.MIMESecret == "" {
+			errs.add("integrations.inbound_email is enabled but neither mailgun_signing_key nor mime_secret is set, so no replies would be accepted")
+		}
+	}
+
+	if _, err := parseLogLevel(cfg.Logging.Level); err != nil {
+		errs.add("logging.level: %v", err)
+	}
+	if _, err := parseLogFormat(cfg.Logging.Format); err != nil {
+		errs.add("logging.format: %v", err)
+	}
+
+	for language, mt := range cfg.Templates {
+		mt := mt
+		if err := mt.Validate(); err != nil {
+			errs.add("templates.%v: %v", language, err)
+		}
+	}
+
+	return errs.errorOrNil()
+}
+
+// Checks stored notification plans for steps that this config can't carry out.  The error is a ConfigErrors
+// if there are any problems.
+func (cfg *Config) CheckPlans(plans []*NotificationPlan) error {
+	var errs ConfigErrors
+
+	for _, p := range plans {
+		for n, s := range p.Steps {
+			where := fmt.Sprintf("Notification plan for %v, step %v", p.Username, n+1)
+
+			for _, m := range s.AllMethods() {
+				u, err := url.Parse(m)
+				if err != nil {
+					errs.add("%v: method is not a valid URI", where)
+					continue
+				}
+
+				switch u.Scheme {
+				case "phone":
+					if !cfg.twilioConfigured() {
+						errs.add("%v: uses phone but Twilio is not configured", where)
+					}
+					if cfg.Service.CallbackURLBase == "" {
+						errs.add("%v: uses phone but service.callback_url_base is not set", where)
+					}
+				case "sms":
+					if !cfg.twilioConfigured() {
+						errs.add("%v: uses sms but Twilio is not configured", where)
+					}
+				case "email":
+					if !cfg.emailConfigured() {
+						errs.add("%v: uses email but neither Mailgun nor SMTP is configured", where)
+					}
+					if cfg.Service.ClickURLBase == "" {
+						errs.add("%v: uses email but service.click_url_base is not set", where)
+					}
+				default:
+					errs.add("%v: method %q is not supported", where, u.Scheme)
+				}
+			}
+		}
+	}
+
+	return errs.errorOrNil()
+}
+
+func (cfg *Config) twilioConfigured() bool {
+	t := cfg.Integrations.Twilio
+	return cfg.Integrations.Mock.Enabled || (t.AccountSID != "" && t.AuthToken != "" && t.CallFromNumber != "")
+}
+
+func (cfg *Config) emailConfigured() bool {
+	return cfg.Integrations.Mock.Enabled || cfg.Integrations.Mailgun.Enabled || cfg.Integrations.SMTP.Hostname != ""
+}
+
+// The -check-config mode: checks the config and, if we can open the DB, the stored notification plans.
+// Problems are printed to stdout.  Returns the exit status.
+func checkConfig(cfg *Config) int {
+	var problems ConfigErrors
+
+	if err := cfg.Validate(); err != nil {
+		problems = append(problems, err.(ConfigErrors)...)
+	}
+
+	if cfg.Service.DBFile != "" {
+		_, err := os.Stat(cfg.Service.DBFile)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Println("Note: database", cfg.Service.DBFile, "does not exist yet, so there are no notification plans to check")
+		default:
+			err = c.DB.OpenReadOnly(cfg.Service.DBFile)
+			if err != nil {
+				fmt.Println("Note: notification plans were not checked.", err, "(Is Chicken Little running?)")
+				break
+			}
+			defer c.DB.Close()
+
+			plans, _ := c.GetAllNotificationPlans()
+			if err := cfg.CheckPlans(plans); err != nil {
+				problems = append(problems, err.(ConfigErrors)...)
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("Config OK")
+		return 0
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	return 1
+}
+
+// Splits a listen address like ":7072" or "127.0.0.1:7072" and checks the port
+func splitListenAddr(addr string) (string, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", err
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return "", "", fmt.Errorf("port %q is not a number between 0 and 65535", port)
+	}
+
+	return host, strconv.Itoa(n), nil
+}
+
+// Reports whether two listen hosts can clash.  An empty or unspecified host listens on every interface.
+func hostsOverlap(a, b string) bool {
+	wildcard := func(h string) bool {
+		return h == "" || h == "0.0.0.0" || h == "::"
+	}
+	return a == b || wildcard(a) || wildcard(b)
+}
+
+// URL bases need to be absolute, and we add the slash after them ourselves
+func checkURLBase(errs *ConfigErrors, name, base string) {
+	if base == "" {
+		return
+	}
+
+	u, err := url.Parse(base)
+	switch {
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		errs.add("%v %q is not an absolute http or https URL", name, base)
+	case strings.HasSuffix(base, "/"):
+		errs.add("%v %q must not end with a slash", name, base)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A config that passes validation, for tests to break
+func testValidConfig() Config {
+	return Config{
+		Service: ServiceConfig{
+			APIListenAddr:      ":7072",
+			CallbackListenAddr: ":7073",
+			CallbackURLBase:    "https://callbacks.example.com",
+			ClickListenAddr:    "127.0.0.1:7074",
+			ClickURLBase:       "https://clicks.example.com",
+			DBFile:             "./chickenlittle.db",
+		},
+		Integrations: Integrations{
+			Twilio: Twilio{
+				AccountSID:     "AC123",
+				AuthToken:      "secret",
+				CallFromNumber: "+15005550006",
+				APIBaseURL:     "https://api.twilio.com/2010-04-01/Accounts/",
+			},
+			SMTP: SMTP{Hostname: "smtp.example.com", Port: 587, Sender: "chickenlittle@example.com"},
+		},
+	}
+}
+
+func TestSampleConfigIsValid(t *testing.T) {
+	y, err := ioutil.ReadFile("config.yaml.sample")
+	if err != nil {
+		t.Fatalf("Could not read sample config: %s", err)
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(y, &cfg)
+	if err != nil {
+		t.Fatalf("Could not parse sample config: %s", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Sample config is invalid: %s", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		errs   []string
+	}{
+		{"valid", func(cfg *Config) {}, nil},
+		{"missing listen address", func(cfg *Config) { cfg.Service.APIListenAddr = "" }, []string{"service.api_listen_address is not set"}},
+		{"bad port", func(cfg *Config) { cfg.Service.ClickListenAddr = ":http-alt" }, []string{"service.click_listen_address"}},
+		{"port conflict", func(cfg *Config) { cfg.Service.ClickListenAddr = "127.0.0.1:7072" }, []string{"service.api_listen_address and service.click_listen_address both listen on port 7072"}},
+		{"different hosts", func(cfg *Config) {
+			cfg.Service.APIListenAddr = "10.0.0.1:7074"
+		}, nil},
+		{"mock port conflict", func(cfg *Config) {
+			cfg.Integrations.Mock = Mock{Enabled: true, ListenAddr: ":7073"}
+		}, []string{"both listen on port 7073"}},
+		{"relative url base", func(cfg *Config) { cfg.Service.CallbackURLBase = "callbacks.example.com" }, []string{"service.callback_url_base"}},
+		{"url base with slash", func(cfg *Config) { cfg.Service.ClickURLBase = "https://clicks.example.com/" }, []string{"must not end with a slash"}},
+		{"partial twilio", func(cfg *Config) { cfg.Integrations.Twilio.AuthToken = "" }, []string{"integrations.twilio.auth_token is not set"}},
+		{"twilio base without slash", func(cfg *Config) {
+			cfg.Integrations.Twilio.APIBaseURL = "https://api.twilio.com/2010-04-01/Accounts"
+		}, []string{"integrations.twilio.api_base_url"}},
+		{"smtp without sender", func(cfg *Config) { cfg.Integrations.SMTP.Sender = "" }, []string{"integrations.smtp.sender is not set"}},
+		{"mailgun without key", func(cfg *Config) {
+			cfg.Integrations.Mailgun = Mailgun{Enabled: true, Hostname: "mg.example.com"}
+		}, []string{"integrations.mailgun.api_key is not set"}},
+		{"inbound email without domain", func(cfg *Config) {
+			cfg.Integrations.InboundEmail = InboundEmailConfig{Enabled: true, MailgunSigningKey: "key-secret"}
+		}, []string{"integrations.inbound_email.reply_domain is not set"}},
+		{"inbound email without a way in", func(cfg *Config) {
+			cfg.Integrations.InboundEmail = InboundEmailConfig{Enabled: true, ReplyDomain: "replies.example.com"}
+		}, []string{"neither mailgun_signing_key nor mime_secret is set"}},
+		{"negative rate limit", func(cfg *Config) { cfg.RateLimits.PerPerson = -1 }, []string{"rate_limits.per_person can't be negative"}},
+		{"bad log level", func(cfg *Config) { cfg.Logging.Level = "loud" }, []string{"logging.level"}},
+		{"bad template", func(cfg *Config) {
+			cfg.Templates = map[string]MessageTemplates{"default": {SMS: "{{.Nope}}"}}
+		}, []string{"templates.default"}},
+		{"several problems", func(cfg *Config) {
+			cfg.Service.DBFile = ""
+			cfg.Integrations.SMTP.Port = 0
+		}, []string{"service.db_file is not set", "integrations.smtp.port 0 is not a valid port"}},
+	}
+
+	for _, tt := range tests {
+		cfg := testValidConfig()
+		tt.change(&cfg)
+
+		err := cfg.Validate()
+		if tt.errs == nil {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %s", tt.name, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("%v: expected an error", tt.name)
+			continue
+		}
+		if n := len(err.(ConfigErrors)); n != len(tt.errs) {
+			t.Errorf("%v: expected %d errors, got %d: %s", tt.name, len(tt.errs), n, err)
+		}
+		for _, e := range tt.errs {
+			if !strings.Contains(err.Error(), e) {
+				t.Errorf("%v: expected error containing %q, got %s", tt.name, e, err)
+			}
+		}
+	}
+}
+
+func TestCheckPlans(t *testing.T) {
+	plans := []*NotificationPlan{
+		{Username: "lancelot", Steps: []NotificationStep{
+			{Method: "sms://+12108675309"},
+			{Method: "phone://+12108675309"},
+			{Method: "email://lancelot@camelot.example.com"},
+		}},
+	}
+
+	cfg := testValidConfig()
+	if err := cfg.CheckPlans(plans); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	cfg.Service.CallbackURLBase = ""
+	cfg.Integrations.SMTP = SMTP{}
+	plans = append(plans, &NotificationPlan{Username: "mordred", Steps: []NotificationStep{{Method: "pager://1234"}}})
+
+	err := cfg.CheckPlans(plans)
+	if err == nil {
+		t.Fatalf("Expected problems with the plans")
+	}
+	for _, e := range []string{
+		"lancelot, step 2: uses phone but service.callback_url_base is not set",
+		"lancelot, step 3: uses email but neither Mailgun nor SMTP is configured",
+		`mordred, step 1: method "pager" is not supported`,
+	} {
+		if !strings.Contains(err.Error(), e) {
+			t.Errorf("Expected error containing %q, got %s", e, err)
+		}
+	}
+
+	// Phone numbers aren't repeated back
+	if strings.Contains(err.Error(), "2108675309") {
+		t.Errorf("Plan errors contain a phone number: %s", err)
+	}
+}
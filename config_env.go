@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every config setting can be overridden by an environment variable named after its path in config.yaml,
+// e.g. CHICKENLITTLE_INTEGRATIONS_TWILIO_AUTH_TOKEN for integrations.twilio.auth_token.  Adding _FILE to the
+// name reads the value from a file instead, which is handy for secrets mounted into a container.
+const configEnvPrefix = "CHICKENLITTLE"
+
+// Overrides config settings with any environment variables that are set for them
+func (cfg *Config) ApplyEnvironment() error {
+	return cfg.applyEnv(os.LookupEnv)
+}
+
+func (cfg *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs ConfigErrors
+	applyEnvToStruct(reflect.ValueOf(cfg).Elem(), configEnvPrefix, lookup, &errs)
+	return errs.errorOrNil()
+}
+
+func applyEnvToStruct(v reflect.Value, prefix string, lookup func(string) (string, bool), errs *ConfigErrors) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name := prefix + "_" + strings.ToUpper(tag)
+		f := v.Field(i)
+
+		if f.Kind() == reflect.Struct {
+			applyEnvToStruct(f, name, lookup, errs)
+			continue
+		}
+
+		val, ok, err := lookupEnvSetting(name, lookup)
+		if err != nil {
+			errs.add("%v", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		err = setConfigField(f, val)
+		if err != nil {
+			errs.add("%v: %v", name, err)
+		}
+	}
+}
+
+// Finds the value for a setting in the variable itself, or in the file that its _FILE variant names
+func lookupEnvSetting(name string, lookup func(string) (string, bool)) (string, bool, error) {
+	val, ok := lookup(name)
+	file, fromFile := lookup(name + "_FILE")
+
+	switch {
+	case ok && fromFile:
+		return "", false, fmt.Errorf("%v and %v_FILE are both set", name, name)
+	case fromFile:
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", false, fmt.Errorf("%v_FILE: %v", name, err)
+		}
+		// Files written by hand or by echo usually end with a newline that isn't part of the secret
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	}
+
+	return val, ok, nil
+}
+
+func setConfigField(f reflect.Value, val string) error {
+	// Durations are int64s underneath, so they need to be caught first
+	if f.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", val)
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", val)
+		}
+		f.SetInt(int64(n))
+	default:
+		return fmt.Errorf("can't be set from the environment")
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigEnvironment(t *testing.T) {
+	secret, err := ioutil.TempFile(os.TempDir(), "chickenlittle-secret-")
+	if err != nil {
+		t.Fatalf("Could not create secret file: %s", err)
+	}
+	defer os.Remove(secret.Name())
+	secret.WriteString("smtp-password\n")
+	secret.Close()
+
+	env := map[string]string{
+		"CHICKENLITTLE_INTEGRATIONS_TWILIO_AUTH_TOKEN":  "twilio-token",
+		"CHICKENLITTLE_INTEGRATIONS_SMTP_PASSWORD_FILE": secret.Name(),
+		"CHICKENLITTLE_INTEGRATIONS_SMTP_PORT":          "2525",
+		"CHICKENLITTLE_INTEGRATIONS_MAILGUN_ENABLED":    "true",
+		"CHICKENLITTLE_SERVICE_SHUTDOWN_TIMEOUT":        "1m",
+		"CHICKENLITTLE_LOGGING_LEVEL":                   "debug",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	cfg := testValidConfig()
+	err = cfg.applyEnv(lookup)
+	if err != nil {
+		t.Fatalf("applyEnv() failed: %s", err)
+	}
+
+	if cfg.Integrations.Twilio.AuthToken != "twilio-token" {
+		t.Errorf("Twilio auth token was not overridden: %q", cfg.Integrations.Twilio.AuthToken)
+	}
+	if cfg.Integrations.SMTP.Password != "smtp-password" {
+		t.Errorf("SMTP password was not read from its file: %q", cfg.Integrations.SMTP.Password)
+	}
+	if cfg.Integrations.SMTP.Port != 2525 || !cfg.Integrations.Mailgun.Enabled || cfg.Service.ShutdownTimeout != time.Minute || cfg.Logging.Level != "debug" {
+		t.Errorf("Settings were not overridden: %+v", cfg)
+	}
+
+	// Settings that aren't in the environment are left alone
+	if cfg.Integrations.Twilio.AccountSID != "AC123" {
+		t.Errorf("Twilio account SID was changed: %q", cfg.Integrations.Twilio.AccountSID)
+	}
+
+	// Bad values are all reported
+	env = map[string]string{
+		"CHICKENLITTLE_INTEGRATIONS_SMTP_PORT":              "smtp",
+		"CHICKENLITTLE_INTEGRATIONS_MOCK_ENABLED":           "maybe",
+		"CHICKENLITTLE_INTEGRATIONS_TWILIO_AUTH_TOKEN":      "twilio-token",
+		"CHICKENLITTLE_INTEGRATIONS_TWILIO_AUTH_TOKEN_FILE": secret.Name(),
+		"CHICKENLITTLE_INTEGRATIONS_MAILGUN_API_KEY_FILE":   "/nonexistent",
+	}
+
+	err = cfg.applyEnv(lookup)
+	if err == nil {
+		t.Fatalf("Expected errors from bad settings")
+	}
+	if n := len(err.(ConfigErrors)); n != 4 {
+		t.Errorf("Expected 4 errors, got %d: %s", n, err)
+	}
+	if !strings.Contains(err.Error(), "CHICKENLITTLE_INTEGRATIONS_TWILIO_AUTH_TOKEN and CHICKENLITTLE_INTEGRATIONS_TWILIO_AUTH_TOKEN_FILE are both set") {
+		t.Errorf("Unexpected errors: %s", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"gopkg.in/yaml.v2"
+)
+
+type ReloadConfigResponse struct {
+	Message  string   `json:"message,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// Returns a copy of the current config.  Anything that needs several settings to agree, like the
+// credentials and addresses for a Twilio request, should take one copy and use it throughout.
+func (c *ChickenLittle) CurrentConfig() Config {
+	c.configMu.RLock()
+	defer c.configMu.RUnlock()
+
+	return c.Config
+}
+
+// Reads a config file and applies any settings from the environment.  The config isn't validated.
+func readConfig(filename string) (Config, error) {
+	var cfg Config
+
+	y, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return cfg, fmt.Errorf("Error opening config file: %v", err)
+	}
+
+	err = yaml.Unmarshal(y, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("Error parsing config file: %v", err)
+	}
+
+	// Settings in the environment, like secrets, take precedence over the file
+	err = cfg.ApplyEnvironment()
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// Re-reads the config file and swaps in the new config, as long as it's valid.  Otherwise, we carry on
+// with the old config.  Settings that can only change with a restart keep their old values; a warning is
+// returned for each of them that was changed, and for plan steps that the new config can't carry out.
+func reloadConfig(filename string) ([]string, error) {
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+
+	// Our listeners and the DB are already open
+	old := c.CurrentConfig()
+	restartOnly := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"service.api_listen_address", old.Service.APIListenAddr, cfg.Service.APIListenAddr},
+		{"service.callback_listen_address", old.Service.CallbackListenAddr, cfg.Service.CallbackListenAddr},
+		{"service.click_listen_address", old.Service.ClickListenAddr, cfg.Service.ClickListenAddr},
+		{"service.db_file", old.Service.DBFile, cfg.Service.DBFile},
+		{"integrations.mock", old.Integrations.Mock, cfg.Integrations.Mock},
+	}
+	for _, s := range restartOnly {
+		if s.old != s.new {
+			warnings = append(warnings, fmt.Sprintf("%v can't be changed without a restart.  Keeping the old setting.", s.name))
+		}
+	}
+	cfg.Service.APIListenAddr = old.Service.APIListenAddr
+	cfg.Service.CallbackListenAddr = old.Service.CallbackListenAddr
+	cfg.Service.ClickListenAddr = old.Service.ClickListenAddr
+	cfg.Service.DBFile = old.Service.DBFile
+	cfg.Integrations.Mock = old.Integrations.Mock
+
+	if c.DB.Handle != nil {
+		plans, err := c.GetAllNotificationPlans()
+		if err == nil {
+			if err := cfg.CheckPlans(plans); err != nil {
+				for _, e := range err.(ConfigErrors) {
+					warnings = append(warnings, e.Error())
+				}
+			}
+		}
+	}
+
+	// This can still fail if the log file can't be opened, so it goes before the swap
+	err = configureLogging(cfg.Logging)
+	if err != nil {
+		return nil, err
+	}
+
+	c.configMu.Lock()
+	c.Config = cfg
+	c.configMu.Unlock()
+
+	logger.Info("Config reloaded", "file", filename)
+	for _, w := range warnings {
+		logger.Warn("Config reload warning", "warning", w)
+	}
+
+	return warnings, nil
+}
+
+// Reloads the config file, just like a SIGHUP does
+func ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	var res ReloadConfigResponse
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	warnings, err := reloadConfig(cfgPath)
+	if err != nil {
+		logger.Error("Config reload failed.  Keeping the old config.", "err", err)
+
+		res.Error = "Config reload failed.  Keeping the old config."
+		if ce, ok := err.(ConfigErrors); ok {
+			for _, e := range ce {
+				res.Problems = append(res.Problems, e.Error())
+			}
+		} else {
+			res.Problems = []string{err.Error()}
+		}
+
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), 422)
+		return
+	}
+
+	res.Message = "Config reloaded"
+	res.Warnings = warnings
+
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestReloadConfig(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+
+	saved := c.CurrentConfig()
+	defer func() { c.Config = saved }()
+
+	c.Config = testValidConfig()
+	cfgPath = tempdir + "/config.yaml"
+
+	writeConfig := func(cfg Config) {
+		y, err := yaml.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("Could not marshal config: %s", err)
+		}
+		err = ioutil.WriteFile(cfgPath, y, 0600)
+		if err != nil {
+			t.Fatalf("Could not write config: %s", err)
+		}
+	}
+
+	// A rotated token is picked up
+	cfg := testValidConfig()
+	cfg.Integrations.Twilio.AuthToken = "rotated"
+	writeConfig(cfg)
+
+	w := testAPIRequest(t, "POST", "http://localhost/admin/reload", "")
+	if w.Code != 200 {
+		t.Fatalf("Reload failed: %s", w.Body)
+	}
+	if token := c.CurrentConfig().Integrations.Twilio.AuthToken; token != "rotated" {
+		t.Errorf("Twilio auth token was not reloaded: %q", token)
+	}
+
+	// Listen addresses need a restart
+	cfg.Service.APIListenAddr = ":8080"
+	cfg.Integrations.SMTP.Hostname = "smtp2.example.com"
+	writeConfig(cfg)
+
+	w = testAPIRequest(t, "POST", "http://localhost/admin/reload", "")
+	if w.Code != 200 {
+		t.Fatalf("Reload failed: %s", w.Body)
+	}
+
+	var res ReloadConfigResponse
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "service.api_listen_address") {
+		t.Errorf("Expected a warning about the listen address, got %+v", res)
+	}
+	if current := c.CurrentConfig(); current.Service.APIListenAddr != ":7072" || current.Integrations.SMTP.Hostname != "smtp2.example.com" {
+		t.Errorf("Unexpected config after reload: %+v", current)
+	}
+
+	// An invalid config is rejected and the old one stays
+	cfg.Integrations.Twilio.AuthToken = ""
+	cfg.Integrations.SMTP.Sender = ""
+	writeConfig(cfg)
+
+	w = testAPIRequest(t, "POST", "http://localhost/admin/reload", "")
+	if w.Code != 422 {
+		t.Fatalf("Expected an invalid config to be rejected, got %d: %s", w.Code, w.Body)
+	}
+
+	res = ReloadConfigResponse{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if len(res.Problems) != 2 {
+		t.Errorf("Expected 2 problems, got %+v", res)
+	}
+	if token := c.CurrentConfig().Integrations.Twilio.AuthToken; token != "rotated" {
+		t.Errorf("Config changed after a rejected reload: %q", token)
+	}
+
+	// So is a file that doesn't parse
+	ioutil.WriteFile(cfgPath, []byte("service: [unclosed"), 0600)
+	w = testAPIRequest(t, "POST", "http://localhost/admin/reload", "")
+	if w.Code != 422 {
+		t.Errorf("Expected a malformed config to be rejected, got %d: %s", w.Code, w.Body)
+	}
+}
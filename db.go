@@ -3,7 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/boltdb/bolt"
-	"log"
+	"time"
 )
 
 type DB struct {
@@ -16,12 +16,25 @@ func (db *DB) Open(dbfile string) {
 
 	db.Handle, err = bolt.Open(dbfile, 0600, nil)
 	if err != nil {
-		log.Fatalln(err)
+		logger.Fatal("Could not open database", "file", dbfile, "err", err)
 	}
 
 	return
 }
 
+// Open the BoltDB file without write access, so that we can look at it while another Chicken Little
+// is using it.  We give up if it's locked for more than a second.
+func (db *DB) OpenReadOnly(dbfile string) error {
+	var err error
+
+	db.Handle, err = bolt.Open(dbfile, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("Could not open %v: %v", dbfile, err)
+	}
+
+	return nil
+}
+
 // Close the BoltDB file
 func (db *DB) Close() {
 	db.Handle.Close()
@@ -31,7 +44,7 @@ func (db *DB) Close() {
 // Store a key/value in a BoltDB bucket
 func (d *DB) Store(bucket, key, value string) error {
 
-	log.Println("Storing:", key)
+	logger.Debug("Storing key", "bucket", bucket, "key", key)
 
 	err := d.Handle.Update(func(tx *bolt.Tx) error {
 		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
@@ -53,7 +66,7 @@ func (d *DB) Store(bucket, key, value string) error {
 // Delete a key from a BoltDB bucket
 func (d *DB) Delete(bucket, key string) error {
 
-	log.Println("Deleting", key, "from bucket", bucket)
+	logger.Debug("Deleting key", "bucket", bucket, "key", key)
 
 	err := d.Handle.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(bucket))
@@ -77,7 +90,7 @@ func (d *DB) Fetch(bucket, key string) (string, error) {
 
 	var val string
 
-	log.Println("Fetching", key, "from bucket", bucket)
+	logger.Debug("Fetching key", "bucket", bucket, "key", key)
 
 	err := d.Handle.View(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(bucket))
@@ -101,7 +114,7 @@ func (d *DB) Fetch(bucket, key string) (string, error) {
 func (d *DB) FetchAll(bucket string) ([]string, error) {
 	var vals []string
 
-	log.Println("Fetching all from bucket", bucket)
+	logger.Debug("Fetching all keys", "bucket", bucket)
 
 	err := d.Handle.View(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(bucket))
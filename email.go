@@ -1,21 +1,47 @@
 package main
 
-import (
-	"fmt"
-	"log"
-)
-
-func SendEmail(address, message, uuid string) {
-	log.Println("[", uuid, "] Sending email to:", address)
-	subject := "Chicken Little message received"
-	plain := fmt.Sprint("You've received a message from the Chicken Little alert system:\n\n", message,
-		"\n\n", "Stop notifications for this alert: ", c.Config.Service.ClickURLBase, "/", uuid, "/stop")
-	html := fmt.Sprint("<HTML><BODY>You've received a message from the Chicken Little alert system:<BR><BR>",
-		message, "<BR><BR><A HREF='", c.Config.Service.ClickURLBase, "/", uuid, "/stop'>Stop notifications for this alert</A></BODY></HTML>")
-
-	if c.Config.Integrations.Mailgun.Enabled {
-		SendEmailMailgun(address, subject, plain, html)
-	} else {
-		SendEmailSMTP(address, subject, plain, html)
+// Sends the notification by e-mail.  Failures are returned so that they can be counted, but they
+// don't change the course of the plan.
+func SendEmail(address, message, uuid string) error {
+	l := notificationLogger(uuid)
+	l.Info("Sending e-mail")
+	l.Debug("E-mail details", "to", address, "content", message)
+
+	// Replies to our e-mail can acknowledge it if inbound e-mail is set up
+	replyTo, messageID := emailReplyHeaders(uuid)
+
+	d := messageData(uuid)
+	d.Content = message
+	d.AckByReply = replyTo != ""
+
+	subject := RenderMessage("email_subject", d)
+	plain := RenderMessage("email_text", d)
+	html := RenderMessage("email_html", d)
+
+	return deliverEmail(address, subject, plain, html, uuid, replyTo, messageID)
+}
+
+// Sends a plain text e-mail about a notification that doesn't ask for a response
+func SendEmailNotice(address, subject, plain, uuid string) error {
+	l := notificationLogger(uuid)
+	l.Info("Sending e-mail notice")
+	l.Debug("E-mail notice details", "to", address, "subject", subject)
+
+	return deliverEmail(address, subject, plain, "", uuid, "", "")
+}
+
+// Hands an e-mail to whichever provider is configured
+func deliverEmail(address, subject, plain, html, uuid, replyTo, messageID string) error {
+	// Every part of the send uses the same config, even if it's reloaded while we're sending
+	cfg := c.CurrentConfig()
+
+	switch {
+	case cfg.Integrations.Mock.Enabled:
+		mockProvider.RecordEmail(address, subject, plain, html, uuid, replyTo, messageID)
+		return nil
+	case cfg.Integrations.Mailgun.Enabled:
+		return SendEmailMailgun(cfg.Integrations.Mailgun, address, subject, plain, html, replyTo, messageID)
+	default:
+		return SendEmailSMTP(cfg.Integrations.SMTP, address, subject, plain, html, replyTo, messageID)
 	}
 }
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replies are sent to ack+<UUID>@<reply_domain>, and our e-mails have a Message-ID of <UUID@reply_domain>
+// so that the In-Reply-To header of a reply leads us back to the notification, too.
+const inboundEmailLocalPart = "ack"
+
+// How far the timestamp of a Mailgun webhook can be from our clock.  Older requests are refused, so a captured
+// one can't be sent again later, and we only need to remember tokens for this long to refuse it sooner.
+const mailgunSignatureMaxAge = 15 * time.Minute
+
+// The tokens of the Mailgun webhooks that we've accepted recently, and when we can forget them
+var mailgunTokens = struct {
+	sync.Mutex
+	seen map[string]time.Time
+}{seen: make(map[string]time.Time)}
+
+var (
+	uuidPattern    = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	ackWordPattern = regexp.MustCompile(`(?i)\back(nowledged?)?\b`)
+	ackForPattern  = regexp.MustCompile(`(?i)\back(?:nowledged?)?\s+(?:for\s+)?(\d+[a-z]*)\b`) // "ack 1h" or "acknowledge for 30m"
+	quoteIntro     = regexp.MustCompile(`^On .* wrote:$`)
+
+	// For reading the text of an HTML-only reply
+	htmlHidden    = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)>|<!--.*?-->`)
+	htmlQuote     = regexp.MustCompile(`(?is)<blockquote\b.*</blockquote>`)
+	htmlLineBreak = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|tr|li|h[1-6])>`)
+	htmlTag       = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// InboundEmail is a reply to one of our notification e-mails
+type InboundEmail struct {
+	From       string
+	To         []string
+	InReplyTo  string
+	References string
+	Body       string
+}
+
+// The Reply-To and Message-ID headers for a notification e-mail, or empty strings if inbound
+// e-mail isn't enabled
+func emailReplyHeaders(uuid string) (string, string) {
+	ie := c.CurrentConfig().Integrations.InboundEmail
+	if !ie.Enabled || uuid == "" {
+		return "", ""
+	}
+
+	return fmt.Sprint(inboundEmailLocalPart, "+", uuid, "@", ie.ReplyDomain), fmt.Sprint("<", uuid, "@", ie.ReplyDomain, ">")
+}
+
+// Receives replies that Mailgun forwards to us with a route like
+// forward("https://<callback_url_base>/email/mailgun")
+func ReceiveMailgunEmail(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(1024 * 1024)
+	if err != nil && err != http.ErrNotMultipart {
+		logger.Error("Could not parse e-mail from Mailgun", "err", err)
+	}
+
+	if !verifyMailgunSignature(r.FormValue("timestamp"), r.FormValue("token"), r.FormValue("signature")) {
+		logger.Warn("Invalid Mailgun signature on e-mail")
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	e := InboundEmail{
+		From:       r.FormValue("from"),
+		To:         []string{r.FormValue("recipient")},
+		InReplyTo:  r.FormValue("In-Reply-To"),
+		References: r.FormValue("References"),
+		Body:       r.FormValue("stripped-text"),
+	}
+	if e.Body == "" {
+		e.Body = r.FormValue("body-plain")
+	}
+
+	receiveEmailReply(w, e)
+}
+
+// Receives a reply as a raw MIME message in the request body, for mail servers that can pipe
+// messages to a URL.  The mail server has to send the mime_secret as a bearer token, since the sender
+// check relies on it having verified the From header.
+func ReceiveMIMEEmail(w http.ResponseWriter, r *http.Request) {
+	if !verifyMIMESecret(r.Header.Get("Authorization")) {
+		logger.Warn("Invalid or missing secret on MIME e-mail")
+		http.Error(w, "Invalid secret", http.StatusForbidden)
+		return
+	}
+
+	m, err := mail.ReadMessage(io.LimitReader(r.Body, 1024*1024))
+	if err != nil {
+		logger.Error("Could not read MIME e-mail", "err", err)
+		http.Error(w, "Could not parse message", http.StatusBadRequest)
+		return
+	}
+
+	e, err := parseMIMEEmail(m)
+	if err != nil {
+		logger.Error("Could not parse MIME e-mail", "err", err)
+		http.Error(w, "Could not parse message", http.StatusBadRequest)
+		return
+	}
+
+	receiveEmailReply(w, e)
+}
+
+// Acknowledges the notification that an e-mail is a reply to, if it says so and comes from the
+// person who was notified
+func receiveEmailReply(w http.ResponseWriter, e InboundEmail) {
+	var res CallbackResponse
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	uuid := emailReplyUUID(e)
+	res.UUID = uuid
+
+	if uuid == "" || !notificationInProgress(uuid) {
+		logger.Info("E-mail reply does not match an active notification")
+		logger.Debug("Unmatched e-mail reply details", "from", e.From)
+		res.Error = "No active notifications for this e-mail"
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusNotFound)
+		return
+	}
+
+	l := notificationLogger(uuid)
+	l.Info("Received an e-mail reply")
+	l.Debug("E-mail reply details", "from", e.From, "body", e.Body)
+
+	if !emailFromPerson(uuid, e.From) {
+		l.Warn("E-mail reply does not come from an address in the notification plan")
+		res.Error = "Sender does not match the person being notified"
+		errjson, _ := json.Marshal(res)
+		http.Error(w, string(errjson), http.StatusForbidden)
+		return
+	}
+
+	if !ackWordPattern.MatchString(replyText(e.Body)) {
+		l.Info("E-mail reply does not acknowledge the notification")
+		res.Message = "Reply does not acknowledge the notification"
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	// An acknowledgement can say how long until the notification is re-triggered
+	var snooze time.Duration
+	if m := ackForPattern.FindStringSubmatch(replyText(e.Body)); m != nil {
+		var err error
+		snooze, err = parseSnoozeDuration(m[1])
+		if err != nil {
+			l.Info("E-mail reply has an invalid duration", "err", err)
+			w.WriteHeader(422) // unprocessable entity
+			res.Error = err.Error()
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+	}
+
+	if snooze > 0 {
+		l.Info("Acknowledged by e-mail reply until a re-trigger", "for", snooze)
+	} else {
+		l.Info("Acknowledged by e-mail reply.  Attempting to stop notifications.")
+	}
+
+	acknowledgeNotification(uuid, AckChannelEmailReply, snooze)
+
+	res.Message = "Notification acknowledged"
+	json.NewEncoder(w).Encode(res)
+}
+
+// Finds the notification that an e-mail replies to, by its recipient address or else its
+// In-Reply-To and References headers
+func emailReplyUUID(e InboundEmail) string {
+	for _, to := range e.To {
+		addrs, err := mail.ParseAddressList(to)
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			local := strings.SplitN(a.Address, "@", 2)[0]
+			if strings.HasPrefix(strings.ToLower(local), inboundEmailLocalPart+"+") {
+				if id := uuidPattern.FindString(local); id != "" {
+					return strings.ToLower(id)
+				}
+			}
+		}
+	}
+
+	for _, h := range []string{e.InReplyTo, e.References} {
+		if id := uuidPattern.FindString(h); id != "" {
+			return strings.ToLower(id)
+		}
+	}
+
+	return ""
+}
+
+// Reports whether an e-mail address is one that the notification's plan sends e-mail to
+func emailFromPerson(uuid, from string) bool {
+	a, err := mail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	nr, exists := NIP.Requests[uuid]
+	if !exists || nr.Plan == nil {
+		return false
+	}
+
+	for _, s := range nr.Plan.Steps {
+		for _, m := range s.AllMethods() {
+			u, err := url.Parse(m)
+			if err != nil || u.Scheme != "email" {
+				continue
+			}
+
+			if strings.EqualFold(fmt.Sprint(u.User, "@", u.Host), a.Address) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// The text that the person wrote in a reply, without the quoted message beneath it
+func replyText(body string) string {
+	var lines []string
+
+	s := bufio.NewScanner(strings.NewReader(body))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, ">") || quoteIntro.MatchString(line) || line == "-----Original Message-----" {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Pulls the headers and plain text body that we need out of a MIME message
+func parseMIMEEmail(m *mail.Message) (InboundEmail, error) {
+	e := InboundEmail{
+		From:       m.Header.Get("From"),
+		InReplyTo:  m.Header.Get("In-Reply-To"),
+		References: m.Header.Get("References"),
+	}
+	for _, h := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		if v := m.Header.Get(h); v != "" {
+			e.To = append(e.To, v)
+		}
+	}
+
+	body, err := mimeText(m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Body)
+	if err != nil {
+		return e, err
+	}
+	e.Body = body
+
+	return e, nil
+}
+
+// Finds the text of a MIME body.  A text/plain part is preferred, but replies from some clients only have a
+// text/html part, so we fall back to that with its markup stripped.
+func mimeText(contentType, encoding string, body io.Reader) (string, error) {
+	text, isHTML, err := mimePart(contentType, encoding, body)
+	if err != nil {
+		return "", err
+	}
+
+	if isHTML {
+		return htmlText(text), nil
+	}
+	return text, nil
+}
+
+// Decodes the first text/plain part of a MIME body, or else its first text/html part, and reports whether
+// it's HTML
+func mimePart(contentType, encoding string, body io.Reader) (string, bool, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Messages without a Content-Type are plain text
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var htmlBody string
+		var haveHTML bool
+
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", false, err
+			}
+
+			text, isHTML, err := mimePart(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p)
+			if err != nil {
+				continue
+			}
+			if !isHTML {
+				return text, false, nil
+			}
+			if !haveHTML {
+				htmlBody, haveHTML = text, true
+			}
+		}
+
+		if haveHTML {
+			return htmlBody, true, nil
+		}
+		return "", false, fmt.Errorf("No text/plain or text/html part found")
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", false, fmt.Errorf("Unsupported content type %v", mediaType)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(b), mediaType == "text/html", nil
+}
+
+// The text of an HTML e-mail, without its markup or the message that it quotes
+func htmlText(s string) string {
+	s = htmlHidden.ReplaceAllString(s, "")
+	s = htmlQuote.ReplaceAllString(s, "")
+	s = htmlLineBreak.ReplaceAllString(s, "\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
+
+// Checks the signature that Mailgun sends with webhooks, and that the request is recent and hasn't been seen
+// before.  If no signing key has been configured, nothing is accepted.
+func verifyMailgunSignature(timestamp, token, signature string) bool {
+	key := c.CurrentConfig().Integrations.InboundEmail.MailgunSigningKey
+	if key == "" {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac.Sum(nil), expected) {
+		return false
+	}
+
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	now := time.Now()
+	sent := time.Unix(secs, 0)
+	if sent.Before(now.Add(-mailgunSignatureMaxAge)) || sent.After(now.Add(mailgunSignatureMaxAge)) {
+		logger.Warn("Mailgun webhook timestamp is out of range", "timestamp", sent)
+		return false
+	}
+
+	mailgunTokens.Lock()
+	defer mailgunTokens.Unlock()
+
+	for t, expires := range mailgunTokens.seen {
+		if now.After(expires) {
+			delete(mailgunTokens.seen, t)
+		}
+	}
+
+	if _, seen := mailgunTokens.seen[token]; seen {
+		logger.Warn("Mailgun webhook token has already been used")
+		return false
+	}
+	mailgunTokens.seen[token] = sent.Add(mailgunSignatureMaxAge)
+
+	return true
+}
+
+// Checks the bearer token sent with a raw MIME reply against the mime_secret.  Unlike Mailgun's
+// signatures, it has to be configured, because anyone could otherwise claim to be the person notified.
+func verifyMIMESecret(authorization string) bool {
+	secret := c.CurrentConfig().Integrations.InboundEmail.MIMESecret
+	if secret == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
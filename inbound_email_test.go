@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMIMEEmailReply = "From: Sir Lancelot <lancelot@camelot.example.com>\r\n" +
+	"To: Chicken Little <ack+6BA7B810-9DAD-11D1-80B4-00C04FD430C8@replies.example.com>\r\n" +
+	"Subject: Re: Chicken Little message received\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/html; charset=UTF-8\r\n" +
+	"\r\n" +
+	"<p>Ack</p>\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Ack=2C I'm on my way\r\n" +
+	"\r\n" +
+	"On Tue, Nov 3, 2015 at 10:00 AM, Chicken Little wrote:\r\n" +
+	"> The castle is on fire\r\n" +
+	"--b1--\r\n"
+
+func TestParseMIMEEmail(t *testing.T) {
+	m, err := mail.ReadMessage(strings.NewReader(testMIMEEmailReply))
+	if err != nil {
+		t.Fatalf("Could not read test message: %s", err)
+	}
+
+	e, err := parseMIMEEmail(m)
+	if err != nil {
+		t.Fatalf("parseMIMEEmail() failed: %s", err)
+	}
+
+	if id := emailReplyUUID(e); id != "6ba7b810-9dad-11d1-80b4-00c04fd430c8" {
+		t.Errorf("Unexpected UUID for reply: %q", id)
+	}
+
+	if text := replyText(e.Body); text != "Ack, I'm on my way\n" {
+		t.Errorf("Unexpected reply text: %q", text)
+	}
+}
+
+func TestMIMETextHTML(t *testing.T) {
+	// An HTML-only reply in base64, as some mail clients send
+	body := "<html><head><style>p { color: red; }</style></head><body><p>Ack &amp; on my way</p>" +
+		"<div>On Tue, Nov 3, 2015 at 10:00 AM, Chicken Little wrote:<br><blockquote><p>Reply with ack</p></blockquote></div></body></html>"
+	enc := base64.StdEncoding.EncodeToString([]byte(body))
+
+	msg := "From: lancelot@camelot.example.com\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		enc[:40] + "\r\n" + enc[40:] + "\r\n" +
+		"--b1--\r\n"
+
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("Could not read test message: %s", err)
+	}
+
+	e, err := parseMIMEEmail(m)
+	if err != nil {
+		t.Fatalf("parseMIMEEmail() failed: %s", err)
+	}
+
+	if text := strings.TrimSpace(replyText(e.Body)); text != "Ack & on my way" {
+		t.Errorf("Unexpected reply text: %q", text)
+	}
+}
+
+func TestReplyText(t *testing.T) {
+	tests := []struct {
+		body string
+		ack  bool
+	}{
+		{"ack", true},
+		{"ACK!", true},
+		{"Acknowledged, thanks", true},
+		{"Thanks\n\n> Reply with ack to stop notifications", false},
+		{"I'm looking at it\nOn Tuesday, Chicken Little wrote:\nack", false},
+		{"Hacking on it now", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := ackWordPattern.MatchString(replyText(tt.body)); got != tt.ack {
+			t.Errorf("Reply %q acknowledges = %v, expected %v", tt.body, got, tt.ack)
+		}
+	}
+}
+
+func TestInboundEmail(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	c.Config.Integrations.InboundEmail = InboundEmailConfig{Enabled: true, ReplyDomain: "replies.example.com", MIMESecret: "mime-secret"}
+	defer func() { c.Config.Integrations.InboundEmail = InboundEmailConfig{} }()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed: %s", w.Body)
+	}
+
+	// MIME: reply to the address in Reply-To
+	uuid := testMockNotify(t, "lancelot", testMockEmailNotificationPlanJson)
+	waitFor(t, "e-mail notification", func() bool { return len(mockProvider.SentEmails()) == 1 })
+
+	email := mockProvider.SentEmails()[0]
+	if email.ReplyTo != "ack+"+uuid+"@replies.example.com" || email.MessageID != "<"+uuid+"@replies.example.com>" {
+		t.Errorf("Unexpected reply headers: %q %q", email.ReplyTo, email.MessageID)
+	}
+	if !strings.Contains(email.Plain, `reply to this e-mail with "ack"`) {
+		t.Errorf("E-mail does not explain how to acknowledge by reply: %s", email.Plain)
+	}
+
+	// Raw MIME replies need the secret
+	w = httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://localhost/email/mime", strings.NewReader(testMIMEEmailReply))
+	r.Header.Set("Authorization", "Bearer wrong-secret")
+	callbackRouter().ServeHTTP(w, r)
+	if w.Code != 403 {
+		t.Errorf("Expected a MIME reply with the wrong secret to be refused, got %d", w.Code)
+	}
+
+	// Only the person being notified can acknowledge
+	err := mockProvider.ReplyEmail(email.ID, "mordred@camelot.example.com", "ack")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected a reply from someone else to be refused, got %v", err)
+	}
+
+	// A reply that doesn't say ack doesn't acknowledge, even though the quoted message does
+	err = mockProvider.ReplyEmail(email.ID, "lancelot@camelot.example.com", "What castle?")
+	if err != nil {
+		t.Fatalf("E-mail reply failed: %s", err)
+	}
+	if !notificationInProgress(uuid) {
+		t.Fatalf("Notification was acknowledged by a reply without ack in it")
+	}
+
+	err = mockProvider.ReplyEmail(email.ID, "Sir Lancelot <Lancelot@Camelot.example.com>", "Ack - on my way")
+	if err != nil {
+		t.Fatalf("E-mail reply failed: %s", err)
+	}
+	waitFor(t, "e-mail acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	// Mailgun: match on In-Reply-To and check the signature
+	c.Config.Integrations.InboundEmail.MailgunSigningKey = "key-secret"
+
+	uuid = testMockNotify(t, "lancelot", testMockEmailNotificationPlanJson)
+	waitFor(t, "e-mail notification", func() bool { return len(mockProvider.SentEmails()) == 2 })
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	form := url.Values{}
+	form.Set("timestamp", timestamp)
+	form.Set("token", "abcdef")
+	form.Set("from", "lancelot@camelot.example.com")
+	form.Set("recipient", "alerts@replies.example.com")
+	form.Set("In-Reply-To", "<"+uuid+"@replies.example.com>")
+	form.Set("stripped-text", "ACK")
+
+	post := func() int {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("POST", "http://localhost/email/mailgun", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("Failed to create new HTTP Request: %s", err)
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		callbackRouter().ServeHTTP(w, r)
+		return w.Code
+	}
+	sign := func(timestamp, token string) string {
+		mac := hmac.New(sha256.New, []byte("key-secret"))
+		mac.Write([]byte(timestamp + token))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	form.Set("signature", "00")
+	if code := post(); code != 403 {
+		t.Errorf("Expected a bad Mailgun signature to be refused, got %d", code)
+	}
+
+	// A request that was captured a while ago can't be sent again
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	form.Set("timestamp", stale)
+	form.Set("signature", sign(stale, "abcdef"))
+	if code := post(); code != 403 {
+		t.Errorf("Expected a stale Mailgun signature to be refused, got %d", code)
+	}
+
+	form.Set("timestamp", timestamp)
+	form.Set("signature", sign(timestamp, "abcdef"))
+	if code := post(); code != 200 {
+		t.Errorf("Mailgun reply failed: %d", code)
+	}
+	if code := post(); code != 403 {
+		t.Errorf("Expected a replayed Mailgun request to be refused, got %d", code)
+	}
+	waitFor(t, "Mailgun acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	// Without a signing key, nothing from Mailgun is trusted
+	c.Config.Integrations.InboundEmail.MailgunSigningKey = ""
+	form.Set("token", "ghijkl")
+	form.Set("signature", sign(timestamp, "ghijkl"))
+	if code := post(); code != 403 {
+		t.Errorf("Expected a Mailgun reply without a signing key to be refused, got %d", code)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, from the most verbose to the least
+type LogLevel int
+
+const (
+	DebugLevel LogLevel = iota // 0
+	InfoLevel                  // 1
+	WarnLevel                  // 2
+	ErrorLevel                 // 3
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return "info"
+}
+
+func parseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "", "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("Unknown log level %q", s)
+}
+
+// Reports whether a log format is JSON, as opposed to logfmt
+func parseLogFormat(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "", "logfmt":
+		return false, nil
+	case "json":
+		return true, nil
+	}
+	return false, fmt.Errorf("Unknown log format %q", s)
+}
+
+// Logger writes leveled log lines in logfmt or JSON.  Every line carries the logger's fields, which are
+// alternating keys and values.  Phone numbers, addresses and message content should only be logged at
+// debug level.
+type Logger struct {
+	fields []interface{}
+}
+
+// Our root logger, without any fields
+var logger = &Logger{}
+
+// Where log lines go and which ones we keep, as set by configureLogging()
+var logSettings = struct {
+	level LogLevel
+	json  bool
+	out   io.Writer
+	file  *os.File // Set if we opened out ourselves
+	mu    sync.Mutex
+}{level: InfoLevel, out: os.Stderr}
+
+// Sets up logging as described by the config file.  By default we log at info level, in logfmt, to stderr.
+func configureLogging(lc LoggingConfig) error {
+	level, err := parseLogLevel(lc.Level)
+	if err != nil {
+		return err
+	}
+
+	asJSON, err := parseLogFormat(lc.Format)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer
+	var file *os.File
+	switch lc.Output {
+	case "", "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		file, err = os.OpenFile(lc.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("Could not open log file: %v", err)
+		}
+		out = file
+	}
+
+	logSettings.mu.Lock()
+	defer logSettings.mu.Unlock()
+
+	if logSettings.file != nil {
+		logSettings.file.Close()
+	}
+	logSettings.level, logSettings.json, logSettings.out, logSettings.file = level, asJSON, out, file
+
+	return nil
+}
+
+// Returns a logger that adds the given keys and values to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(DebugLevel, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(InfoLevel, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(WarnLevel, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(ErrorLevel, msg, kv)
+}
+
+// Logs at error level and exits
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(ErrorLevel, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level LogLevel, msg string, kv []interface{}) {
+	logSettings.mu.Lock()
+	defer logSettings.mu.Unlock()
+
+	if level < logSettings.level {
+		return
+	}
+
+	fields := append([]interface{}{"time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var b bytes.Buffer
+	if logSettings.json {
+		writeJSONLogLine(&b, fields)
+	} else {
+		writeLogfmtLine(&b, fields)
+	}
+	logSettings.out.Write(b.Bytes())
+}
+
+func writeLogfmtLine(b *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		v := fmt.Sprint(logValue(fields[i+1]))
+		if v == "" || strings.ContainsAny(v, " =\"\\\n\t") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(b, "%v=%v", fields[i], v)
+	}
+	b.WriteByte('\n')
+}
+
+func writeJSONLogLine(b *bytes.Buffer, fields []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(fmt.Sprint(fields[i]))
+		v, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+}
+
+// Converts values that don't print or marshal nicely on their own
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// Returns a logger for a notification-in-progress, with its uuid, username and the plan step and method it's
+// at.  Don't call this with NIP.Mu held.
+func notificationLogger(uuid string) *Logger {
+	if uuid == "" {
+		return logger
+	}
+
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	l := logger.With("uuid", uuid)
+
+	nr, exists := NIP.Requests[uuid]
+	if !exists {
+		return l
+	}
+	l = l.With("username", nr.Plan.Username)
+
+	if step := NIP.Steps[uuid]; step > 0 && step <= len(nr.Plan.Steps) {
+		l = l.With("step", step, "method", nr.Plan.Steps[step-1].schemes())
+	}
+
+	return l
+}
+
+// The scheme of a plan step's method (e.g. "sms"), which is safe to log without the address
+func methodScheme(method string) string {
+	if i := strings.Index(method, "://"); i >= 0 {
+		return method[:i]
+	}
+	return "unknown"
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends log lines to a buffer until the returned function is called
+func captureLogs(t *testing.T, lc LoggingConfig) (*bytes.Buffer, func()) {
+	err := configureLogging(lc)
+	if err != nil {
+		t.Fatalf("configureLogging() failed: %s", err)
+	}
+
+	var b bytes.Buffer
+	logSettings.mu.Lock()
+	logSettings.out = &b
+	logSettings.mu.Unlock()
+
+	return &b, func() {
+		configureLogging(LoggingConfig{})
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	b, restore := captureLogs(t, LoggingConfig{Level: "info"})
+	defer restore()
+
+	l := logger.With("uuid", "abc", "username", "lancelot")
+	l.Debug("Not logged", "content", "The castle is on fire")
+	l.Info("Snoozing notifications", "for", 15*time.Minute, "step", 2)
+	l.Error("Contact attempt failed", "err", errors.New(`bad "number"`))
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d: %s", len(lines), b)
+	}
+
+	re := regexp.MustCompile(`^time=\S+ level=info msg="Snoozing notifications" uuid=abc username=lancelot for=15m0s step=2$`)
+	if !re.MatchString(lines[0]) {
+		t.Errorf("Unexpected log line: %s", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], `level=error msg="Contact attempt failed" uuid=abc username=lancelot err="bad \"number\""`) {
+		t.Errorf("Unexpected log line: %s", lines[1])
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	b, restore := captureLogs(t, LoggingConfig{Level: "debug", Format: "json"})
+	defer restore()
+
+	logger.With("uuid", "abc").Debug("Plan step method", "step", 1, "err", errors.New("oops"))
+
+	var line map[string]interface{}
+	err := json.Unmarshal(b.Bytes(), &line)
+	if err != nil {
+		t.Fatalf("Log line is not JSON: %s", b)
+	}
+
+	if line["level"] != "debug" || line["msg"] != "Plan step method" || line["uuid"] != "abc" || line["step"] != 1.0 || line["err"] != "oops" {
+		t.Errorf("Unexpected log line: %s", b)
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer configureLogging(LoggingConfig{})
+
+	if err := configureLogging(LoggingConfig{Level: "loud"}); err == nil {
+		t.Errorf("Expected an unknown level to be refused")
+	}
+	if err := configureLogging(LoggingConfig{Format: "xml"}); err == nil {
+		t.Errorf("Expected an unknown format to be refused")
+	}
+
+	f, err := ioutil.TempFile(os.TempDir(), "chickenlittle-log-")
+	if err != nil {
+		t.Fatalf("Could not create log file: %s", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := configureLogging(LoggingConfig{Level: "warn", Output: f.Name()}); err != nil {
+		t.Fatalf("configureLogging() failed: %s", err)
+	}
+	logger.Info("Not logged")
+	logger.Warn("Logged")
+
+	out, _ := ioutil.ReadFile(f.Name())
+	if strings.Contains(string(out), "Not logged") || !strings.Contains(string(out), "msg=Logged") {
+		t.Errorf("Unexpected log file contents: %s", out)
+	}
+}
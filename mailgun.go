@@ -5,15 +5,29 @@ import (
 	"github.com/mailgun/mailgun-go"
 )
 
-// Sends a multipart text and HTML e-mail with a link to the click endpoint for stopping the notification
-func SendEmailMailgun(address, subject, plain, html string) {
-	from := fmt.Sprint("Chicken Little <chickenlittle@", c.Config.Integrations.Mailgun.Hostname, ">")
+// Sends a multipart text and HTML e-mail (or just text, if there's no HTML) with a link to the click endpoint for stopping the notification.
+// replyTo and messageID are only set if replies can acknowledge the notification.
+func SendEmailMailgun(mc Mailgun, address, subject, plain, html, replyTo, messageID string) error {
+	from := fmt.Sprint("Chicken Little <chickenlittle@", mc.Hostname, ">")
 
-	mg := mailgun.NewMailgun(c.Config.Integrations.Mailgun.Hostname, c.Config.Integrations.Mailgun.APIKey, "")
+	mg := mailgun.NewMailgun(mc.Hostname, mc.APIKey, "")
 
 	m := mg.NewMessage(from, subject, plain)
-	m.SetHtml(html)
+	if html != "" {
+		m.SetHtml(html)
+	}
 	m.AddRecipient(address)
 
-	mg.Send(m)
+	if replyTo != "" {
+		m.AddHeader("Reply-To", replyTo)
+		m.AddHeader("Message-Id", messageID)
+	}
+
+	_, _, err := mg.Send(m)
+	if err != nil {
+		metrics.ProviderErrors.Inc("mailgun", "send")
+		return fmt.Errorf("Mailgun send failed: %v", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+)
+
+// Added to the content of a notification that was held back by a maintenance window and delivered afterwards
+const maintenanceNote = "[after maintenance] "
+
+// MaintenanceWindow suppresses the notifications that match it while it's open.  A window with no people or teams
+// applies to everyone, and one without a content pattern applies to any content.
+type MaintenanceWindow struct {
+	Name           string    `json:"name"`
+	Description    string    `json:"description,omitempty"`
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	People         []string  `json:"people,omitempty"`          // Usernames
+	Teams          []string  `json:"teams,omitempty"`           // Everyone in these teams
+	ContentPattern string    `json:"content_pattern,omitempty"` // A regular expression that the content must match
+	Deliver        bool      `json:"deliver,omitempty"`         // Deliver suppressed notifications once the window ends, unless they've been resolved
+}
+
+// SuppressedNotification is a notification that was held back by a maintenance window, to be delivered when
+// the window ends
+type SuppressedNotification struct {
+	UUID     string `json:"uuid"`
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	ContentFields
+	Window   string    `json:"window"`
+	Received time.Time `json:"received"`
+
+	FallbackFor string `json:"fallback_for,omitempty"`
+	Group       string `json:"group,omitempty"`
+}
+
+// Serializes deliveries of suppressed notifications, so that each is only delivered or resolved once
+var suppressedMu sync.Mutex
+
+// Compiled content patterns by window name, so that a pattern is compiled once rather than for every notification
+var contentPatterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+func (mw *MaintenanceWindow) Marshal() ([]byte, error) {
+	jmw, err := json.Marshal(mw)
+	return jmw, err
+}
+
+func (mw *MaintenanceWindow) Unmarshal(jmw string) error {
+	err := json.Unmarshal([]byte(jmw), mw)
+	return err
+}
+
+func (sn *SuppressedNotification) Marshal() ([]byte, error) {
+	jsn, err := json.Marshal(sn)
+	return jsn, err
+}
+
+func (sn *SuppressedNotification) Unmarshal(jsn string) error {
+	err := json.Unmarshal([]byte(jsn), sn)
+	return err
+}
+
+// Make sure that a window has a name and a sensible period, and that everyone and everything it targets exists
+func (mw *MaintenanceWindow) Validate() error {
+	if mw.Name == "" {
+		return fmt.Errorf("Must provide a name")
+	}
+
+	if mw.Start.IsZero() || mw.End.IsZero() {
+		return fmt.Errorf("Must provide a start and an end")
+	}
+
+	if !mw.End.After(mw.Start) {
+		return fmt.Errorf("end must be after start")
+	}
+
+	for _, u := range mw.People {
+		if _, err := c.GetPerson(u); err != nil {
+			return fmt.Errorf("User %v does not exist", u)
+		}
+	}
+
+	for _, t := range mw.Teams {
+		if _, err := c.GetTeam(t); err != nil {
+			return fmt.Errorf("Team %v does not exist", t)
+		}
+	}
+
+	if _, err := mw.contentRegexp(); err != nil {
+		return fmt.Errorf("content_pattern is not a valid regular expression: %v", err)
+	}
+
+	return nil
+}
+
+// The window's content pattern, compiled, or nil if it doesn't have one
+func (mw *MaintenanceWindow) contentRegexp() (*regexp.Regexp, error) {
+	if mw.ContentPattern == "" {
+		return nil, nil
+	}
+
+	contentPatterns.Lock()
+	defer contentPatterns.Unlock()
+
+	// The window's pattern may have changed since we compiled it
+	if re, exists := contentPatterns.compiled[mw.Name]; exists && re.String() == mw.ContentPattern {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(mw.ContentPattern)
+	if err != nil {
+		return nil, err
+	}
+	contentPatterns.compiled[mw.Name] = re
+
+	return re, nil
+}
+
+// Reports whether a window is open at t
+func (mw *MaintenanceWindow) OpenAt(t time.Time) bool {
+	return !t.Before(mw.Start) && t.Before(mw.End)
+}
+
+// Reports whether a notification for a person with the given content falls under a window, whether or not
+// it's open
+func (mw *MaintenanceWindow) Matches(username, content string) bool {
+	re, err := mw.contentRegexp()
+	if err != nil || (re != nil && !re.MatchString(content)) {
+		return false
+	}
+
+	if len(mw.People) == 0 && len(mw.Teams) == 0 {
+		return true
+	}
+
+	for _, u := range mw.People {
+		if u == username {
+			return true
+		}
+	}
+
+	for _, name := range mw.Teams {
+		t, err := c.GetTeam(name)
+		if err != nil {
+			continue
+		}
+		for _, m := range t.Members {
+			if m == username {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Fetch a MaintenanceWindow from the DB
+func (c *ChickenLittle) GetMaintenanceWindow(name string) (*MaintenanceWindow, error) {
+	jmw, err := c.DB.Fetch("maintenancewindows", name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch maintenance window %v from DB", name)
+	}
+
+	mw := &MaintenanceWindow{}
+
+	err = mw.Unmarshal(jmw)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal maintenance window from DB.  Err: %v  JSON: %v", err, jmw)
+	}
+
+	return mw, nil
+}
+
+// Fetch every MaintenanceWindow from the DB
+func (c *ChickenLittle) GetAllMaintenanceWindows() ([]*MaintenanceWindow, error) {
+	var windows []*MaintenanceWindow
+
+	jmws, err := c.DB.FetchAll("maintenancewindows")
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch all maintenance windows from DB")
+	}
+
+	for _, jmw := range jmws {
+		mw := &MaintenanceWindow{}
+
+		err = mw.Unmarshal(jmw)
+		if err != nil {
+			return nil, fmt.Errorf("Could not unmarshal maintenance window from DB.  Err: %v  JSON: %v", err, jmw)
+		}
+
+		windows = append(windows, mw)
+	}
+
+	return windows, nil
+}
+
+// Store a MaintenanceWindow in the DB
+func (c *ChickenLittle) StoreMaintenanceWindow(mw *MaintenanceWindow) error {
+	jmw, err := mw.Marshal()
+	if err != nil {
+		return fmt.Errorf("Could not marshal maintenance window %+v", mw)
+	}
+
+	err = c.DB.Store("maintenancewindows", mw.Name, string(jmw))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete a MaintenanceWindow from the DB
+func (c *ChickenLittle) DeleteMaintenanceWindow(name string) error {
+	err := c.DB.Delete("maintenancewindows", name)
+	if err != nil {
+		return err
+	}
+
+	contentPatterns.Lock()
+	delete(contentPatterns.compiled, name)
+	contentPatterns.Unlock()
+
+	return nil
+}
+
+// Fetch a SuppressedNotification from the DB
+func (c *ChickenLittle) GetSuppressedNotification(id string) (*SuppressedNotification, error) {
+	jsn, err := c.DB.Fetch("suppressed", id)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch suppressed notification from DB: %v", err)
+	}
+
+	sn := &SuppressedNotification{}
+
+	err = sn.Unmarshal(jsn)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal suppressed notification from DB.  Err: %v  JSON: %v", err, jsn)
+	}
+
+	return sn, nil
+}
+
+// Fetch every SuppressedNotification from the DB
+func (c *ChickenLittle) GetAllSuppressedNotifications() ([]*SuppressedNotification, error) {
+	var sns []*SuppressedNotification
+
+	jsns, err := c.DB.FetchAll("suppressed")
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch all suppressed notifications from DB")
+	}
+
+	for _, jsn := range jsns {
+		sn := &SuppressedNotification{}
+
+		err = sn.Unmarshal(jsn)
+		if err != nil {
+			return nil, fmt.Errorf("Could not unmarshal suppressed notification from DB.  Err: %v  JSON: %v", err, jsn)
+		}
+
+		sns = append(sns, sn)
+	}
+
+	return sns, nil
+}
+
+// Store a SuppressedNotification in the DB
+func (c *ChickenLittle) StoreSuppressedNotification(sn *SuppressedNotification) error {
+	jsn, err := sn.Marshal()
+	if err != nil {
+		return fmt.Errorf("Could not marshal suppressed notification %+v", sn)
+	}
+
+	err = c.DB.Store("suppressed", sn.UUID, string(jsn))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete a SuppressedNotification from the DB
+func (c *ChickenLittle) DeleteSuppressedNotification(id string) error {
+	err := c.DB.Delete("suppressed", id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the open maintenance window that a notification for a person falls under, or nil if there isn't one.
+// If several match, the one that ends last is returned, so that anything it holds back outlasts them all.
+// Windows that have ended are cleared out along the way.
+func openMaintenanceWindow(username, content string) *MaintenanceWindow {
+	windows, err := c.GetAllMaintenanceWindows()
+	if err != nil {
+		return nil
+	}
+
+	// Matching means compiling patterns and fetching teams, so we only try the windows that could win
+	var found *MaintenanceWindow
+	var ended []*MaintenanceWindow
+	now := time.Now()
+	for _, mw := range windows {
+		switch {
+		case !now.Before(mw.End):
+			ended = append(ended, mw)
+		case !mw.OpenAt(now), found != nil && !mw.End.After(found.End):
+		case mw.Matches(username, content):
+			found = mw
+		}
+	}
+
+	pruneMaintenanceWindows(ended)
+
+	return found
+}
+
+// Deletes windows that have ended, unless they're still holding back notifications that haven't been delivered
+func pruneMaintenanceWindows(ended []*MaintenanceWindow) {
+	if len(ended) == 0 {
+		return
+	}
+
+	waiting := make(map[string]bool)
+	sns, _ := c.GetAllSuppressedNotifications()
+	for _, sn := range sns {
+		waiting[sn.Window] = true
+	}
+
+	for _, mw := range ended {
+		if waiting[mw.Name] {
+			continue
+		}
+
+		// It may have been extended since we fetched it
+		if current, err := c.GetMaintenanceWindow(mw.Name); err != nil || !current.End.Equal(mw.End) {
+			continue
+		}
+
+		logger.Info("Removing maintenance window that has ended", "window", mw.Name)
+		err := c.DeleteMaintenanceWindow(mw.Name)
+		if err != nil {
+			logger.Error("Could not delete maintenance window", "window", mw.Name, "err", err)
+		}
+	}
+}
+
+// Records a notification that a maintenance window suppressed, under the UUID it's already been given.  If the
+// window delivers what it suppresses, the notification is held until the window ends.  Otherwise it's over.
+func suppressNotification(mw *MaintenanceWindow, nr *NotificationRequest) error {
+	metrics.NotificationsSuppressed.Inc(SuppressedByMaintenance)
+
+	if mw.Deliver {
+		return c.StoreSuppressedNotification(&SuppressedNotification{
+			UUID:          nr.Plan.ID.String(),
+			Username:      nr.Plan.Username,
+			Content:       nr.Content,
+			ContentFields: nr.ContentFields,
+			Window:        mw.Name,
+			Received:      time.Now(),
+			FallbackFor:   nr.FallbackFor,
+			Group:         nr.Group,
+		})
+	}
+
+	now := time.Now()
+	return c.StoreNotificationRecord(&NotificationRecord{
+		UUID:          nr.Plan.ID.String(),
+		Username:      nr.Plan.Username,
+		Content:       nr.Content,
+		ContentFields: nr.ContentFields,
+		Outcome:       OutcomeSuppressed,
+		Started:       now,
+		Ended:         now,
+		FallbackFor:   nr.FallbackFor,
+		Group:         nr.Group,
+		Window:        mw.Name,
+	})
+}
+
+// Resolves a suppressed notification that's waiting for its window to end, so that it's never delivered.
+// Returns false if there's no such notification.
+func resolveSuppressed(id string) bool {
+	return endSuppressed(id, OutcomeResolved, "")
+}
+
+// Ends a suppressed notification that's waiting for its window to end with outcome, so that it's never
+// delivered.  Returns false if there's no such notification.
+func endSuppressed(id, outcome, takenBy string) bool {
+	suppressedMu.Lock()
+
+	sn, err := c.GetSuppressedNotification(id)
+	if err != nil {
+		suppressedMu.Unlock()
+		return false
+	}
+
+	err = c.DeleteSuppressedNotification(id)
+	if err != nil {
+		suppressedMu.Unlock()
+		logger.Error("Could not delete suppressed notification", "uuid", id, "err", err)
+		return false
+	}
+
+	sn.storeRecord(outcome, takenBy)
+	suppressedMu.Unlock()
+
+	// The last member of a group to finish completes it
+	if sn.Group != "" {
+		groupMemberEnded(sn.Group)
+	}
+
+	return true
+}
+
+// Keeps a record of a suppressed notification that won't be delivered
+func (sn *SuppressedNotification) storeRecord(outcome, takenBy string) {
+	err := c.StoreNotificationRecord(&NotificationRecord{
+		UUID:          sn.UUID,
+		Username:      sn.Username,
+		Content:       sn.Content,
+		ContentFields: sn.ContentFields,
+		Outcome:       outcome,
+		Started:       sn.Received,
+		Ended:         time.Now(),
+		FallbackFor:   sn.FallbackFor,
+		Group:         sn.Group,
+		TakenBy:       takenBy,
+		Window:        sn.Window,
+	})
+	if err != nil {
+		logger.Error("Could not store notification record", "uuid", sn.UUID, "err", err)
+	}
+}
+
+// Arranges for the notifications that a window holds back to be delivered when it ends
+func scheduleWindowEnd(mw *MaintenanceWindow) {
+	name := mw.Name
+	time.AfterFunc(time.Until(mw.End), func() { deliverSuppressed(name) })
+}
+
+// Delivers the notifications that a window held back, if it has ended.  Windows that have been extended since
+// are left alone, since they have a later delivery scheduled.  Notifications held back by a window that has been
+// deleted are delivered straight away.
+func deliverSuppressed(window string) {
+	if mw, err := c.GetMaintenanceWindow(window); err == nil && time.Now().Before(mw.End) {
+		return
+	}
+
+	sns, err := c.GetAllSuppressedNotifications()
+	if err != nil {
+		return
+	}
+
+	for _, sn := range sns {
+		if sn.Window == window {
+			deliverSuppressedNotification(sn.UUID)
+		}
+	}
+}
+
+// Sends a suppressed notification to the notification engine, with the UUID it was given when it was suppressed.
+// A group member's notification isn't delivered if the group was taken or timed out in the meantime.
+func deliverSuppressedNotification(id string) {
+	// It stays in the DB, to be delivered when we start up again
+	if draining() {
+		return
+	}
+
+	suppressedMu.Lock()
+
+	// It may have been resolved or delivered in the meantime
+	sn, err := c.GetSuppressedNotification(id)
+	if err != nil {
+		suppressedMu.Unlock()
+		return
+	}
+
+	// If we've started shutting down, it stays in the DB too
+	nr, outcome, takenBy := sn.request()
+	if nr != nil && !startNotification(nr) {
+		suppressedMu.Unlock()
+		return
+	}
+
+	err = c.DeleteSuppressedNotification(id)
+	if err != nil {
+		suppressedMu.Unlock()
+		logger.Error("Could not delete suppressed notification", "uuid", id, "err", err)
+		return
+	}
+
+	if nr != nil {
+		suppressedMu.Unlock()
+		return
+	}
+
+	sn.storeRecord(outcome, takenBy)
+	suppressedMu.Unlock()
+
+	if sn.Group != "" {
+		groupMemberEnded(sn.Group)
+	}
+}
+
+// Builds the request that delivers a suppressed notification.  If it can't or shouldn't be delivered, the request
+// is nil, and the outcome (and who took its group, if anyone did) say why.
+func (sn *SuppressedNotification) request() (*NotificationRequest, string, string) {
+	nlog := logger.With("uuid", sn.UUID, "username", sn.Username, "window", sn.Window)
+
+	if sn.Group != "" {
+		g, err := c.GetNotificationGroup(sn.Group)
+		switch {
+		case err != nil:
+		case g.Mode != GroupModeAll && g.AcknowledgedBy != "":
+			nlog.Info("Not delivering suppressed notification.  Its group was taken.", "group", sn.Group, "taken_by", g.AcknowledgedBy)
+			return nil, OutcomeTaken, g.AcknowledgedBy
+		case g.Deadline != nil && time.Now().After(*g.Deadline):
+			nlog.Info("Not delivering suppressed notification.  Its group timed out.", "group", sn.Group)
+			return nil, OutcomeUnacknowledged, ""
+		}
+	}
+
+	plan, err := c.GetNotificationPlan(sn.Username)
+	if err != nil {
+		nlog.Error("Could not deliver suppressed notification.  There's no notification plan.", "err", err)
+		return nil, OutcomeFailed, ""
+	}
+
+	plan.ID, err = uuid.Parse(sn.UUID)
+	if err != nil {
+		nlog.Error("Could not deliver suppressed notification", "err", err)
+		return nil, OutcomeFailed, ""
+	}
+
+	p, err := c.GetPerson(sn.Username)
+	if err != nil {
+		nlog.Warn("Could not fetch person for notification", "err", err)
+		p = &Person{Username: sn.Username}
+	}
+
+	nlog.Info("Maintenance window is over.  Delivering suppressed notification.")
+
+	nr := &NotificationRequest{
+		Content:       sn.Content,
+		ContentFields: sn.ContentFields,
+		Plan:          plan,
+		Person:        p,
+		FallbackFor:   sn.FallbackFor,
+		Group:         sn.Group,
+		Window:        sn.Window,
+	}
+	addContentNote(nr, maintenanceNote)
+
+	return nr, "", ""
+}
+
+// Schedules the delivery of everything that maintenance windows are holding back.  Anything held back by a
+// window that ended or was deleted while we were down is delivered now.  The notification engine must be running.
+func resumeMaintenanceWindows() {
+	sns, err := c.GetAllSuppressedNotifications()
+	if err != nil {
+		// There's nothing waiting
+		return
+	}
+
+	scheduled := make(map[string]bool)
+	for _, sn := range sns {
+		if scheduled[sn.Window] {
+			continue
+		}
+		scheduled[sn.Window] = true
+
+		mw, err := c.GetMaintenanceWindow(sn.Window)
+		if err != nil || !time.Now().Before(mw.End) {
+			deliverSuppressed(sn.Window)
+			continue
+		}
+
+		scheduleWindowEnd(mw)
+	}
+}
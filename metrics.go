@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Our Prometheus metrics.  Gauges are read from the NIP store when /metrics is scraped.
+var metrics = struct {
+	NotificationsStarted    *metricVec
+	NotificationsEnded      *metricVec
+	ContactAttempts         *metricVec
+	Acknowledgements        *metricVec
+	NotificationsSuppressed *metricVec
+	ThrottleSummaries       *metricVec
+	ProviderErrors          *metricVec
+	TimeToAcknowledge       *histogramVec
+}{
+	NotificationsStarted:    newMetricVec("chickenlittle_notifications_started_total", "Notifications started", "counter"),
+	NotificationsEnded:      newMetricVec("chickenlittle_notifications_ended_total", "Notifications ended, by outcome", "counter", "outcome"),
+	ContactAttempts:         newMetricVec("chickenlittle_contact_attempts_total", "Attempts to contact a person, by method and outcome", "counter", "method", "outcome"),
+	Acknowledgements:        newMetricVec("chickenlittle_acknowledgements_total", "Notifications acknowledged or stopped, by channel", "counter", "channel"),
+	NotificationsSuppressed: newMetricVec("chickenlittle_notifications_suppressed_total", "Notifications that weren't delivered when they were requested, by reason", "counter", "reason"),
+	ThrottleSummaries:       newMetricVec("chickenlittle_throttle_summaries_total", "Summaries sent for notifications that were over a rate limit", "counter"),
+	ProviderErrors:          newMetricVec("chickenlittle_provider_errors_total", "Failed requests to Twilio, Mailgun and SMTP servers, by kind of failure", "counter", "provider", "kind"),
+	TimeToAcknowledge: newHistogramVec("chickenlittle_time_to_acknowledge_seconds", "Time from the start of a notification to its acknowledgement",
+		[]float64{30, 60, 120, 300, 600, 900, 1800, 3600, 7200, 14400}, "username", "team"),
+}
+
+// The channels that a notification can be acknowledged through
+const (
+	AckChannelSMS        = "sms"
+	AckChannelPhone      = "phone"
+	AckChannelEmailClick = "email_click"
+	AckChannelEmailReply = "email_reply"
+	AckChannelAPI        = "api"
+)
+
+// The reasons that a notification can be suppressed
+const (
+	SuppressedByMaintenance = "maintenance"
+	SuppressedByPersonLimit = "per_person_limit"
+	SuppressedByGlobalLimit = "global_limit"
+)
+
+// A counter or gauge, partitioned by labels
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]float64 // Keyed by the label values, joined with \xff
+	mu     sync.Mutex
+}
+
+func newMetricVec(name, help, kind string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+}
+
+// Adds v to the metric with the given label values
+func (m *metricVec) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[strings.Join(labelValues, "\xff")] += v
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// The current value of the metric with the given label values
+func (m *metricVec) Value(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.values[strings.Join(labelValues, "\xff")]
+}
+
+func (m *metricVec) write(b *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %v %v\n# TYPE %v %v\n", m.name, m.help, m.name, m.kind)
+
+	// A metric without labels is always reported, even before it's been touched
+	if len(m.labels) == 0 {
+		fmt.Fprintf(b, "%v %v\n", m.name, formatMetricValue(m.values[""]))
+		return
+	}
+
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(b, "%v%v %v\n", m.name, formatLabels(m.labels, strings.Split(key, "\xff")), formatMetricValue(m.values[key]))
+	}
+}
+
+// A histogram, partitioned by labels
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	series  map[string]*histogram
+	mu      sync.Mutex
+}
+
+type histogram struct {
+	counts []uint64 // Observations in each bucket.  These are not cumulative; write() adds them up.
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, series: make(map[string]*histogram)}
+}
+
+// Records an observation in the histogram with the given label values
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	s, exists := h.series[key]
+	if !exists {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// The number of observations in the histogram with the given label values
+func (h *histogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, exists := h.series[strings.Join(labelValues, "\xff")]; exists {
+		return s.count
+	}
+	return 0
+}
+
+func (h *histogramVec) write(b *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		labelValues := strings.Split(key, "\xff")
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%v_bucket%v %v\n", h.name, formatLabels(append(h.labels, "le"), append(labelValues, formatMetricValue(upper))), cumulative)
+		}
+		fmt.Fprintf(b, "%v_bucket%v %v\n", h.name, formatLabels(append(h.labels, "le"), append(labelValues, "+Inf")), s.count)
+		fmt.Fprintf(b, "%v_sum%v %v\n", h.name, formatLabels(h.labels, labelValues), formatMetricValue(s.sum))
+		fmt.Fprintf(b, "%v_count%v %v\n", h.name, formatLabels(h.labels, labelValues), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%v="%v"`, name, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counts an attempt to contact someone for a notification
+func recordContactAttempt(method string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	metrics.ContactAttempts.Inc(method, outcome)
+}
+
+// Counts an acknowledgement and how long it took since the notification was started or re-triggered.  Must be
+// called before the notification is stopped.  Resolving a notification that was already acknowledged doesn't
+// count towards the time to acknowledge.  Notifications sent to a team are labelled with it.
+func recordAcknowledgement(uuid, channel string) {
+	metrics.Acknowledgements.Inc(channel)
+
+	NIP.Mu.Lock()
+	s, exists := NIP.Status[uuid]
+	nr := NIP.Requests[uuid]
+	if !exists || nr == nil || s.Triggered.IsZero() || s.State == StateAcknowledged {
+		NIP.Mu.Unlock()
+		return
+	}
+	elapsed := time.Since(s.Triggered)
+	username, group := nr.Plan.Username, nr.Group
+	NIP.Mu.Unlock()
+
+	metrics.TimeToAcknowledge.Observe(elapsed.Seconds(), username, groupTeam(group))
+}
+
+// The team that a group was notified through, or "" for a notification that isn't part of a team's group
+func groupTeam(id string) string {
+	if id == "" {
+		return ""
+	}
+
+	g, err := c.GetNotificationGroup(id)
+	if err != nil {
+		logger.Debug("Could not fetch notification group for metrics", "group", id, "err", err)
+		return ""
+	}
+
+	return g.Team
+}
+
+// Serves our metrics in the Prometheus text format
+func ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+
+	metrics.NotificationsStarted.write(&b)
+	metrics.NotificationsEnded.write(&b)
+	metrics.ContactAttempts.write(&b)
+	metrics.Acknowledgements.write(&b)
+	metrics.NotificationsSuppressed.write(&b)
+	metrics.ThrottleSummaries.write(&b)
+	metrics.ProviderErrors.write(&b)
+	metrics.TimeToAcknowledge.write(&b)
+
+	NIP.Mu.Lock()
+	active := len(NIP.Stoppers)
+	conversations := len(NIP.Conversations)
+	NIP.Mu.Unlock()
+
+	fmt.Fprintf(&b, "# HELP chickenlittle_notifications_in_progress Notifications that have not been acknowledged or stopped\n")
+	fmt.Fprintf(&b, "# TYPE chickenlittle_notifications_in_progress gauge\nchickenlittle_notifications_in_progress %v\n", active)
+	fmt.Fprintf(&b, "# HELP chickenlittle_sms_conversations SMS acknowledgement codes that are awaiting a reply\n")
+	fmt.Fprintf(&b, "# TYPE chickenlittle_sms_conversations gauge\nchickenlittle_sms_conversations %v\n", conversations)
+	fmt.Fprintf(&b, "# HELP chickenlittle_throttled_pending Notifications over a rate limit that are waiting for their summary\n")
+	fmt.Fprintf(&b, "# TYPE chickenlittle_throttled_pending gauge\nchickenlittle_throttled_pending %v\n", limiter.pending())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
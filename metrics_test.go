@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := newMetricVec("test_total", "A test counter", "counter", "method", "outcome")
+	m.Inc("sms", "success")
+	m.Inc("sms", "success")
+	m.Inc("phone", `say "error"`)
+
+	h := newHistogramVec("test_seconds", "A test histogram", []float64{1, 10}, "username")
+	h.Observe(0.5, "lancelot")
+	h.Observe(5, "lancelot")
+	h.Observe(50, "lancelot")
+
+	var b bytes.Buffer
+	m.write(&b)
+	h.write(&b)
+
+	expected := `# HELP test_total A test counter
+# TYPE test_total counter
+test_total{method="phone",outcome="say \"error\""} 1
+test_total{method="sms",outcome="success"} 2
+# HELP test_seconds A test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{username="lancelot",le="1"} 1
+test_seconds_bucket{username="lancelot",le="10"} 2
+test_seconds_bucket{username="lancelot",le="+Inf"} 3
+test_seconds_sum{username="lancelot"} 55.5
+test_seconds_count{username="lancelot"} 3
+`
+	if b.String() != expected {
+		t.Errorf("Unexpected exposition.\nGot:\n%s\nExpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed: %s", w.Body)
+	}
+
+	// The metrics are shared with the other tests, so we only look at how they change
+	started := metrics.NotificationsStarted.Value()
+	attempts := metrics.ContactAttempts.Value("email", "success")
+	clicks := metrics.Acknowledgements.Value(AckChannelEmailClick)
+	acks := metrics.TimeToAcknowledge.Count("lancelot", "")
+
+	uuid := testMockNotify(t, "lancelot", testMockEmailNotificationPlanJson)
+	waitFor(t, "e-mail notification", func() bool { return len(mockProvider.SentEmails()) == 1 })
+
+	w = testAPIRequest(t, "GET", "http://localhost/metrics", "")
+	if w.Code != 200 {
+		t.Fatalf("Metrics request failed: %s", w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "chickenlittle_notifications_in_progress ") {
+		t.Errorf("Metrics are missing the notifications in progress gauge: %s", w.Body)
+	}
+
+	err := mockProvider.ClickStopLink(mockProvider.SentEmails()[0].ID)
+	if err != nil {
+		t.Fatalf("Clicking stop link failed: %s", err)
+	}
+	waitFor(t, "e-mail acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	if got := metrics.NotificationsStarted.Value() - started; got != 1 {
+		t.Errorf("Expected 1 notification started, got %v", got)
+	}
+	if got := metrics.ContactAttempts.Value("email", "success") - attempts; got != 1 {
+		t.Errorf("Expected 1 successful e-mail attempt, got %v", got)
+	}
+	if got := metrics.Acknowledgements.Value(AckChannelEmailClick) - clicks; got != 1 {
+		t.Errorf("Expected 1 acknowledgement by e-mail click, got %v", got)
+	}
+	if got := metrics.TimeToAcknowledge.Count("lancelot", "") - acks; got != 1 {
+		t.Errorf("Expected 1 time-to-acknowledge observation, got %v", got)
+	}
+
+	// Notifying a team labels the time to acknowledge with it
+	w = testAPIRequest(t, "POST", "http://localhost/teams", `{"name": "knights", "members": ["lancelot"]}`)
+	if w.Code != 200 {
+		t.Fatalf("CreateTeam request failed: %s", w.Body)
+	}
+	teamAcks := metrics.TimeToAcknowledge.Count("lancelot", "knights")
+
+	w = testAPIRequest(t, "POST", "http://localhost/notify", `{"content": "The castle is on fire", "team": "knights"}`)
+	if w.Code != 200 {
+		t.Fatalf("NotifyGroup request failed: %s", w.Body)
+	}
+	var res NotificationGroupResponse
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if len(res.Members) != 1 {
+		t.Fatalf("Expected 1 member, got %+v", res.Members)
+	}
+	waitFor(t, "e-mail notification", func() bool { return len(mockProvider.SentEmails()) == 2 })
+
+	err = mockProvider.ClickStopLink(mockProvider.SentEmails()[1].ID)
+	if err != nil {
+		t.Fatalf("Clicking stop link failed: %s", err)
+	}
+	waitFor(t, "e-mail acknowledgement", func() bool { return !notificationInProgress(res.Members[0].UUID) })
+
+	if got := metrics.TimeToAcknowledge.Count("lancelot", "knights") - teamAcks; got != 1 {
+		t.Errorf("Expected 1 time-to-acknowledge observation for the team, got %v", got)
+	}
+	if got := metrics.TimeToAcknowledge.Count("lancelot", "") - acks; got != 1 {
+		t.Errorf("Expected the team's acknowledgement to be kept apart, got %v", got)
+	}
+
+	w = testAPIRequest(t, "GET", "http://localhost/metrics", "")
+	for _, series := range []string{`{username="lancelot",team=""}`, `{username="lancelot",team="knights"}`} {
+		if !strings.Contains(w.Body.String(), `chickenlittle_time_to_acknowledge_seconds_count`+series) {
+			t.Errorf("Metrics are missing the time-to-acknowledge histogram for %v: %s", series, w.Body)
+		}
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	mockProvider MockProvider
+)
+
+// MockProvider stands in for Twilio and our e-mail providers when the mock integration is enabled.
+// Outbound SMS, phone calls and e-mails are recorded in memory instead of being delivered, and
+// the recipient's side of the conversation (SMS replies, digit presses, clicks and status
+// callbacks) can be simulated against our own callback endpoints.
+type MockProvider struct {
+	SMS    []MockSMS   `json:"sms"`
+	Calls  []MockCall  `json:"calls"`
+	Emails []MockEmail `json:"emails"`
+	serial int
+	mu     sync.Mutex
+}
+
+type MockSMS struct {
+	Sid            string    `json:"sid"`
+	To             string    `json:"to"`
+	From           string    `json:"from"`
+	Body           string    `json:"body"`
+	StatusCallback string    `json:"status_callback,omitempty"`
+	Sent           time.Time `json:"sent"`
+}
+
+type MockCall struct {
+	Sid            string    `json:"sid"`
+	To             string    `json:"to"`
+	From           string    `json:"from"`
+	Url            string    `json:"url"`
+	StatusCallback string    `json:"status_callback,omitempty"`
+	Redirects      []string  `json:"redirects,omitempty"`
+	Placed         time.Time `json:"placed"`
+}
+
+type MockEmail struct {
+	ID        string    `json:"id"`
+	To        string    `json:"to"`
+	Subject   string    `json:"subject"`
+	Plain     string    `json:"plain"`
+	HTML      string    `json:"html"`
+	StopURL   string    `json:"stop_url"`
+	ReplyTo   string    `json:"reply_to,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Sent      time.Time `json:"sent"`
+}
+
+// Just enough TwiML to find out where a call sends the digits that were pressed, or where it goes next
+type mockTwiML struct {
+	Gather []struct {
+		Action string `xml:"action,attr"`
+	} `xml:"Gather"`
+	Redirect []string `xml:"Redirect"`
+}
+
+// Returns a copy of every SMS sent so far
+func (m *MockProvider) SentSMS() []MockSMS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MockSMS(nil), m.SMS...)
+}
+
+// Returns a copy of every phone call placed so far
+func (m *MockProvider) PlacedCalls() []MockCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MockCall(nil), m.Calls...)
+}
+
+// Returns a copy of every e-mail sent so far
+func (m *MockProvider) SentEmails() []MockEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MockEmail(nil), m.Emails...)
+}
+
+// Forget everything that's been recorded
+func (m *MockProvider) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.SMS = nil
+	m.Calls = nil
+	m.Emails = nil
+}
+
+// Records an e-mail in place of sending it through Mailgun or SMTP
+func (m *MockProvider) RecordEmail(address, subject, plain, html, uuid, replyTo, messageID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.serial++
+	e := MockEmail{
+		ID:        fmt.Sprintf("EM%032d", m.serial),
+		To:        address,
+		Subject:   subject,
+		Plain:     plain,
+		HTML:      html,
+		ReplyTo:   replyTo,
+		MessageID: messageID,
+		Sent:      time.Now(),
+	}
+	if uuid != "" {
+		e.StopURL = fmt.Sprint(c.CurrentConfig().Service.ClickURLBase, "/", uuid, "/stop")
+	}
+
+	m.Emails = append(m.Emails, e)
+}
+
+// Simulates the person texting body back to us from the phone number from
+func (m *MockProvider) ReplySMS(from, body string) error {
+	u := url.Values{}
+	u.Set("From", from)
+	cfg := c.CurrentConfig()
+	u.Set("To", cfg.Integrations.Twilio.CallFromNumber)
+	u.Set("Body", body)
+
+	return mockCallback(fmt.Sprint(cfg.Service.CallbackURLBase, "/sms"), u)
+}
+
+// Simulates the person answering the call with the given Sid and pressing digits each time
+// they're prompted.  Each press is sent to the Gather that the call's TwiML is waiting on,
+// following any Redirects along the way.
+func (m *MockProvider) PressDigits(sid string, presses ...string) error {
+	call, err := m.findCall(sid)
+	if err != nil {
+		return err
+	}
+
+	u := url.Values{}
+	u.Set("CallSid", call.Sid)
+	u.Set("From", call.From)
+	u.Set("To", call.To)
+
+	// Answer the call by fetching its TwiML, just like Twilio would
+	b, err := mockCallbackBody(call.Url, u)
+	if err != nil {
+		return err
+	}
+
+	for _, digits := range presses {
+		action, err := mockGatherAction(sid, b, u)
+		if err != nil {
+			return err
+		}
+
+		form := url.Values{}
+		for k, v := range u {
+			form[k] = v
+		}
+		form.Set("Digits", digits)
+
+		b, err = mockCallbackBody(action, form)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Finds the action of the Gather that a call's TwiML is waiting on, following Redirects to get there
+func mockGatherAction(sid string, b []byte, u url.Values) (string, error) {
+	// Don't chase a redirect loop forever
+	for i := 0; i < 10; i++ {
+		var t mockTwiML
+
+		if len(bytes.TrimSpace(b)) == 0 {
+			return "", fmt.Errorf("Call %v has no more TwiML to prompt for digits", sid)
+		}
+
+		err := xml.Unmarshal(b, &t)
+		if err != nil {
+			return "", fmt.Errorf("Could not parse TwiML for call %v: %v", sid, err)
+		}
+
+		if len(t.Gather) > 0 && t.Gather[0].Action != "" {
+			return t.Gather[0].Action, nil
+		}
+
+		if len(t.Redirect) == 0 {
+			return "", fmt.Errorf("Call %v does not prompt for digits", sid)
+		}
+
+		b, err = mockCallbackBody(t.Redirect[0], u)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("Call %v redirected too many times", sid)
+}
+
+// Simulates a delivery status callback for the SMS or call with the given Sid
+func (m *MockProvider) SendStatus(sid, status string) error {
+	u := url.Values{}
+
+	if sms, err := m.findSMS(sid); err == nil {
+		if sms.StatusCallback == "" {
+			return fmt.Errorf("SMS %v did not request status callbacks", sid)
+		}
+		u.Set("MessageSid", sms.Sid)
+		u.Set("MessageStatus", status)
+		return mockCallback(sms.StatusCallback, u)
+	}
+
+	call, err := m.findCall(sid)
+	if err != nil {
+		return err
+	}
+	if call.StatusCallback == "" {
+		return fmt.Errorf("Call %v did not request status callbacks", sid)
+	}
+	u.Set("CallSid", call.Sid)
+	u.Set("CallStatus", status)
+	return mockCallback(call.StatusCallback, u)
+}
+
+// Simulates the person clicking the stop link in the e-mail with the given ID
+func (m *MockProvider) ClickStopLink(id string) error {
+	e, err := m.findEmail(id)
+	if err != nil {
+		return err
+	}
+	if e.StopURL == "" {
+		return fmt.Errorf("E-mail %v has no stop link", id)
+	}
+
+	resp, err := http.Get(e.StopURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Stop link for e-mail %v returned %v", id, resp.Status)
+	}
+
+	return nil
+}
+
+// Simulates the person replying to the e-mail with the given ID from the address from.  The reply
+// is delivered to our inbound e-mail endpoint as a MIME message.
+func (m *MockProvider) ReplyEmail(id, from, body string) error {
+	e, err := m.findEmail(id)
+	if err != nil {
+		return err
+	}
+	if e.ReplyTo == "" {
+		return fmt.Errorf("E-mail %v does not accept replies", id)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", from)
+	fmt.Fprintf(&msg, "To: %v\r\n", e.ReplyTo)
+	fmt.Fprintf(&msg, "Subject: Re: %v\r\n", e.Subject)
+	fmt.Fprintf(&msg, "In-Reply-To: %v\r\n", e.MessageID)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%v\r\n\r\n", body)
+	for _, line := range strings.Split(e.Plain, "\n") {
+		fmt.Fprintf(&msg, "> %v\r\n", line)
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprint(c.CurrentConfig().Service.CallbackURLBase, "/email/mime"), &msg)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	req.Header.Set("Authorization", "Bearer "+c.CurrentConfig().Integrations.InboundEmail.MIMESecret)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Reply to e-mail %v returned %v", id, resp.Status)
+	}
+
+	return nil
+}
+
+func (m *MockProvider) findSMS(sid string) (MockSMS, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.SMS {
+		if s.Sid == sid {
+			return s, nil
+		}
+	}
+
+	return MockSMS{}, fmt.Errorf("SMS %v not found", sid)
+}
+
+func (m *MockProvider) findEmail(id string) (MockEmail, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.Emails {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+
+	return MockEmail{}, fmt.Errorf("E-mail %v not found", id)
+}
+
+func (m *MockProvider) findCall(sid string) (MockCall, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, call := range m.Calls {
+		if call.Sid == sid {
+			return call, nil
+		}
+	}
+
+	return MockCall{}, fmt.Errorf("Call %v not found", sid)
+}
+
+// POSTs a form to one of our callback endpoints, the way Twilio would
+func mockCallback(callbackURL string, form url.Values) error {
+	_, err := mockCallbackBody(callbackURL, form)
+	return err
+}
+
+// POSTs a form to one of our callback endpoints and returns the body of the response
+func mockCallbackBody(callbackURL string, form url.Values) ([]byte, error) {
+	resp, err := http.PostForm(callbackURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return b, fmt.Errorf("Callback to %v returned %v", callbackURL, resp.Status)
+	}
+
+	return b, nil
+}
+
+// Handles POST /2010-04-01/Accounts/{account}/Messages.json
+func MockSendSMS(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	mockProvider.mu.Lock()
+	mockProvider.serial++
+	sms := MockSMS{
+		Sid:            fmt.Sprintf("SM%032d", mockProvider.serial),
+		To:             r.FormValue("To"),
+		From:           r.FormValue("From"),
+		Body:           r.FormValue("Body"),
+		StatusCallback: r.FormValue("StatusCallback"),
+		Sent:           time.Now(),
+	}
+	mockProvider.SMS = append(mockProvider.SMS, sms)
+	mockProvider.mu.Unlock()
+
+	logger.Info("Mock: recorded SMS", "sid", sms.Sid)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(SMSResponse{
+		Sid:        sms.Sid,
+		AccountSid: mux.Vars(r)["account"],
+		To:         sms.To,
+		From:       sms.From,
+		Body:       sms.Body,
+		Status:     "queued",
+		Direction:  "outbound-api",
+	})
+}
+
+// Handles POST /2010-04-01/Accounts/{account}/Calls.json
+func MockMakePhoneCall(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	mockProvider.mu.Lock()
+	mockProvider.serial++
+	call := MockCall{
+		Sid:            fmt.Sprintf("CA%032d", mockProvider.serial),
+		To:             r.FormValue("To"),
+		From:           r.FormValue("From"),
+		Url:            r.FormValue("Url"),
+		StatusCallback: r.FormValue("StatusCallback"),
+		Placed:         time.Now(),
+	}
+	mockProvider.Calls = append(mockProvider.Calls, call)
+	mockProvider.mu.Unlock()
+
+	logger.Info("Mock: recorded call", "sid", call.Sid)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"sid":         call.Sid,
+		"account_sid": mux.Vars(r)["account"],
+		"to":          call.To,
+		"from":        call.From,
+		"status":      "queued",
+	})
+}
+
+// Handles POST /2010-04-01/Accounts/{account}/Calls/{sid}, which redirects a call in progress
+func MockUpdatePhoneCall(w http.ResponseWriter, r *http.Request) {
+	sid := mux.Vars(r)["sid"]
+
+	r.ParseForm()
+
+	mockProvider.mu.Lock()
+	defer mockProvider.mu.Unlock()
+
+	for i := range mockProvider.Calls {
+		if mockProvider.Calls[i].Sid == sid {
+			mockProvider.Calls[i].Redirects = append(mockProvider.Calls[i].Redirects, r.FormValue("Url"))
+
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			json.NewEncoder(w).Encode(map[string]string{
+				"sid":    sid,
+				"status": "in-progress",
+			})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    20404,
+		"message": fmt.Sprint("The requested resource ", r.URL.Path, " was not found"),
+		"status":  http.StatusNotFound,
+	})
+}
+
+// Handles GET /outbox and returns everything that's been recorded as JSON
+func MockOutbox(w http.ResponseWriter, r *http.Request) {
+	mockProvider.mu.Lock()
+	defer mockProvider.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(&mockProvider)
+}
+
+// Handles DELETE /outbox
+func MockResetOutbox(w http.ResponseWriter, r *http.Request) {
+	mockProvider.Reset()
+}
+
+// Handles POST /simulate/sms.  Takes From and Body form values.
+func MockSimulateSMSReply(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	mockSimulationResult(w, mockProvider.ReplySMS(r.FormValue("From"), r.FormValue("Body")))
+}
+
+// Handles POST /simulate/calls/{sid}/digits.  Takes one or more Digits form values, which are
+// pressed in order.
+func MockSimulateDigits(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	mockSimulationResult(w, mockProvider.PressDigits(mux.Vars(r)["sid"], r.Form["Digits"]...))
+}
+
+// Handles POST /simulate/status/{sid}.  Takes a Status form value.
+func MockSimulateStatus(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	mockSimulationResult(w, mockProvider.SendStatus(mux.Vars(r)["sid"], r.FormValue("Status")))
+}
+
+// Handles POST /simulate/emails/{id}/click
+func MockSimulateClick(w http.ResponseWriter, r *http.Request) {
+	mockSimulationResult(w, mockProvider.ClickStopLink(mux.Vars(r)["id"]))
+}
+
+// Handles POST /simulate/emails/{id}/reply.  Takes From and Body form values.
+func MockSimulateEmailReply(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	mockSimulationResult(w, mockProvider.ReplyEmail(mux.Vars(r)["id"], r.FormValue("From"), r.FormValue("Body")))
+}
+
+func mockSimulationResult(w http.ResponseWriter, err error) {
+	var res CallbackResponse
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if err != nil {
+		w.WriteHeader(422) // unprocessable entity
+		res.Error = err.Error()
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	res.Message = "Simulation delivered"
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testMockNotificationPlanJson = `
+[
+  {
+    "method": "sms://+12108675309",
+    "notify_every_period": 0,
+    "notify_until_period": 3600000000000
+  },
+  {
+    "method": "phone://+12108675309",
+    "notify_every_period": 3600000000000,
+    "notify_until_period": 0
+  }
+]
+`
+
+const testMockEmailNotificationPlanJson = `
+[
+  {
+    "method": "email://lancelot@camelot.example.com",
+    "notify_every_period": 3600000000000,
+    "notify_until_period": 0
+  }
+]
+`
+
+const testMockPhoneNotificationPlanJson = `
+[
+  {
+    "method": "phone://+12108675309",
+    "notify_every_period": 3600000000000,
+    "notify_until_period": 0
+  }
+]
+`
+
+var engineOnce sync.Once
+
+// Several tests need the notification engine, but it can only be started once
+func startTestNotificationEngine() {
+	engineOnce.Do(func() {
+		stopChan = make(chan string)
+		go StartNotificationEngine()
+	})
+}
+
+// Points our Twilio and e-mail integrations at the mock provider and serves our callback and
+// click endpoints.  Returns a function that tears it all down again.
+func startTestMockProvider() func() {
+	mockServer := httptest.NewServer(mockRouter())
+	callbackServer := httptest.NewServer(callbackRouter())
+	clickServer := httptest.NewServer(clickRouter())
+
+	c.Config.Integrations.Mock.Enabled = true
+	c.Config.Integrations.Twilio.APIBaseURL = mockServer.URL + "/2010-04-01/Accounts/"
+	c.Config.Integrations.Twilio.AccountSID = "AC123"
+	c.Config.Integrations.Twilio.CallFromNumber = "+15005550006"
+	c.Config.Service.CallbackURLBase = callbackServer.URL
+	c.Config.Service.ClickURLBase = clickServer.URL
+
+	return func() {
+		c.Config.Integrations.Mock.Enabled = false
+		mockServer.Close()
+		callbackServer.Close()
+		clickServer.Close()
+	}
+}
+
+// Polls until cond is true or a few seconds have gone by
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Sends an API request and returns the recorded response
+func testAPIRequest(t *testing.T, method, url, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Failed to create new HTTP Request: %s", err)
+	}
+	apiRouter().ServeHTTP(w, r)
+	return w
+}
+
+// Creates a notification plan for a person and notifies them, returning the notification's UUID
+func testMockNotify(t *testing.T, username, plan string) string {
+	testAPIRequest(t, "DELETE", "http://localhost/plan/"+username, "")
+	w := testAPIRequest(t, "POST", "http://localhost/plan/"+username, plan)
+	if w.Code != 200 {
+		t.Fatalf("CreateNotificationPlan request failed: %s", w.Body)
+	}
+
+	w = testAPIRequest(t, "POST", "http://localhost/people/"+username+"/notify", `{"content": "The castle is on fire"}`)
+	if w.Code != 200 {
+		t.Fatalf("NotifyPerson request failed: %s", w.Body)
+	}
+
+	m := regexp.MustCompile(`"uuid":"([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("NotifyPerson response contained no UUID: %s", w.Body)
+	}
+
+	return m[1]
+}
+
+func TestMockProvider(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	// Stand up the mock provider and our own callback and click endpoints
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed")
+	}
+
+	// SMS: acknowledge by replying with the code from the message
+	uuid := testMockNotify(t, "lancelot", testMockNotificationPlanJson)
+	waitFor(t, "SMS notification", func() bool { return len(mockProvider.SentSMS()) == 1 })
+
+	sms := mockProvider.SentSMS()[0]
+	if sms.To != "+12108675309" || !strings.HasPrefix(sms.Body, "The castle is on fire") {
+		t.Errorf("Unexpected SMS: %+v", sms)
+	}
+
+	err := mockProvider.SendStatus(sms.Sid, "delivered")
+	if err != nil {
+		t.Errorf("Status callback failed: %s", err)
+	}
+
+	code := regexp.MustCompile(`Reply with "(\d+)"`).FindStringSubmatch(sms.Body)
+	if code == nil {
+		t.Fatalf("SMS contained no acknowledgement code: %s", sms.Body)
+	}
+
+	err = mockProvider.ReplySMS(sms.To, code[1])
+	if err != nil {
+		t.Fatalf("SMS reply failed: %s", err)
+	}
+	waitFor(t, "SMS acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	if n := len(mockProvider.SentSMS()); n != 2 {
+		t.Errorf("Expected an SMS confirming the acknowledgement, got %d messages", n)
+	}
+	if n := len(mockProvider.PlacedCalls()); n != 0 {
+		t.Errorf("Expected no phone calls after acknowledgement, got %d", n)
+	}
+
+	// Phone: acknowledge by pressing a key
+	mockProvider.Reset()
+	uuid = testMockNotify(t, "lancelot", testMockPhoneNotificationPlanJson)
+	waitFor(t, "phone call", func() bool { return len(mockProvider.PlacedCalls()) == 1 })
+
+	call := mockProvider.PlacedCalls()[0]
+	err = mockProvider.PressDigits(call.Sid, "1")
+	if err != nil {
+		t.Fatalf("Digit press failed: %s", err)
+	}
+	waitFor(t, "phone acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	call = mockProvider.PlacedCalls()[0]
+	if len(call.Redirects) != 1 || !strings.Contains(call.Redirects[0], "/twiml/acknowledged") {
+		t.Errorf("Expected the call to be redirected to the acknowledgement message, got %v", call.Redirects)
+	}
+
+	// E-mail: acknowledge by clicking the stop link
+	mockProvider.Reset()
+	uuid = testMockNotify(t, "lancelot", testMockEmailNotificationPlanJson)
+	waitFor(t, "e-mail notification", func() bool { return len(mockProvider.SentEmails()) == 1 })
+
+	email := mockProvider.SentEmails()[0]
+	if email.To != "lancelot@camelot.example.com" {
+		t.Errorf("Unexpected e-mail recipient: %s", email.To)
+	}
+
+	err = mockProvider.ClickStopLink(email.ID)
+	if err != nil {
+		t.Fatalf("Stop link failed: %s", err)
+	}
+	waitFor(t, "e-mail acknowledgement", func() bool { return !notificationInProgress(uuid) })
+}
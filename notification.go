@@ -2,30 +2,97 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/url"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 var (
-	stopChan chan string
+	stopChan     chan string
+	controlChan  = make(chan NotificationControl)
+	shutdownChan = make(chan struct{})
+
+	// Tracks the running plan processors so that we can wait for them during shutdown
+	notificationHandlers sync.WaitGroup
+)
+
+type NotificationAction int
+
+const (
+	StopAction        NotificationAction = iota // 0
+	EscalateAction                              // 1
+	SnoozeAction                                // 2
+	ShutdownAction                              // 3
+	AcknowledgeAction                           // 4
+)
+
+// How long a notification is snoozed for when the person doesn't say, and the longest they can ask for.  The
+// longest snooze is also the longest that an acknowledgement can be given for.
+var (
+	defaultSnoozePeriod = 15 * time.Minute
+	maxSnoozePeriod     = 24 * time.Hour
+)
+
+// How long an acknowledgement lasts when it's given by phone, before the notification is re-triggered
+var defaultRetriggerPeriod = time.Hour
+
+// Added to the content of a notification that has been re-triggered
+const retriggeredNote = "[re-triggered] "
+
+// The states that a notification can be in
+const (
+	StateNotifying    = "notifying"
+	StateSnoozed      = "snoozed"
+	StateAcknowledged = "acknowledged" // Acknowledged for a while, and re-triggered when that's up unless it's been resolved
+	StateSuppressed   = "suppressed"   // Held back by a maintenance window until it ends
+	StateEnded        = "ended"        // Only shown for notifications that are over.  Their outcome says how they ended.
 )
 
+// NotificationControl asks the plan processor for a notification to do something other than carry on with its plan
+type NotificationControl struct {
+	UUID   string
+	Action NotificationAction
+	Snooze time.Duration // How long to snooze for, if Action is SnoozeAction, or to acknowledge for, if AcknowledgeAction
+}
+
+// NotificationStatus describes where a notification-in-progress is at
+type NotificationStatus struct {
+	State        string     `json:"state"`
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty"`
+	RetriggerAt  *time.Time `json:"retrigger_at,omitempty"` // When an acknowledged notification is re-triggered
+	Retriggers   int        `json:"retriggers"`
+	Escalations  int        `json:"escalations"`
+	Attempts     int        `json:"attempts"` // Contact attempts at the current step
+	Started      time.Time  `json:"-"`        // When we started notifying
+	Triggered    time.Time  `json:"-"`        // When we started or last re-triggered, for the time-to-acknowledge metric
+	FallbackUUID string     `json:"-"`        // The notification we started when this one gave up
+	LastMethod   string     `json:"-"`        // The method that last reached the person
+	TakenBy      string     `json:"-"`        // Who took this notification's group, once someone has
+	StopOutcome  string     `json:"-"`        // How a stop request from the group ends this notification
+}
+
 type NotificationsInProgress struct {
-	Stoppers      map[string]chan bool
+	Stoppers      map[string]chan NotificationControl
 	Messages      map[string]string
 	Conversations map[string]string
+	Requests      map[string]*NotificationRequest
+	Steps         map[string]int
+	Status        map[string]*NotificationStatus
+	Errors        map[string][]error
+	Draining      bool          // Set when we're shutting down, so that no new contact attempts are started
+	Stopping      chan struct{} // Closed when we're shutting down, so that anything waiting to retry can give up
 	Mu            sync.Mutex
 }
 
 // Start the main notification loop.  This loop receives notifications on planChan and launches the notificationHandler
-// to carry out the actual notifications.  Also receives requests to stop notifications on stopChan and then stops them.
+// to carry out the actual notifications.  Also receives requests to stop notifications on stopChan and then stops them,
+// and requests to escalate or snooze notifications on controlChan.  The loop ends when a shutdown is requested on
+// shutdownChan.
 func StartNotificationEngine() {
-	// Initialize our map of Stopper channels
+	// Initialize our map of Stopper channels, which also carry escalation and snooze requests
 	// UUID -> channel
-	NIP.Stoppers = make(map[string]chan bool)
+	NIP.Stoppers = make(map[string]chan NotificationControl)
 
 	// Initialize our map of Messages
 	NIP.Messages = make(map[string]string)
@@ -33,13 +100,24 @@ func StartNotificationEngine() {
 	// Initialize our map of Conversations
 	NIP.Conversations = make(map[string]string)
 
-	log.Println("StartNotificationEngine()")
+	// Initialize our maps of requests and the plan step that each has reached
+	NIP.Requests = make(map[string]*NotificationRequest)
+	NIP.Steps = make(map[string]int)
+
+	// Initialize our map of notification statuses
+	NIP.Status = make(map[string]*NotificationStatus)
+
+	// Initialize our map of contact failures
+	NIP.Errors = make(map[string][]error)
+
+	NIP.Draining = false
+	NIP.Stopping = make(chan struct{})
+
+	logger.Info("Notification engine started")
 
 	for {
 
 		select {
-		// IMPROVEMENT: We could implement a close() of planChan to indicate that the service is shutting down
-		//              and instruct all notifications to cease
 		case nr := <-planChan:
 			// We've received a new notification plan
 
@@ -48,13 +126,36 @@ func StartNotificationEngine() {
 
 			NIP.Mu.Lock()
 
-			// Create a new Stopper channel for this plan
-			NIP.Stoppers[id] = make(chan bool)
+			// Create a new Stopper channel for this plan.  It's buffered so that we never block here
+			// if the plan processor has already given up on this plan.
+			NIP.Stoppers[id] = make(chan NotificationControl, 4)
+
+			now := time.Now()
+			NIP.Status[id] = &NotificationStatus{State: StateNotifying, Started: now, Triggered: now}
+
+			// Pick up where we left off if this notification was interrupted by a shutdown
+			if nr.Checkpoint != nil {
+				NIP.Status[id].Escalations = nr.Checkpoint.Escalations
+				NIP.Status[id].Attempts = nr.Checkpoint.Attempts
+				NIP.Status[id].Retriggers = nr.Checkpoint.Retriggers
+				for _, key := range nr.Checkpoint.Conversations {
+					NIP.Conversations[key] = id
+				}
+			}
 
 			// Save the message to NIP.Message
 			NIP.Messages[id] = nr.Content
 
+			// Save the request itself so that we can personalize messages
+			NIP.Requests[id] = nr
+
+			// Resumed notifications were already counted before the shutdown
+			if nr.Checkpoint == nil {
+				metrics.NotificationsStarted.Inc()
+			}
+
 			// Launch a goroutine to handle plan processing
+			notificationHandlers.Add(1)
 			go notificationHandler(nr, NIP.Stoppers[id])
 
 			NIP.Mu.Unlock()
@@ -63,16 +164,53 @@ func StartNotificationEngine() {
 			NIP.Mu.Lock()
 
 			// Check to see if the requested UUID is actually in progress
-			_, prs := NIP.Stoppers[stopUUID]
-			if prs {
+			if sc, prs := NIP.Stoppers[stopUUID]; prs {
 
-				log.Println("[", stopUUID, "]", "Sending a stop notification to the plan processor")
+				logger.Debug("Sending a stop notification to the plan processor", "uuid", stopUUID)
 
-				// It's in progress, so we'll send a message on its Stopper to
-				// be received by the goroutine executing the plan
-				NIP.Stoppers[stopUUID] <- true
+				// It's in progress, so we'll send a message on its Stopper to be received by the goroutine
+				// executing the plan.  Don't hold up the engine if the plan processor is already swamped.
+				select {
+				case sc <- NotificationControl{UUID: stopUUID, Action: StopAction}:
+				default:
+					logger.Warn("Plan processor is busy.  Dropping stop request.", "uuid", stopUUID)
+				}
 			}
 			NIP.Mu.Unlock()
+		case ctl := <-controlChan:
+			// We've received a request to escalate or snooze a notification plan
+			NIP.Mu.Lock()
+
+			if sc, prs := NIP.Stoppers[ctl.UUID]; prs {
+				logger.Debug("Sending a control request to the plan processor", "uuid", ctl.UUID, "action", ctl.Action)
+
+				// Don't hold up the engine if the plan processor is already swamped with requests
+				select {
+				case sc <- ctl:
+				default:
+					logger.Warn("Plan processor is busy.  Dropping control request.", "uuid", ctl.UUID, "action", ctl.Action)
+				}
+			}
+			NIP.Mu.Unlock()
+		case <-shutdownChan:
+			// We're shutting down, so every plan processor needs to stop where it is.  The notifications stay
+			// in the NIP store so that they can be checkpointed.
+			NIP.Mu.Lock()
+
+			logger.Info("Shutting down the notification engine")
+
+			NIP.Draining = true
+			close(NIP.Stopping)
+			for id, sc := range NIP.Stoppers {
+				select {
+				case sc <- NotificationControl{UUID: id, Action: ShutdownAction}:
+				default:
+					logger.Warn("Plan processor is busy.  It will stop at its next step.", "uuid", id)
+				}
+			}
+
+			NIP.Mu.Unlock()
+			return
 		}
 	}
 
@@ -80,78 +218,512 @@ func StartNotificationEngine() {
 
 // Receives notification requests from the notification engine and steps through the plan, making phone calls,
 // sending SMS, email, etc., as necessary.
-func notificationHandler(nr *NotificationRequest, sc <-chan bool) {
+func notificationHandler(nr *NotificationRequest, sc <-chan NotificationControl) {
+	defer notificationHandlers.Done()
 
 	var timerChan <-chan time.Time
 	var tickerChan <-chan time.Time
+	var snoozeChan <-chan time.Time
 
 	uuid := nr.Plan.ID.String()
-	log.Println("[", uuid, "]", "Initiating notification plan")
+	nlog := logger.With("uuid", uuid, "username", nr.Plan.Username)
+	nlog.Info("Initiating notification plan", "steps", len(nr.Plan.Steps))
+	nlog.Debug("Notification content", "content", nr.Content)
 
-	// Iterate through each step of the plan
-	for n, s := range nr.Plan.Steps {
+	// A notification that was interrupted by a shutdown starts over at the step it had reached
+	firstStep := 0
+	if nr.Checkpoint != nil && nr.Checkpoint.Step > 0 {
+		firstStep = nr.Checkpoint.Step - 1
+		nlog.Info("Resuming notification plan", "step", nr.Checkpoint.Step)
+	}
 
-		// TO DO: validate Method here and return an error if it's unsupported
-		u, err := url.Parse(s.Method)
-		if err != nil {
-			log.Println("Error parsing URI:", err)
-			log.Println("Advancing to next step in plan.")
-			continue
+	// If it had been acknowledged for a while, that while carries on, and then the plan starts over
+	if nr.Checkpoint != nil && nr.Checkpoint.RetriggerAt != nil {
+		if !awaitRetrigger(nr, time.Until(*nr.Checkpoint.RetriggerAt), sc, nlog) {
+			return
 		}
+		firstStep = 0
+	}
 
-		log.Println("[", uuid, "]", "Method:", s.Method)
-
-	stepLoop:
-		// This outer loop repeats a notification until it's acknowledged.  It can be broken by the expiration of the timer for this step,
-		// or by a stop request.
-		for {
-
-			// Take the appropriate action, depending on the type of notification
-			switch u.Scheme {
-			case "phone":
-				MakePhoneCall(u.Host, nr.Content, uuid)
-			case "sms":
-				SendSMS(u.Host, nr.Content, uuid, false)
-			case "email":
-				SendEmail(fmt.Sprint(u.User, "@", u.Host), nr.Content, uuid)
+plan:
+	// Each pass of this loop runs through the plan from firstStep.  It's only repeated when an acknowledgement
+	// runs out and the notification is re-triggered.
+	for {
+		// Iterate through each step of the plan
+		for n, s := range nr.Plan.Steps {
+			if n < firstStep {
+				continue
 			}
 
-			if n == len(nr.Plan.Steps)-1 {
-				// We're at the last step of the plan, so this step will repeat until ackknowledged. We use a Ticker and set its period to NotifyEveryPeriod
-				tickerChan = time.NewTicker(s.NotifyEveryPeriod).C
-				log.Println("[", uuid, "]", "Scheduling the next retry in", strconv.FormatFloat(s.NotifyEveryPeriod.Minutes(), 'f', 1, 64), "minutes")
+			stepLog := nlog.With("step", n+1, "method", s.schemes())
 
-			} else {
-				// We're not at the last step, so we only run this step once.  We use Timer set its duration to NotifyUntilPeriod
-				timerChan = time.NewTimer(s.NotifyUntilPeriod).C
-				log.Println("[", uuid, "]", "Scheduling the next notification step in", strconv.FormatFloat(s.NotifyUntilPeriod.Minutes(), 'f', 1, 64), "minutes")
+			// Methods are validated when plans are stored, but older plans may still have bad ones
+			var methods []*url.URL
+			for _, m := range s.AllMethods() {
+				u, err := url.Parse(m)
+				if err != nil {
+					stepLog.Error("Could not parse method", "err", err)
+					continue
+				}
+				methods = append(methods, u)
 			}
+			if len(methods) == 0 {
+				stepLog.Error("No usable methods.  Advancing to next step in plan.")
+				continue
+			}
+
+			stepLog.Info("Starting plan step")
+			stepLog.Debug("Plan step methods", "addresses", strings.Join(s.AllMethods(), ","))
 
-		timerLoop:
-			// This inner loop selects over various channels to receive timers and stop requests.
-			// It can be broken by an expiring Timer (signaling that it's time to proceed to the next step) or a stop request.
+			NIP.Mu.Lock()
+			NIP.Steps[uuid] = n + 1
+			// A resumed step carries on counting its attempts where it left off
+			if st, exists := NIP.Status[uuid]; exists && (n > firstStep || nr.Checkpoint == nil) {
+				st.Attempts = 0
+			}
+			NIP.Mu.Unlock()
+
+			// Whatever the last step left running belongs to it, and mustn't move this one along
+			timerChan, tickerChan = nil, nil
+
+			// The last step repeats until it's acknowledged, unless the plan limits how long it goes on for
+			var deadlineChan <-chan time.Time
+			if n == len(nr.Plan.Steps)-1 && s.MaxDuration > 0 {
+				deadlineChan = time.After(s.MaxDuration)
+			}
+
+		stepLoop:
+			// This outer loop repeats a notification until it's acknowledged.  It can be broken by the expiration of the timer for this step,
+			// or by a stop or escalation request.
 			for {
-				select {
-				case <-timerChan:
-					// Our timer for this step has expired so we break the outer loop to proceed to the next step.
-					log.Println("[", uuid, "]", "Step timer expired.  Proceeding to next plan step.")
-					break stepLoop
-				case <-tickerChan:
-					// Our ticker for this step expired, so we'll break the inner loop and try this step again.
-					log.Println("[", uuid, "]", "**Tick**  Retry contact method!")
-					log.Println("[", uuid, "]", "Waiting", strconv.FormatFloat(s.NotifyEveryPeriod.Minutes(), 'f', 1, 64), "minutes]")
-					break timerLoop
-				case <-sc:
-					log.Println("[", uuid, "]", "Stop request received.  Terminating notifications.")
-					NIP.Mu.Lock()
-					defer NIP.Mu.Unlock()
-					delete(NIP.Stoppers, uuid)
-					delete(NIP.Messages, uuid)
+
+				// Don't start contacting anyone while we're shutting down
+				if draining() {
+					stepLog.Info("Shutting down.  Leaving notification for the checkpoint.")
 					return
 				}
+
+				// Any snooze ends when we're ready to notify again
+				snoozeChan = nil
+				setNotificationState(uuid, StateNotifying, nil)
+
+				// Every method of the step is tried at once
+				err := contactAll(methods, nr.Content, uuid, stepLog)
+				attempts := countAttempt(uuid)
+
+				// Transient failures have already been retried by the provider, so we'll carry on with the plan and
+				// try again at the next scheduled attempt.  Anything else (bad credentials, an invalid number) will
+				// never succeed, so there's no point in waiting out this step.
+				if err != nil && !IsTemporary(err) {
+					if n == len(nr.Plan.Steps)-1 {
+						stepLog.Error("Final plan step cannot be completed.  Terminating notifications.")
+						giveUp(nr, OutcomeFailed, stepLog)
+						return
+					}
+					stepLog.Warn("Step cannot be completed.  Proceeding to next plan step.")
+					break stepLoop
+				}
+
+				if n == len(nr.Plan.Steps)-1 {
+					// We're at the last step of the plan, so this step will repeat until ackknowledged. We use a Ticker and set its period to NotifyEveryPeriod
+					timerChan = nil
+					if s.NotifyEveryPeriod > 0 {
+						tickerChan = time.NewTicker(s.NotifyEveryPeriod).C
+						stepLog.Info("Scheduling the next retry", "in", s.NotifyEveryPeriod)
+					} else {
+						// Plans stored before periods were validated might not have one.  NewTicker would panic.
+						stepLog.Warn("Final plan step has no notify_every_period.  Waiting for acknowledgement without retrying.")
+					}
+
+				} else {
+					// We're not at the last step, so we only run this step once.  We use Timer set its duration to NotifyUntilPeriod
+					timerChan = time.NewTimer(s.NotifyUntilPeriod).C
+					stepLog.Info("Scheduling the next notification step", "in", s.NotifyUntilPeriod)
+				}
+
+			timerLoop:
+				// This inner loop selects over various channels to receive timers and stop, escalation and snooze requests.
+				// It can be broken by an expiring Timer (signaling that it's time to proceed to the next step), an expiring
+				// snooze, an escalation or a stop request.
+				for {
+					select {
+					case <-timerChan:
+						// Our timer for this step has expired so we break the outer loop to proceed to the next step.
+						stepLog.Info("Step timer expired.  Proceeding to next plan step.")
+						break stepLoop
+					case <-tickerChan:
+						// Our ticker for this step expired, so we'll break the inner loop and try this step again, unless
+						// that was the last attempt the plan allows.
+						if s.MaxAttempts > 0 && attempts >= s.MaxAttempts {
+							stepLog.Warn("No acknowledgement after the last attempt.  Giving up.", "attempts", attempts)
+							giveUp(nr, OutcomeUnacknowledged, stepLog)
+							return
+						}
+						stepLog.Info("Retrying contact method")
+						break timerLoop
+					case <-deadlineChan:
+						stepLog.Warn("No acknowledgement within max_duration.  Giving up.", "max_duration", s.MaxDuration)
+						giveUp(nr, OutcomeUnacknowledged, stepLog)
+						return
+					case <-snoozeChan:
+						// The person asked us to leave them alone for a while, and that while is up.  We'll break the inner
+						// loop and try this step again.
+						stepLog.Info("Snooze expired.  Resuming notifications.")
+						break timerLoop
+					case ctl := <-sc:
+						switch ctl.Action {
+						case EscalateAction:
+							if n == len(nr.Plan.Steps)-1 {
+								stepLog.Info("Escalation requested but this is the final plan step.  Ignoring.")
+								continue
+							}
+							stepLog.Info("Escalation requested.  Proceeding to next plan step.")
+							NIP.Mu.Lock()
+							NIP.Status[uuid].Escalations++
+							NIP.Mu.Unlock()
+							break stepLoop
+						case SnoozeAction:
+							// Stop our step timers while we're snoozing.  This step starts over once the snooze expires.
+							stepLog.Info("Snoozing notifications", "for", ctl.Snooze)
+							timerChan, tickerChan = nil, nil
+							snoozeChan = time.After(ctl.Snooze)
+							until := time.Now().Add(ctl.Snooze)
+							setNotificationState(uuid, StateSnoozed, &until)
+						case AcknowledgeAction:
+							// The person has it in hand for now.  If they haven't resolved it by the time the
+							// acknowledgement runs out, we start the plan over.
+							stepLog.Info("Acknowledged until a re-trigger", "for", ctl.Snooze)
+							if nr.Group != "" {
+								if takenBy := acknowledgeGroup(nr, stepLog); takenBy != "" {
+									stepLog.Info("Group was taken by someone else first.  Terminating notifications.", "taken_by", takenBy)
+									tellTaken(uuid, takenBy, stepLog)
+									endNotification(uuid, OutcomeTaken)
+									return
+								}
+							}
+							if !awaitRetrigger(nr, ctl.Snooze, sc, stepLog) {
+								return
+							}
+							firstStep = 0
+							timerChan, tickerChan = nil, nil
+							continue plan
+						case ShutdownAction:
+							stepLog.Info("Shutting down.  Leaving notification for the checkpoint.")
+							return
+						default:
+							// This notification's group was taken by someone else, or timed out.  Someone else may
+							// also have taken it just before this person acknowledged.
+							outcome, takenBy := groupStop(uuid)
+							if outcome == "" && nr.Group != "" {
+								if takenBy = acknowledgeGroup(nr, stepLog); takenBy != "" {
+									outcome = OutcomeTaken
+								}
+							}
+							if outcome != "" {
+								stepLog.Info("Stopped by its group.  Terminating notifications.", "outcome", outcome, "taken_by", takenBy)
+								if outcome == OutcomeTaken {
+									tellTaken(uuid, takenBy, stepLog)
+								}
+								endNotification(uuid, outcome)
+								return
+							}
+
+							stepLog.Info("Stop request received.  Terminating notifications.")
+							endNotification(uuid, OutcomeAcknowledged)
+							return
+						}
+					}
+				}
+
+				stepLog.Debug("Repeating plan step")
+			}
+		}
+
+		// Only the last step can end the plan, so we only get here if it couldn't be carried out at all.  The
+		// notification still has to end, or it would be left in the NIP store forever.
+		nlog.Error("Ran out of plan steps without contacting anyone.  Terminating notifications.")
+		giveUp(nr, OutcomeFailed, nlog)
+		return
+	}
+}
+
+// Waits out an acknowledgement that was given for a while.  Returns true once it has run out and the
+// notification has been re-triggered.  Returns false if the notification is over in the meantime, because it
+// was resolved or stopped by its group, or if we're shutting down and it's been left for the checkpoint.
+func awaitRetrigger(nr *NotificationRequest, d time.Duration, sc <-chan NotificationControl, log *Logger) bool {
+	uuid := nr.Plan.ID.String()
+
+	until := time.Now().Add(d)
+	setRetrigger(uuid, &until)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			log.Info("Acknowledgement ran out without a resolution.  Re-triggering notification.")
+			retrigger(nr)
+			return true
+		case ctl := <-sc:
+			switch ctl.Action {
+			case AcknowledgeAction:
+				// Acknowledged again, so the new acknowledgement replaces the old one
+				log.Info("Acknowledged until a re-trigger", "for", ctl.Snooze)
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(ctl.Snooze)
+				until = time.Now().Add(ctl.Snooze)
+				setRetrigger(uuid, &until)
+			case ShutdownAction:
+				log.Info("Shutting down.  Leaving notification for the checkpoint.")
+				return false
+			case StopAction:
+				// The person already acknowledged it, so a group that timed out doesn't change that
+				if outcome, takenBy := groupStop(uuid); outcome != "" {
+					log.Info("Stopped by its group.  Terminating notifications.", "outcome", outcome, "taken_by", takenBy)
+					if outcome == OutcomeUnacknowledged {
+						outcome = OutcomeAcknowledged
+					}
+					endNotification(uuid, outcome)
+					return false
+				}
+
+				log.Info("Resolved.  Terminating notifications.")
+				endNotification(uuid, OutcomeResolved)
+				return false
+			default:
+				log.Info("Notification is acknowledged.  Ignoring request.", "action", ctl.Action)
 			}
+		}
+	}
+}
+
+// Acknowledges a notification-in-progress that was acknowledged through channel.  Without a snooze, the
+// notification is over.  With one, it's re-triggered from the first step of its plan once the snooze is up,
+// unless it has been resolved by then.  Stopping an acknowledged notification resolves it.
+func acknowledgeNotification(uuid, channel string, snooze time.Duration) {
+	recordAcknowledgement(uuid, channel)
+
+	if snooze <= 0 {
+		// Attempt to stop the notification by sending the UUID to the notification engine
+		stopChan <- uuid
+		return
+	}
+
+	controlChan <- NotificationControl{UUID: uuid, Action: AcknowledgeAction, Snooze: snooze}
+}
+
+// Contacts a person by every method of a plan step at the same time.  Failures are logged and kept in the
+// NIP store.  The error is nil if any method worked, since the person can respond to that one.  Otherwise it's
+// temporary if any of the failures were, because the step is worth trying again.
+func contactAll(methods []*url.URL, content, uuid string, log *Logger) error {
+	errs := make([]error, len(methods))
+
+	var wg sync.WaitGroup
+	for i, u := range methods {
+		wg.Add(1)
+		go func(i int, u *url.URL) {
+			defer wg.Done()
+			errs[i] = contact(u, content, uuid, log)
+		}(i, u)
+	}
+	wg.Wait()
+
+	var failed error
+	for i, err := range errs {
+		if err == nil {
+			NIP.Mu.Lock()
+			if s, exists := NIP.Status[uuid]; exists {
+				s.LastMethod = methods[i].String()
+			}
+			NIP.Mu.Unlock()
+			return nil
+		}
+
+		log.Error("Contact attempt failed", "scheme", methods[i].Scheme, "err", err, "temporary", IsTemporary(err))
 
-			log.Println("Loop broken")
+		NIP.Mu.Lock()
+		NIP.Errors[uuid] = append(NIP.Errors[uuid], err)
+		NIP.Mu.Unlock()
+
+		if failed == nil || (IsTemporary(err) && !IsTemporary(failed)) {
+			failed = err
 		}
 	}
+
+	return failed
+}
+
+// Contacts a person by one method, taking the appropriate action for its type
+func contact(u *url.URL, content, uuid string, log *Logger) error {
+	var err error
+
+	switch u.Scheme {
+	case "phone":
+		err = MakePhoneCall(u.Host, content, uuid)
+	case "sms":
+		err = SendSMS(u.Host, content, uuid, false)
+	case "email":
+		// E-mail is fire-and-forget, so a failure is counted but doesn't change the plan
+		emailErr := SendEmail(fmt.Sprint(u.User, "@", u.Host), content, uuid)
+		if emailErr != nil {
+			log.Error("E-mail failed", "err", emailErr)
+		}
+		recordContactAttempt(u.Scheme, emailErr)
+		return nil
+	}
+
+	recordContactAttempt(u.Scheme, err)
+	return err
+}
+
+// Removes a notification from the notifications-in-progress (NIP) store and keeps a record of how it ended
+func endNotification(uuid, outcome string) {
+	rec := notificationRecord(uuid, outcome)
+	if rec != nil {
+		metrics.NotificationsEnded.Inc(outcome)
+
+		err := c.StoreNotificationRecord(rec)
+		if err != nil {
+			logger.Error("Could not store notification record", "uuid", uuid, "err", err)
+		}
+	}
+
+	removeNotification(uuid)
+
+	// The last member of a group to finish completes it
+	if rec != nil && rec.Group != "" {
+		groupMemberEnded(rec.Group)
+	}
+}
+
+// Removes a notification from the notifications-in-progress (NIP) store
+func removeNotification(uuid string) {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	delete(NIP.Stoppers, uuid)
+	delete(NIP.Messages, uuid)
+
+	// Release the SMS acknowledgement codes so that they can be used for other notifications
+	for key, id := range NIP.Conversations {
+		if id == uuid {
+			delete(NIP.Conversations, key)
+		}
+	}
+
+	delete(NIP.Requests, uuid)
+	delete(NIP.Steps, uuid)
+	delete(NIP.Status, uuid)
+	delete(NIP.Errors, uuid)
+}
+
+// Reports whether the notification engine is shutting down
+func draining() bool {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	return NIP.Draining
+}
+
+// A channel that's closed once the notification engine starts shutting down.  It's nil, and never ready, if the
+// engine isn't running.
+func shuttingDown() <-chan struct{} {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	return NIP.Stopping
+}
+
+// Hands a notification request to the notification engine.  Returns false if the engine is shutting down, and
+// so will never start it, rather than waiting forever.
+func startNotification(nr *NotificationRequest) bool {
+	select {
+	case planChan <- nr:
+		return true
+	case <-shuttingDown():
+		return false
+	}
+}
+
+// Records the state of a notification-in-progress
+func setNotificationState(uuid, state string, snoozedUntil *time.Time) {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	if s, exists := NIP.Status[uuid]; exists {
+		s.State = state
+		s.SnoozedUntil = snoozedUntil
+	}
+}
+
+// Records when an acknowledged notification-in-progress is due to be re-triggered
+func setRetrigger(uuid string, at *time.Time) {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	if s, exists := NIP.Status[uuid]; exists {
+		s.State = StateAcknowledged
+		s.SnoozedUntil = nil
+		s.RetriggerAt = at
+	}
+}
+
+// Starts an acknowledged notification-in-progress over, noting in its content that it was re-triggered
+func retrigger(nr *NotificationRequest) {
+	uuid := nr.Plan.ID.String()
+
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	addContentNote(nr, retriggeredNote)
+	NIP.Messages[uuid] = nr.Content
+
+	if s, exists := NIP.Status[uuid]; exists {
+		s.State = StateNotifying
+		s.RetriggerAt = nil
+		s.Retriggers++
+		s.Attempts = 0
+		s.Triggered = time.Now()
+	}
+}
+
+// Returns how a notification-in-progress was stopped by its group, and who took the group, if it was
+func groupStop(uuid string) (string, string) {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	if s, exists := NIP.Status[uuid]; exists {
+		return s.StopOutcome, s.TakenBy
+	}
+	return "", ""
+}
+
+// Counts a contact attempt at the current step of a notification-in-progress, returning the number made so far
+func countAttempt(uuid string) int {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	s, exists := NIP.Status[uuid]
+	if !exists {
+		return 0
+	}
+
+	s.Attempts++
+	return s.Attempts
+}
+
+// Reports whether a notification-in-progress has any plan steps left to escalate to
+func canEscalate(uuid string) bool {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	nr, exists := NIP.Requests[uuid]
+	if !exists {
+		return false
+	}
+
+	return NIP.Steps[uuid] < len(nr.Plan.Steps)
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Link points somewhere that helps with a notification, like a dashboard or a runbook
+type Link struct {
+	Text string `json:"text,omitempty"`
+	URL  string `json:"url"`
+}
+
+// ContentFields are the parts of a notification beyond its content.  Each channel renders what fits: SMS and
+// voice use the title, and e-mail has room for everything.  All of them are optional.
+type ContentFields struct {
+	Title    string `json:"title,omitempty"`    // A short summary.  Defaults to the content.
+	Details  string `json:"details,omitempty"`  // A longer explanation
+	Source   string `json:"source,omitempty"`   // The system that raised the notification
+	Severity string `json:"severity,omitempty"` // e.g. critical, warning or info
+	Links    []Link `json:"links,omitempty"`
+}
+
+// Make sure that every link is an absolute http or https URL, so that it's safe to click
+func (cf *ContentFields) Validate() error {
+	for _, l := range cf.Links {
+		u, err := url.Parse(l.URL)
+		if err != nil || !u.IsAbs() || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Link %q is not an absolute http or https URL", l.URL)
+		}
+	}
+
+	return nil
+}
+
+// Fills in the content from the title, for requests that only have a title, and checks the fields
+func prepareContent(content *string, cf *ContentFields) error {
+	if strings.TrimSpace(*content) == "" {
+		*content = cf.Title
+	}
+
+	return cf.Validate()
+}
+
+// Prefixes a notification's content and title with a note, like the one added when it's re-triggered, unless
+// they already have it
+func addContentNote(nr *NotificationRequest, note string) {
+	if !strings.HasPrefix(nr.Content, note) {
+		nr.Content = note + nr.Content
+	}
+	if nr.Title != "" && !strings.HasPrefix(nr.Title, note) {
+		nr.Title = note + nr.Title
+	}
+}
+
+// The title of a notification, or its content if it doesn't have one
+func (nr *NotificationRequest) headline() string {
+	if nr.Title != "" {
+		return nr.Title
+	}
+	return nr.Content
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestContentFields(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	plans := map[string]string{
+		"lancelot": `[{"method": "sms://+12108675309", "notify_every_period": "1h"}]`,
+		"galahad":  `[{"method": "email://galahad@camelot.example.com", "notify_every_period": "1h"}]`,
+	}
+	for u, plan := range plans {
+		w := testAPIRequest(t, "POST", "http://localhost/people", `{"username": "`+u+`", "fullname": "Sir `+strings.Title(u)+`"}`)
+		if w.Code != 200 {
+			t.Fatalf("CreatePerson request failed: %s", w.Body)
+		}
+		w = testAPIRequest(t, "POST", "http://localhost/plan/"+u, plan)
+		if w.Code != 200 {
+			t.Fatalf("CreateNotificationPlan request failed: %s", w.Body)
+		}
+	}
+
+	// Links have to be safe to click
+	w := testAPIRequest(t, "POST", "http://localhost/people/lancelot/notify", `{"title": "The castle is on fire", "links": [{"url": "javascript:alert(1)"}]}`)
+	if w.Code != 422 {
+		t.Errorf("Expected a notification with a bad link to be rejected: %s", w.Body)
+	}
+
+	body := `{
+		"title": "The castle is on fire",
+		"details": "The east tower caught fire at dawn.  The moat is empty.",
+		"source": "watchtower",
+		"severity": "critical",
+		"links": [{"text": "Runbook", "url": "https://runbooks.example.com/fire"}, {"url": "https://dashboards.example.com/castle"}]
+	}`
+
+	var ids []string
+	for _, u := range []string{"lancelot", "galahad"} {
+		w = testAPIRequest(t, "POST", "http://localhost/people/"+u+"/notify", body)
+		if w.Code != 200 {
+			t.Fatalf("NotifyPerson request failed: %s", w.Body)
+		}
+		var res NotifyPersonResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if res.Content != "The castle is on fire" {
+			t.Errorf("Expected the content to default to the title: %+v", res)
+		}
+		ids = append(ids, res.UUID)
+	}
+
+	waitFor(t, "notifications", func() bool { return len(mockProvider.SentSMS()) == 1 && len(mockProvider.SentEmails()) == 1 })
+
+	// SMS only has room for the title
+	if sms := mockProvider.SentSMS()[0].Body; !strings.HasPrefix(sms, "The castle is on fire - Reply") || strings.Contains(sms, "east tower") {
+		t.Errorf("Unexpected SMS: %s", sms)
+	}
+
+	// E-mail has everything, with links that can be clicked
+	e := mockProvider.SentEmails()[0]
+	for _, want := range []string{"The east tower caught fire at dawn.", "Severity: critical", "Source: watchtower", "Runbook: https://runbooks.example.com/fire", "https://dashboards.example.com/castle"} {
+		if !strings.Contains(e.Plain, want) {
+			t.Errorf("Expected %q in the e-mail: %s", want, e.Plain)
+		}
+	}
+	for _, want := range []string{"<A HREF='https://runbooks.example.com/fire'>Runbook</A>", "<A HREF='https://dashboards.example.com/castle'>https://dashboards.example.com/castle</A>"} {
+		if !strings.Contains(e.HTML, want) {
+			t.Errorf("Expected %q in the e-mail: %s", want, e.HTML)
+		}
+	}
+
+	for _, id := range ids {
+		testAPIRequest(t, "DELETE", "http://localhost/notifications/"+id, "")
+		waitFor(t, "acknowledgement", func() bool { return !notificationInProgress(id) })
+	}
+
+	// The fields are kept with the record
+	var s NotificationStatusResponse
+	w = testAPIRequest(t, "GET", "http://localhost/notifications/"+ids[0], "")
+	json.Unmarshal(w.Body.Bytes(), &s)
+	if s.State != StateEnded || s.Title != "The castle is on fire" || s.Severity != "critical" || len(s.Links) != 2 {
+		t.Errorf("Unexpected status of an ended notification: %+v", s)
+	}
+}
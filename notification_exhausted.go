@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/twinj/uuid"
+)
+
+// How long we wait for an on_exhausted webhook to answer
+const exhaustedWebhookTimeout = 10 * time.Second
+
+// Gives up on a notification that nobody acknowledged, carrying out its plan's on_exhausted action, and
+// records it with the given outcome
+func giveUp(nr *NotificationRequest, outcome string, log *Logger) {
+	id := nr.Plan.ID.String()
+
+	// Whatever we'd do next can wait until after the restart
+	if draining() {
+		log.Info("Shutting down.  Leaving notification for the checkpoint.")
+		return
+	}
+
+	oe := nr.Plan.OnExhausted
+	if oe == nil {
+		endNotification(id, outcome)
+		return
+	}
+
+	switch oe.Action {
+	case ExhaustedEscalate:
+		// Two people who fall back on each other would otherwise be notified forever
+		if nr.FallbackFor != "" {
+			log.Warn("Not escalating a fallback notification again", "fallback_for", nr.FallbackFor)
+			break
+		}
+
+		fid, err := notifyFallback(nr, oe.Username)
+		if err != nil {
+			log.Error("Could not notify fallback person", "fallback", oe.Username, "err", err)
+			break
+		}
+		log.Info("Notifying fallback person", "fallback", oe.Username, "fallback_uuid", fid)
+
+		NIP.Mu.Lock()
+		if s, exists := NIP.Status[id]; exists {
+			s.FallbackUUID = fid
+		}
+		NIP.Mu.Unlock()
+	case ExhaustedWebhook:
+		err := callExhaustedWebhook(oe.URL, notificationRecord(id, outcome))
+		if err != nil {
+			metrics.ProviderErrors.Inc("webhook", "send")
+			log.Error("on_exhausted webhook failed", "err", err)
+			break
+		}
+		log.Info("Called on_exhausted webhook")
+	}
+
+	endNotification(id, outcome)
+}
+
+// Starts notifying someone else with their own plan and the same content.  Returns the new notification's UUID.
+func notifyFallback(nr *NotificationRequest, username string) (string, error) {
+	plan, err := c.GetNotificationPlan(username)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := c.GetPerson(username)
+	if err != nil {
+		p = &Person{Username: username}
+	}
+
+	plan.ID = uuid.NewV4()
+
+	fnr := &NotificationRequest{
+		Content:       nr.Content,
+		ContentFields: nr.ContentFields,
+		Plan:          plan,
+		Person:        p,
+		FallbackFor:   nr.Plan.ID.String(),
+	}
+
+	// The fallback person may be in a maintenance window or over a rate limit too.  If we're shutting down,
+	// they're notified once we start up again.
+	if !holdBack(fnr) && !startNotification(fnr) {
+		err = checkpointRequest(fnr)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return plan.ID.String(), nil
+}
+
+// POSTs a notification's record to a webhook
+func callExhaustedWebhook(url string, rec *NotificationRecord) error {
+	if rec == nil {
+		return fmt.Errorf("notification is no longer in progress")
+	}
+
+	jrec, err := rec.Marshal()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: exhaustedWebhookTimeout}
+	resp, err := client.Post(url, "application/json; charset=UTF-8", bytes.NewReader(jrec))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %v", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMaxAttemptsNotificationPlanJson = `
+{
+  "steps": [
+    {
+      "method": "email://lancelot@camelot.example.com",
+      "notify_every_period": "20ms",
+      "max_attempts": 2
+    }
+  ],
+  "on_exhausted": {"action": "webhook", "url": "%v"}
+}
+`
+
+const testMaxDurationNotificationPlanJson = `
+{
+  "steps": [
+    {
+      "method": "email://lancelot@camelot.example.com",
+      "notify_every_period": "1h",
+      "max_duration": "50ms"
+    }
+  ],
+  "on_exhausted": {"action": "escalate", "username": "galahad"}
+}
+`
+
+const testFallbackNotificationPlanJson = `
+{
+  "steps": [
+    {
+      "method": "email://galahad@camelot.example.com",
+      "notify_every_period": "1h",
+      "max_duration": "50ms"
+    }
+  ],
+  "on_exhausted": {"action": "escalate", "username": "lancelot"}
+}
+`
+
+func TestOnExhausted(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	// Repeat quickly enough for the test
+	defer func(p time.Duration) { minStepPeriod = p }(minStepPeriod)
+	minStepPeriod = 0
+
+	for _, p := range []string{testCreatePersonJson, `{"username": "galahad", "fullname": "Sir Galahad"}`} {
+		w := testAPIRequest(t, "POST", "http://localhost/people", p)
+		if w.Code != 200 {
+			t.Fatalf("CreatePerson request failed: %s", w.Body)
+		}
+	}
+
+	// Give up after the second attempt and tell a webhook about it
+	hooks := make(chan NotificationRecord, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec NotificationRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		hooks <- rec
+	}))
+	defer hook.Close()
+
+	uuid := testMockNotify(t, "lancelot", strings.Replace(testMaxAttemptsNotificationPlanJson, "%v", hook.URL, 1))
+
+	rec := <-hooks
+	waitFor(t, "notification to give up", func() bool { return !notificationInProgress(uuid) })
+	if rec.UUID != uuid || rec.Outcome != OutcomeUnacknowledged || rec.Attempts != 2 {
+		t.Errorf("Unexpected webhook record: %+v", rec)
+	}
+	if n := len(mockProvider.SentEmails()); n != 2 {
+		t.Errorf("Expected 2 e-mails, got %d", n)
+	}
+
+	w := testAPIRequest(t, "GET", "http://localhost/notifications/"+uuid, "")
+	if !strings.Contains(w.Body.String(), `"state":"ended"`) || !strings.Contains(w.Body.String(), `"outcome":"unacknowledged"`) {
+		t.Errorf("Unexpected notification status: %s", w.Body)
+	}
+
+	// Give up after a while and hand over to Galahad, who doesn't hand back
+	w = testAPIRequest(t, "POST", "http://localhost/plan/galahad", strings.Replace(testFallbackNotificationPlanJson, `"lancelot"`, `"mordred"`, 1))
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "mordred has no notification plan") {
+		t.Errorf("Expected a fallback without a plan to be rejected: %s", w.Body)
+	}
+	w = testAPIRequest(t, "POST", "http://localhost/plan/galahad", testFallbackNotificationPlanJson)
+	if w.Code != 200 {
+		t.Fatalf("CreateNotificationPlan request failed: %s", w.Body)
+	}
+
+	mockProvider.Reset()
+	uuid = testMockNotify(t, "lancelot", testMaxDurationNotificationPlanJson)
+	waitFor(t, "e-mail notification", func() bool { return len(mockProvider.SentEmails()) == 1 })
+	waitFor(t, "notification to give up", func() bool { return !notificationInProgress(uuid) })
+
+	rec2, err := c.GetNotificationRecord(uuid)
+	if err != nil {
+		t.Fatalf("No notification record: %s", err)
+	}
+	if rec2.Outcome != OutcomeUnacknowledged || rec2.FallbackUUID == "" {
+		t.Fatalf("Unexpected notification record: %+v", rec2)
+	}
+
+	waitFor(t, "fallback notification to give up", func() bool {
+		rec, err := c.GetNotificationRecord(rec2.FallbackUUID)
+		return err == nil && rec.Outcome == OutcomeUnacknowledged
+	})
+	w = testAPIRequest(t, "GET", "http://localhost/notifications/"+rec2.FallbackUUID, "")
+	if !strings.Contains(w.Body.String(), `"username":"galahad"`) || !strings.Contains(w.Body.String(), `"fallback_for":"`+uuid+`"`) {
+		t.Errorf("Unexpected fallback notification status: %s", w.Body)
+	}
+
+	emails := mockProvider.SentEmails()
+	if len(emails) != 2 || emails[0].To != "lancelot@camelot.example.com" || emails[1].To != "galahad@camelot.example.com" {
+		t.Errorf("Unexpected e-mails: %+v", emails)
+	}
+}
+
+func TestValidateOnExhausted(t *testing.T) {
+	tests := []struct {
+		oe     *ExhaustedAction
+		fields []string
+	}{
+		{nil, nil},
+		{&ExhaustedAction{Action: "stop"}, nil},
+		{&ExhaustedAction{Action: "webhook", URL: "https://hooks.example.com/exhausted"}, nil},
+		{&ExhaustedAction{Action: "webhook", URL: "hooks.example.com"}, []string{"on_exhausted.url"}},
+		{&ExhaustedAction{Action: "escalate"}, []string{"on_exhausted.username"}},
+		{&ExhaustedAction{Action: "escalate", Username: "lancelot"}, []string{"on_exhausted.username"}},
+		{&ExhaustedAction{Action: "panic"}, []string{"on_exhausted.action"}},
+	}
+
+	for _, tt := range tests {
+		errs := validateOnExhausted(tt.oe, "lancelot")
+		if len(errs) != len(tt.fields) {
+			t.Errorf("%+v: expected %d errors, got %+v", tt.oe, len(tt.fields), errs)
+			continue
+		}
+		for i, f := range tt.fields {
+			if errs[i].Field != f {
+				t.Errorf("%+v: expected an error for %v, got %+v", tt.oe, f, errs[i])
+			}
+		}
+	}
+}
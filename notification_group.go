@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// How a group notification is acknowledged
+const (
+	GroupModeFirst = "first" // The first person to acknowledge takes it for everyone
+	GroupModeAll   = "all"   // Everyone has to acknowledge it themselves
+)
+
+// NotificationGroup is one incident sent to several people at once, each of them with their own plan.  In
+// GroupModeFirst, whoever acknowledges first takes the incident and everyone else's notifications are stopped.
+// In GroupModeAll, everyone is notified until they acknowledge it themselves.  Either way, the group is complete
+// once every member's notification has ended, or its timeout is up.
+type NotificationGroup struct {
+	UUID    string `json:"uuid"`
+	Content string `json:"content"`
+	ContentFields
+	Team           string        `json:"team,omitempty"`
+	Mode           string        `json:"mode"`
+	Members        []GroupMember `json:"members"`
+	Started        time.Time     `json:"started"`
+	Deadline       *time.Time    `json:"deadline,omitempty"` // When anyone who hasn't acknowledged yet is given up on
+	AcknowledgedBy string        `json:"acknowledged_by,omitempty"`
+	Acknowledged   *time.Time    `json:"acknowledged,omitempty"`
+	Completed      *time.Time    `json:"completed,omitempty"`
+	Outcome        string        `json:"outcome,omitempty"` // acknowledged if everyone who had to did, or unacknowledged
+}
+
+// GroupMember is one person's notification in a NotificationGroup.  Its state, outcome and end aren't stored;
+// they're filled in from the notification when the group is shown.
+type GroupMember struct {
+	Username string     `json:"username"`
+	UUID     string     `json:"uuid"`
+	State    string     `json:"state,omitempty"`
+	Outcome  string     `json:"outcome,omitempty"`
+	Ended    *time.Time `json:"ended,omitempty"`
+}
+
+// Serializes changes to stored groups, so that only one person can take a group
+var groupsMu sync.Mutex
+
+func (g *NotificationGroup) Marshal() ([]byte, error) {
+	jg, err := json.Marshal(g)
+	return jg, err
+}
+
+func (g *NotificationGroup) Unmarshal(jg string) error {
+	err := json.Unmarshal([]byte(jg), g)
+	return err
+}
+
+// Fetch a NotificationGroup from the DB
+func (c *ChickenLittle) GetNotificationGroup(id string) (*NotificationGroup, error) {
+	jg, err := c.DB.Fetch("groups", id)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch notification group from DB: %v", err)
+	}
+
+	g := &NotificationGroup{}
+
+	err = g.Unmarshal(jg)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal notification group from DB.  Err: %v  JSON: %v", err, jg)
+	}
+
+	return g, nil
+}
+
+// Store a NotificationGroup in the DB
+func (c *ChickenLittle) StoreNotificationGroup(g *NotificationGroup) error {
+	jg, err := g.Marshal()
+	if err != nil {
+		return fmt.Errorf("Could not marshal notification group %+v", g)
+	}
+
+	err = c.DB.Store("groups", g.UUID, string(jg))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Records that a group member has acknowledged their notification.  If the first acknowledgement takes the
+// group, everyone else's notifications are stopped.  If someone else got there first, their username is
+// returned and recorded as having taken this notification.  Otherwise it's "".
+func acknowledgeGroup(nr *NotificationRequest, log *Logger) string {
+	username := nr.Plan.Username
+
+	groupsMu.Lock()
+	g, err := c.GetNotificationGroup(nr.Group)
+	if err != nil {
+		groupsMu.Unlock()
+		log.Error("Could not fetch notification group", "group", nr.Group, "err", err)
+		return ""
+	}
+	if g.Mode == GroupModeAll || g.AcknowledgedBy == username {
+		groupsMu.Unlock()
+		return ""
+	}
+	if g.AcknowledgedBy != "" {
+		groupsMu.Unlock()
+		log.Info("Group was already taken", "group", nr.Group, "taken_by", g.AcknowledgedBy)
+
+		NIP.Mu.Lock()
+		if s, exists := NIP.Status[nr.Plan.ID.String()]; exists {
+			s.StopOutcome = OutcomeTaken
+			s.TakenBy = g.AcknowledgedBy
+		}
+		NIP.Mu.Unlock()
+
+		return g.AcknowledgedBy
+	}
+
+	now := time.Now()
+	g.AcknowledgedBy = username
+	g.Acknowledged = &now
+
+	err = c.StoreNotificationGroup(g)
+	groupsMu.Unlock()
+	if err != nil {
+		log.Error("Could not store notification group", "group", nr.Group, "err", err)
+	}
+
+	log.Info("Group taken", "group", nr.Group)
+
+	for _, m := range g.Members {
+		if m.Username != username {
+			stopGroupMember(m.UUID, OutcomeTaken, username)
+		}
+	}
+
+	return ""
+}
+
+// Stops a group member's notification, if it's still in progress, ending it with outcome instead of as an
+// acknowledgement
+func stopGroupMember(uuid, outcome, takenBy string) {
+	// Notifications that are checkpointed now are dealt with when they're resumed
+	if draining() {
+		return
+	}
+
+	NIP.Mu.Lock()
+	s, exists := NIP.Status[uuid]
+	if exists {
+		s.StopOutcome = outcome
+		s.TakenBy = takenBy
+	}
+	NIP.Mu.Unlock()
+
+	if exists {
+		stopChan <- uuid
+		return
+	}
+
+	// A member who's being held back by a maintenance window won't be notified after all
+	endSuppressed(uuid, outcome, takenBy)
+}
+
+// Gives up on everyone in a group who hasn't acknowledged by its deadline
+func expireGroup(id string) {
+	g, err := c.GetNotificationGroup(id)
+	if err != nil || g.Completed != nil {
+		return
+	}
+
+	logger.Info("Group timed out", "group", id)
+
+	for _, m := range g.Members {
+		stopGroupMember(m.UUID, OutcomeUnacknowledged, "")
+	}
+}
+
+// Arranges for a group to be expired at its deadline
+func scheduleGroupExpiry(g *NotificationGroup) {
+	if g.Deadline == nil {
+		return
+	}
+
+	id := g.UUID
+	time.AfterFunc(time.Until(*g.Deadline), func() { expireGroup(id) })
+}
+
+// Completes a group once none of its members' notifications are in progress any more
+func groupMemberEnded(id string) {
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+
+	g, err := c.GetNotificationGroup(id)
+	if err != nil || g.Completed != nil {
+		return
+	}
+
+	g.Outcome = OutcomeAcknowledged
+	allSuppressed := true
+	for _, m := range g.Members {
+		if notificationInProgress(m.UUID) {
+			return
+		}
+
+		// Without a record, it hasn't been started (or resumed) yet
+		rec, err := c.GetNotificationRecord(m.UUID)
+		if err != nil {
+			return
+		}
+		if rec.Outcome != OutcomeAcknowledged && rec.Outcome != OutcomeResolved && rec.Outcome != OutcomeTaken {
+			g.Outcome = OutcomeUnacknowledged
+		}
+		if rec.Outcome != OutcomeSuppressed && rec.Outcome != OutcomeThrottled {
+			allSuppressed = false
+		}
+	}
+
+	// Nobody was notified at all
+	if allSuppressed {
+		g.Outcome = OutcomeSuppressed
+	}
+
+	// In GroupModeFirst, one acknowledgement is enough
+	if g.Mode != GroupModeAll && g.AcknowledgedBy != "" {
+		g.Outcome = OutcomeAcknowledged
+	}
+
+	now := time.Now()
+	g.Completed = &now
+
+	err = c.StoreNotificationGroup(g)
+	if err != nil {
+		logger.Error("Could not store notification group", "group", id, "err", err)
+		return
+	}
+
+	logger.Info("Group completed", "group", id, "outcome", g.Outcome)
+}
+
+// Reports whether a notification is in the notifications-in-progress (NIP) store
+func notificationInProgress(uuid string) bool {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	_, exists := NIP.Stoppers[uuid]
+	return exists
+}
+
+// Tells the person being notified that someone else in their group, takenBy, took the incident.  We use
+// whichever method last reached them, except that a phone number gets a text instead of another call.
+func tellTaken(uuid, takenBy string, log *Logger) {
+	NIP.Mu.Lock()
+	var last string
+	if s, exists := NIP.Status[uuid]; exists {
+		last = s.LastMethod
+	}
+	NIP.Mu.Unlock()
+
+	if last == "" {
+		return
+	}
+
+	u, err := url.Parse(last)
+	if err != nil {
+		return
+	}
+
+	d := messageData(uuid)
+	d.TakenBy = takenBy
+	if p, err := c.GetPerson(takenBy); err == nil && p.FullName != "" {
+		d.TakenBy = p.FullName
+	}
+
+	switch u.Scheme {
+	case "phone", "sms":
+		err = SendSMS(u.Host, RenderMessage("sms_taken", d), uuid, true)
+	case "email":
+		err = SendEmailNotice(fmt.Sprint(u.User, "@", u.Host), RenderMessage("email_taken_subject", d), RenderMessage("email_taken_text", d), uuid)
+	}
+	if err != nil {
+		log.Error("Could not tell person that the group was taken", "scheme", u.Scheme, "err", err)
+	}
+}
+
+// Fills in the state, outcome and end of each member's notification
+func (g *NotificationGroup) memberStatus() {
+	for i, m := range g.Members {
+		NIP.Mu.Lock()
+		s, exists := NIP.Status[m.UUID]
+		if exists {
+			g.Members[i].State = s.State
+		}
+		NIP.Mu.Unlock()
+
+		if exists {
+			continue
+		}
+
+		if rec, err := c.GetNotificationRecord(m.UUID); err == nil {
+			g.Members[i].State = StateEnded
+			g.Members[i].Outcome = rec.Outcome
+			g.Members[i].Ended = &rec.Ended
+		} else if _, err := c.GetSuppressedNotification(m.UUID); err == nil {
+			g.Members[i].State = StateSuppressed
+		}
+	}
+}
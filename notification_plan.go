@@ -3,6 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/twinj/uuid"
@@ -13,15 +18,325 @@ type (
 )
 
 type NotificationStep struct {
-	Method            string        `json:"method"`
+	Method            string        `json:"method,omitempty"`
+	Methods           []string      `json:"methods,omitempty"` // Contacted all at once, instead of Method
 	NotifyEveryPeriod time.Duration `json:"notify_every_period"`
 	NotifyUntilPeriod time.Duration `json:"notify_until_period"`
+	MaxAttempts       int           `json:"max_attempts,omitempty"` // Only used on the last step, which otherwise repeats forever
+	MaxDuration       time.Duration `json:"max_duration,omitempty"` // Ditto
+	VoiceOptions      *VoiceOptions `json:"voice_options,omitempty"`
+}
+
+// Returns every method of a step, whether it has one or several
+func (s *NotificationStep) AllMethods() []string {
+	if len(s.Methods) > 0 {
+		return s.Methods
+	}
+	return []string{s.Method}
+}
+
+// The schemes of a step's methods (e.g. "sms,email"), which are safe to log without the addresses
+func (s *NotificationStep) schemes() string {
+	var schemes []string
+	for _, m := range s.AllMethods() {
+		schemes = append(schemes, methodScheme(m))
+	}
+	return strings.Join(schemes, ",")
+}
+
+// What to do when the last step of a plan runs out of attempts, or can't be completed at all
+const (
+	ExhaustedStop     = "stop"     // Just stop notifying
+	ExhaustedEscalate = "escalate" // Notify a fallback person with their own plan
+	ExhaustedWebhook  = "webhook"  // POST the notification record to a URL
+)
+
+// ExhaustedAction is what a plan does when its person never acknowledges a notification
+type ExhaustedAction struct {
+	Action   string `json:"action"`
+	Username string `json:"username,omitempty"` // The fallback person, for ExhaustedEscalate
+	URL      string `json:"url,omitempty"`      // For ExhaustedWebhook
+}
+
+// The shortest notify_every_period or notify_until_period that a step can have.  Anything shorter is almost
+// certainly a mistake, like a period given in nanoseconds, and would flood the person with notifications.
+var minStepPeriod = time.Minute
+
+// Periods are written as Go duration strings like "5m" or "1h30m".  Plans from before that were written in
+// nanoseconds, so we read either.  They're held to the same minimums, so a bare 15 that was meant as minutes is
+// refused rather than taken as 15ns.
+type planDuration time.Duration
+
+func (d planDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(formatDuration(time.Duration(d)))
+}
+
+func (d *planDuration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		*d = 0
+	case float64:
+		if v != float64(int64(v)) {
+			return fmt.Errorf("%v is not a whole number of nanoseconds", v)
+		}
+		*d = planDuration(v)
+	case string:
+		pd, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like \"5m\" or \"1h30m\"", v)
+		}
+		*d = planDuration(pd)
+	default:
+		return fmt.Errorf("%s is not a duration like \"5m\" or \"1h30m\"", b)
+	}
+
+	return nil
+}
+
+// The fields of a plan, plan template or group request that hold periods
+var periodFields = map[string]bool{"notify_every_period": true, "notify_until_period": true, "max_duration": true, "timeout": true}
+
+// Warns about any periods in the body of an API request that are given in nanoseconds, which are deprecated.
+// Periods read from the DB aren't worth a warning, since they're migrated at startup.
+func warnNanosecondPeriods(body []byte) {
+	var v interface{}
+	if json.Unmarshal(body, &v) != nil {
+		return
+	}
+
+	var found []string
+	findNanosecondPeriods(v, &found)
+	if len(found) == 0 {
+		return
+	}
+
+	sort.Strings(found)
+	logger.Warn("Periods given in nanoseconds are deprecated.  Use a duration like \"5m\" instead.", "periods", strings.Join(found, ", "))
+}
+
+func findNanosecondPeriods(v interface{}, found *[]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if n, ok := e.(float64); ok && n != 0 && periodFields[k] {
+				*found = append(*found, fmt.Sprint(k, "=", int64(n), " (", formatDuration(time.Duration(n)), ")"))
+				continue
+			}
+			findNanosecondPeriods(e, found)
+		}
+	case []interface{}:
+		for _, e := range v {
+			findNanosecondPeriods(e, found)
+		}
+	}
+}
+
+// Formats a duration without the zero units that time.Duration.String() leaves on the end, e.g. "1h" instead
+// of "1h0m0s"
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// The JSON form of a NotificationStep, with its periods as duration strings
+type notificationStepJSON struct {
+	Method            string        `json:"method,omitempty"`
+	Methods           []string      `json:"methods,omitempty"`
+	NotifyEveryPeriod planDuration  `json:"notify_every_period"`
+	NotifyUntilPeriod planDuration  `json:"notify_until_period"`
+	MaxAttempts       int           `json:"max_attempts,omitempty"`
+	MaxDuration       planDuration  `json:"max_duration,omitempty"`
+	VoiceOptions      *VoiceOptions `json:"voice_options,omitempty"`
+}
+
+func (s NotificationStep) MarshalJSON() ([]byte, error) {
+	return json.Marshal(notificationStepJSON{
+		Method:            s.Method,
+		Methods:           s.Methods,
+		NotifyEveryPeriod: planDuration(s.NotifyEveryPeriod),
+		NotifyUntilPeriod: planDuration(s.NotifyUntilPeriod),
+		MaxAttempts:       s.MaxAttempts,
+		MaxDuration:       planDuration(s.MaxDuration),
+		VoiceOptions:      s.VoiceOptions,
+	})
+}
+
+func (s *NotificationStep) UnmarshalJSON(b []byte) error {
+	var js notificationStepJSON
+	err := json.Unmarshal(b, &js)
+	if err != nil {
+		return err
+	}
+
+	*s = NotificationStep{
+		Method:            js.Method,
+		Methods:           js.Methods,
+		NotifyEveryPeriod: time.Duration(js.NotifyEveryPeriod),
+		NotifyUntilPeriod: time.Duration(js.NotifyUntilPeriod),
+		MaxAttempts:       js.MaxAttempts,
+		MaxDuration:       time.Duration(js.MaxDuration),
+		VoiceOptions:      js.VoiceOptions,
+	}
+
+	return nil
 }
 
 type NotificationPlan struct {
-	ID       uuid.UUID
-	Username string             `json:"username"`
-	Steps    []NotificationStep `json:"steps,omitempty"`
+	ID          uuid.UUID
+	Username    string             `json:"username"`
+	Template    string             `json:"template,omitempty"` // A PlanTemplate that the steps come from
+	Steps       []NotificationStep `json:"steps,omitempty"`
+	OnExhausted *ExhaustedAction   `json:"on_exhausted,omitempty"`
+}
+
+// FieldError describes a problem with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Phone numbers must be in E.164 format, e.g. +12108675309
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// Checks that a method can be carried out, returning a description of the problem if it can't
+func validateMethod(method string) string {
+	u, err := url.Parse(method)
+	switch {
+	case err != nil:
+		return "must be a URI like sms://+12108675309"
+	case u.Scheme == "phone" || u.Scheme == "sms":
+		if !e164Pattern.MatchString(u.Host) {
+			return fmt.Sprintf("%v number must be in E.164 format, like +12108675309", u.Scheme)
+		}
+	case u.Scheme == "email":
+		a, err := mail.ParseAddress(fmt.Sprint(u.User, "@", u.Host))
+		if u.User == nil || err != nil || a.Name != "" {
+			return "must be a valid e-mail address, like email://lancelot@camelot.example.com"
+		}
+	default:
+		return "must use phone, sms or email"
+	}
+
+	return ""
+}
+
+// Checks that every step of a plan can be carried out, returning a FieldError for each problem
+func validateSteps(steps []NotificationStep) []FieldError {
+	var errs []FieldError
+
+	for n, s := range steps {
+		field := func(name string) string {
+			return fmt.Sprintf("steps[%v].%v", n, name)
+		}
+		add := func(name, format string, a ...interface{}) {
+			errs = append(errs, FieldError{Field: field(name), Message: fmt.Sprintf(format, a...)})
+		}
+
+		switch {
+		case len(s.Methods) == 0:
+			if msg := validateMethod(s.Method); msg != "" {
+				add("method", "%v", msg)
+			}
+		case s.Method != "":
+			add("methods", "can't be used with method")
+		default:
+			for i, m := range s.Methods {
+				if msg := validateMethod(m); msg != "" {
+					add(fmt.Sprintf("methods[%v]", i), "%v", msg)
+				}
+			}
+		}
+
+		if s.NotifyEveryPeriod < 0 {
+			add("notify_every_period", "can't be negative")
+		}
+		if s.NotifyUntilPeriod < 0 {
+			add("notify_until_period", "can't be negative")
+		}
+		if s.MaxAttempts < 0 {
+			add("max_attempts", "can't be negative")
+		}
+		if s.MaxDuration < 0 {
+			add("max_duration", "can't be negative")
+		}
+
+		// The last step repeats until it's acknowledged, while the others wait their turn and move on.  Only the
+		// last step can give up, so the limits can't go anywhere else.
+		if n == len(steps)-1 {
+			switch {
+			case s.NotifyEveryPeriod == 0:
+				add("notify_every_period", "must be positive on the last step, which repeats until acknowledged")
+			case s.NotifyEveryPeriod > 0 && s.NotifyEveryPeriod < minStepPeriod:
+				add("notify_every_period", "must be at least %v", formatDuration(minStepPeriod))
+			}
+		} else {
+			switch {
+			case s.NotifyUntilPeriod == 0:
+				add("notify_until_period", "must be positive on every step but the last")
+			case s.NotifyUntilPeriod > 0 && s.NotifyUntilPeriod < minStepPeriod:
+				add("notify_until_period", "must be at least %v", formatDuration(minStepPeriod))
+			}
+			if s.MaxAttempts != 0 {
+				add("max_attempts", "can only be set on the last step")
+			}
+			if s.MaxDuration != 0 {
+				add("max_duration", "can only be set on the last step")
+			}
+		}
+	}
+
+	return errs
+}
+
+// Checks a plan's on_exhausted action, returning a FieldError for each problem.  username is the person
+// that the plan belongs to.
+func validateOnExhausted(oe *ExhaustedAction, username string) []FieldError {
+	var errs []FieldError
+
+	if oe == nil {
+		return nil
+	}
+
+	add := func(name, format string, a ...interface{}) {
+		errs = append(errs, FieldError{Field: "on_exhausted." + name, Message: fmt.Sprintf(format, a...)})
+	}
+
+	switch oe.Action {
+	case ExhaustedStop:
+	case ExhaustedEscalate:
+		switch {
+		case oe.Username == "":
+			add("username", "must name the person to notify instead")
+		case oe.Username == username:
+			add("username", "can't be the person who didn't respond")
+		default:
+			// The stored plan is enough, and filling in its template could lead back here
+			if _, err := c.getStoredNotificationPlan(oe.Username); err != nil {
+				add("username", "%v has no notification plan", oe.Username)
+			}
+		}
+	case ExhaustedWebhook:
+		u, err := url.Parse(oe.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("url", "must be an http or https URL")
+		}
+	default:
+		add("action", "must be stop, escalate or webhook")
+	}
+
+	return errs
 }
 
 func (np *NotificationPlan) Marshal() ([]byte, error) {
@@ -34,8 +349,41 @@ func (np *NotificationPlan) Unmarshal(jnp string) error {
 	return err
 }
 
-// Fetch a NotificationPlan from the DB
+// Fetch a NotificationPlan from the DB.  If the plan uses a template, its steps are filled in from the template.
 func (c *ChickenLittle) GetNotificationPlan(username string) (*NotificationPlan, error) {
+	plan, err := c.getStoredNotificationPlan(username)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.applyPlanTemplate(plan)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// Fetch every NotificationPlan from the DB, with the steps of those that use templates filled in
+func (c *ChickenLittle) GetAllNotificationPlans() ([]*NotificationPlan, error) {
+	plans, err := c.getStoredNotificationPlans()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, plan := range plans {
+		// One broken plan shouldn't hide the rest.  It's left without steps.
+		err = c.applyPlanTemplate(plan)
+		if err != nil {
+			logger.Warn("Could not apply plan template", "username", plan.Username, "template", plan.Template, "err", err)
+		}
+	}
+
+	return plans, nil
+}
+
+// Fetch a NotificationPlan from the DB as it's stored, without filling in its template
+func (c *ChickenLittle) getStoredNotificationPlan(username string) (*NotificationPlan, error) {
 	jp, err := c.DB.Fetch("notificationplans", username)
 	if err != nil {
 		return nil, fmt.Errorf("Could not fetch notification plan from DB: plan for %v does not exist", username)
@@ -51,8 +399,74 @@ func (c *ChickenLittle) GetNotificationPlan(username string) (*NotificationPlan,
 	return plan, nil
 }
 
+// Fetch every NotificationPlan from the DB as it's stored
+func (c *ChickenLittle) getStoredNotificationPlans() ([]*NotificationPlan, error) {
+	var plans []*NotificationPlan
+
+	jps, err := c.DB.FetchAll("notificationplans")
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch notification plans from DB: %v", err)
+	}
+
+	for _, jp := range jps {
+		plan := &NotificationPlan{}
+
+		err = plan.Unmarshal(jp)
+		if err != nil {
+			return nil, fmt.Errorf("Could not unmarshal notification plan from DB.  Err: %v  JSON: %v", err, jp)
+		}
+
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
+
+// Fills in the steps and on_exhausted action of a plan that uses a template, for the plan's person.  The template's
+// on_exhausted action is checked again for them, since it was only checked for the people using the template when
+// it was saved.  If it doesn't work for them, say because it escalates to someone whose plan was deleted since, it's
+// left out rather than costing them their whole plan.
+func (c *ChickenLittle) applyPlanTemplate(plan *NotificationPlan) error {
+	if plan.Template == "" {
+		return nil
+	}
+
+	pt, err := c.GetPlanTemplate(plan.Template)
+	if err != nil {
+		return fmt.Errorf("Notification plan for %v uses plan template %v, which does not exist", plan.Username, plan.Template)
+	}
+
+	p, err := c.GetPerson(plan.Username)
+	if err != nil {
+		p = &Person{Username: plan.Username}
+	}
+
+	steps, errs := pt.StepsFor(p)
+	if len(errs) > 0 {
+		return fmt.Errorf("Notification plan for %v can't use plan template %v: %v", plan.Username, plan.Template, describeFieldErrors(errs))
+	}
+
+	plan.Steps = steps
+	plan.OnExhausted = pt.OnExhausted
+
+	if errs := validateOnExhausted(pt.OnExhausted, plan.Username); len(errs) > 0 {
+		logger.Warn("Plan template's on_exhausted action can't be used for this person.  Leaving it out.", "username", plan.Username, "template", plan.Template, "err", describeFieldErrors(errs))
+		plan.OnExhausted = nil
+	}
+
+	return nil
+}
+
 // Store a NotificationPlan in the DB
 func (c *ChickenLittle) StoreNotificationPlan(p *NotificationPlan) error {
+	// Plans that use a template only store its name, so that edits to the template reach them
+	if p.Template != "" {
+		tp := *p
+		tp.Steps = nil
+		tp.OnExhausted = nil
+		p = &tp
+	}
+
 	jp, err := p.Marshal()
 	if err != nil {
 		return fmt.Errorf("Could not marshal person %+v", p)
@@ -66,6 +480,43 @@ func (c *ChickenLittle) StoreNotificationPlan(p *NotificationPlan) error {
 	return nil
 }
 
+// Rewrites any stored plans whose periods are still in nanoseconds, so that they read like new ones.  Returns
+// the number of plans that were rewritten.
+func (c *ChickenLittle) MigrateNotificationPlans() (int, error) {
+	// FetchAll fails when there are no plans yet, in which case there's nothing to do
+	jps, err := c.DB.FetchAll("notificationplans")
+	if err != nil {
+		return 0, nil
+	}
+
+	var migrated int
+	for _, jp := range jps {
+		plan := &NotificationPlan{}
+
+		err = plan.Unmarshal(jp)
+		if err != nil {
+			return migrated, fmt.Errorf("Could not unmarshal notification plan from DB.  Err: %v  JSON: %v", err, jp)
+		}
+
+		newjp, err := plan.Marshal()
+		if err != nil {
+			return migrated, fmt.Errorf("Could not marshal notification plan for %v: %v", plan.Username, err)
+		}
+		if string(newjp) == jp {
+			continue
+		}
+		logger.Info("Migrating notification plan from nanosecond periods", "username", plan.Username)
+
+		err = c.StoreNotificationPlan(plan)
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
 // Delete a NotificationPlan from the DB
 func (c *ChickenLittle) DeleteNotificationPlan(username string) error {
 	err := c.DB.Delete("notificationplans", username)
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// How a notification ended
+const (
+	OutcomeAcknowledged   = "acknowledged"   // Someone acknowledged or stopped it
+	OutcomeUnacknowledged = "unacknowledged" // The plan ran out of attempts
+	OutcomeFailed         = "failed"         // The last step of the plan couldn't be carried out
+	OutcomeTaken          = "taken"          // Someone else in its group acknowledged it first
+	OutcomeResolved       = "resolved"       // It was acknowledged for a while, and stopped before it was re-triggered
+	OutcomeSuppressed     = "suppressed"     // A maintenance window kept it from being delivered
+	OutcomeThrottled      = "throttled"      // It was over a rate limit, and folded into a summary
+)
+
+// NotificationRecord is what we keep of a notification once it's over
+type NotificationRecord struct {
+	UUID     string `json:"uuid"`
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	ContentFields
+	Outcome      string    `json:"outcome"`
+	Step         int       `json:"step"`
+	Attempts     int       `json:"attempts"` // Contact attempts at the last step reached
+	Escalations  int       `json:"escalations"`
+	Retriggers   int       `json:"retriggers,omitempty"`
+	Started      time.Time `json:"started"`
+	Ended        time.Time `json:"ended"`
+	FallbackFor  string    `json:"fallback_for,omitempty"`  // The notification that gave up and started this one
+	FallbackUUID string    `json:"fallback_uuid,omitempty"` // The notification that this one started when it gave up
+	Group        string    `json:"group,omitempty"`
+	TakenBy      string    `json:"taken_by,omitempty"`
+	Window       string    `json:"window,omitempty"`  // The maintenance window that suppressed it
+	Summary      string    `json:"summary,omitempty"` // The summary notification that a throttled notification was folded into
+}
+
+func (nr *NotificationRecord) Marshal() ([]byte, error) {
+	jnr, err := json.Marshal(nr)
+	return jnr, err
+}
+
+func (nr *NotificationRecord) Unmarshal(jnr string) error {
+	err := json.Unmarshal([]byte(jnr), nr)
+	return err
+}
+
+// Fetch a NotificationRecord from the DB
+func (c *ChickenLittle) GetNotificationRecord(id string) (*NotificationRecord, error) {
+	jnr, err := c.DB.Fetch("notifications", id)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch notification record from DB: %v", err)
+	}
+
+	nr := &NotificationRecord{}
+
+	err = nr.Unmarshal(jnr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal notification record from DB.  Err: %v  JSON: %v", err, jnr)
+	}
+
+	return nr, nil
+}
+
+// Store a NotificationRecord in the DB
+func (c *ChickenLittle) StoreNotificationRecord(nr *NotificationRecord) error {
+	jnr, err := nr.Marshal()
+	if err != nil {
+		return fmt.Errorf("Could not marshal notification record %+v", nr)
+	}
+
+	err = c.DB.Store("notifications", nr.UUID, string(jnr))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Builds a record of a notification-in-progress as if it ended now, or returns nil if there's no such notification
+func notificationRecord(uuid, outcome string) *NotificationRecord {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	nr, exists := NIP.Requests[uuid]
+	if !exists {
+		return nil
+	}
+
+	rec := &NotificationRecord{
+		UUID:          uuid,
+		Username:      nr.Plan.Username,
+		Content:       nr.Content,
+		ContentFields: nr.ContentFields,
+		Outcome:       outcome,
+		Step:          NIP.Steps[uuid],
+		Ended:         time.Now(),
+		FallbackFor:   nr.FallbackFor,
+		Group:         nr.Group,
+		Window:        nr.Window,
+	}
+	if s, exists := NIP.Status[uuid]; exists {
+		rec.Attempts = s.Attempts
+		rec.Escalations = s.Escalations
+		rec.Retriggers = s.Retriggers
+		rec.Started = s.Started
+		rec.FallbackUUID = s.FallbackUUID
+		rec.TakenBy = s.TakenBy
+	}
+
+	return rec
+}
@@ -3,13 +3,25 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Person struct {
-	Username            string `yaml:"username" json:"username"`
-	FullName            string `yaml:"full_name" json:"fullname"`
-	VictorOpsRoutingKey string `yaml:"victorops_routing_key" json:"victorops_routing_key,omitempty"`
+	Username            string        `yaml:"username" json:"username"`
+	FullName            string        `yaml:"full_name" json:"fullname"`
+	Phone               string        `yaml:"phone" json:"phone,omitempty"` // For {{phone}} in plan templates
+	Email               string        `yaml:"email" json:"email,omitempty"` // For {{email}} in plan templates
+	VictorOpsRoutingKey string        `yaml:"victorops_routing_key" json:"victorops_routing_key,omitempty"`
+	Language            string        `yaml:"language" json:"language,omitempty"`
+	VoiceOptions        *VoiceOptions `yaml:"voice_options" json:"voice_options,omitempty"`
+
+	// A PIN is accepted through the API, but only its bcrypt hash is stored, and neither is ever shown.  PINs
+	// stored before they were hashed are left in PIN until the person is updated.
+	PIN       string `yaml:"pin" json:"pin,omitempty"`
+	PINHash   string `yaml:"-" json:"pin_hash,omitempty"`
+	HasPIN    bool   `yaml:"-" json:"has_pin"`              // Only set when a person is shown through the API
+	RemovePIN bool   `yaml:"-" json:"remove_pin,omitempty"` // Set when updating a person to remove their PIN
 }
 
 func (p *Person) Marshal() ([]byte, error) {
@@ -22,6 +34,41 @@ func (p *Person) Unmarshal(jp string) error {
 	return err
 }
 
+// The PIN that digits entered during a call are checked against: its hash, or the PIN itself if it was stored
+// before PINs were hashed
+func (p *Person) storedPIN() string {
+	if p.PINHash != "" {
+		return p.PINHash
+	}
+	return p.PIN
+}
+
+// Hashes a new PIN, so that it's never stored as it was entered
+func (p *Person) hashPIN() error {
+	if p.PIN == "" {
+		return nil
+	}
+
+	h, err := bcrypt.GenerateFromPassword([]byte(p.PIN), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("Could not hash pin: %v", err)
+	}
+
+	p.PINHash = string(h)
+	p.PIN = ""
+
+	return nil
+}
+
+// How a Person is shown through the API.  Their PIN isn't shown, only whether they have one.
+func (p Person) public() Person {
+	p.HasPIN = p.storedPIN() != ""
+	p.PIN = ""
+	p.PINHash = ""
+	p.RemovePIN = false
+	return p
+}
+
 // Fetch a Person from the DB
 func (c *ChickenLittle) GetPerson(p string) (*Person, error) {
 	jp, err := c.DB.Fetch("people", p)
@@ -45,7 +92,7 @@ func (c *ChickenLittle) GetAllPeople() ([]*Person, error) {
 
 	jp, err := c.DB.FetchAll("people")
 	if err != nil {
-		log.Println("Error fetching all people from DB:", err, "(Have you added any people?)")
+		logger.Debug("Could not fetch all people from DB.  Have you added any people?", "err", err)
 		return nil, fmt.Errorf("Could not fetch all people from DB")
 	}
 
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PlanTemplate is a named set of notification steps that several people's plans can share.  Its methods can
+// use placeholders like {{phone}}, which are filled in from each person's contact info.
+type PlanTemplate struct {
+	Name        string             `json:"name"`
+	Steps       []NotificationStep `json:"steps"`
+	OnExhausted *ExhaustedAction   `json:"on_exhausted,omitempty"`
+}
+
+// The placeholders that a plan template's methods can use, and the contact info that fills them in
+var planPlaceholders = map[string]struct {
+	what  string
+	value func(p *Person) string
+}{
+	"phone": {"phone number", func(p *Person) string { return p.Phone }},
+	"email": {"e-mail address", func(p *Person) string { return p.Email }},
+}
+
+var planPlaceholderPattern = regexp.MustCompile(`\{\{\s*(\w*)\s*\}\}`)
+
+// Who we pretend a template is for when checking that its steps make sense
+var samplePerson = &Person{Username: "sample", Phone: "+12108675309", Email: "sample@camelot.example.com"}
+
+// Fills in the placeholders of a method for Person p, returning a description of the problem if it can't be done
+func resolveMethod(method string, p *Person) (string, string) {
+	var problem string
+
+	resolved := planPlaceholderPattern.ReplaceAllStringFunc(method, func(ph string) string {
+		name := planPlaceholderPattern.FindStringSubmatch(ph)[1]
+
+		pl, exists := planPlaceholders[name]
+		switch {
+		case !exists:
+			problem = fmt.Sprintf("%v is not a placeholder.  Use {{phone}} or {{email}}.", ph)
+		case pl.value(p) == "":
+			problem = fmt.Sprintf("uses %v but %v has no %v", ph, p.Username, pl.what)
+		default:
+			return pl.value(p)
+		}
+
+		return ph
+	})
+
+	return resolved, problem
+}
+
+// Returns the template's steps with their placeholders filled in for Person p, or a FieldError for each
+// method that can't be filled in
+func (pt *PlanTemplate) StepsFor(p *Person) ([]NotificationStep, []FieldError) {
+	var errs []FieldError
+
+	steps := make([]NotificationStep, len(pt.Steps))
+
+	for n, s := range pt.Steps {
+		steps[n] = s
+
+		if s.Method != "" {
+			m, problem := resolveMethod(s.Method, p)
+			if problem != "" {
+				errs = append(errs, FieldError{Field: fmt.Sprintf("steps[%v].method", n), Message: problem})
+			}
+			steps[n].Method = m
+		}
+
+		if len(s.Methods) > 0 {
+			steps[n].Methods = make([]string, len(s.Methods))
+			for i, method := range s.Methods {
+				m, problem := resolveMethod(method, p)
+				if problem != "" {
+					errs = append(errs, FieldError{Field: fmt.Sprintf("steps[%v].methods[%v]", n, i), Message: problem})
+				}
+				steps[n].Methods[i] = m
+			}
+		}
+	}
+
+	return steps, errs
+}
+
+// Checks that a template's placeholders are ones we know and that its steps make sense once they're filled in
+func (pt *PlanTemplate) Validate() []FieldError {
+	steps, errs := pt.StepsFor(samplePerson)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return append(validateSteps(steps), validateOnExhausted(pt.OnExhausted, "")...)
+}
+
+func (pt *PlanTemplate) Marshal() ([]byte, error) {
+	jpt, err := json.Marshal(pt)
+	return jpt, err
+}
+
+func (pt *PlanTemplate) Unmarshal(jpt string) error {
+	err := json.Unmarshal([]byte(jpt), pt)
+	return err
+}
+
+// Fetch a PlanTemplate from the DB
+func (c *ChickenLittle) GetPlanTemplate(name string) (*PlanTemplate, error) {
+	jpt, err := c.DB.Fetch("plantemplates", name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch plan template from DB: template %v does not exist", name)
+	}
+
+	pt := &PlanTemplate{}
+
+	err = pt.Unmarshal(jpt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal plan template from DB.  Err: %v  JSON: %v", err, jpt)
+	}
+
+	return pt, nil
+}
+
+// Fetch every PlanTemplate from the DB
+func (c *ChickenLittle) GetAllPlanTemplates() ([]*PlanTemplate, error) {
+	var templates []*PlanTemplate
+
+	jpts, err := c.DB.FetchAll("plantemplates")
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch plan templates from DB: %v", err)
+	}
+
+	for _, jpt := range jpts {
+		pt := &PlanTemplate{}
+
+		err = pt.Unmarshal(jpt)
+		if err != nil {
+			return nil, fmt.Errorf("Could not unmarshal plan template from DB.  Err: %v  JSON: %v", err, jpt)
+		}
+
+		templates = append(templates, pt)
+	}
+
+	return templates, nil
+}
+
+// Store a PlanTemplate in the DB
+func (c *ChickenLittle) StorePlanTemplate(pt *PlanTemplate) error {
+	jpt, err := pt.Marshal()
+	if err != nil {
+		return fmt.Errorf("Could not marshal plan template %+v", pt)
+	}
+
+	err = c.DB.Store("plantemplates", pt.Name, string(jpt))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete a PlanTemplate from the DB
+func (c *ChickenLittle) DeletePlanTemplate(name string) error {
+	err := c.DB.Delete("plantemplates", name)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the usernames of everyone whose plan uses a template, in order
+func (c *ChickenLittle) PlanTemplateUsers(name string) ([]string, error) {
+	var users []string
+
+	plans, err := c.getStoredNotificationPlans()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range plans {
+		if p.Template == name {
+			users = append(users, p.Username)
+		}
+	}
+	sort.Strings(users)
+
+	return users, nil
+}
+
+// Describes a list of FieldErrors in a sentence
+func describeFieldErrors(errs []FieldError) string {
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Field+" "+e.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
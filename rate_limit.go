@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+)
+
+const defaultRateLimitPeriod = time.Hour
+
+// Counts the notifications that have been started recently, and the ones that were throttled because there were
+// too many.  Throttled requests don't page anyone.  Each person gets a single summary of theirs when the period
+// that they were throttled in is up.
+type rateLimiter struct {
+	mu        sync.Mutex
+	started   map[string][]time.Time // Start times within the period, by username
+	all       []time.Time            // Start times within the period, for everyone
+	summaries map[string]*throttleSummary
+}
+
+// The requests that have been throttled for a person since their last summary.  It's kept in the DB until it's
+// sent, so that it isn't lost if we're restarted in the meantime.
+type throttleSummary struct {
+	UUID     string    `json:"uuid"` // The summary notification is started with this UUID
+	Username string    `json:"username"`
+	Count    int       `json:"count"`
+	Latest   string    `json:"latest"` // The title of the last request that was throttled
+	Due      time.Time `json:"due"`
+}
+
+var limiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		started:   make(map[string][]time.Time),
+		summaries: make(map[string]*throttleSummary),
+	}
+}
+
+func (s *throttleSummary) Marshal() ([]byte, error) {
+	js, err := json.Marshal(s)
+	return js, err
+}
+
+func (s *throttleSummary) Unmarshal(js string) error {
+	err := json.Unmarshal([]byte(js), s)
+	return err
+}
+
+// Fetch every throttle summary that's waiting to be sent from the DB
+func (c *ChickenLittle) GetThrottleSummaries() ([]*throttleSummary, error) {
+	var ss []*throttleSummary
+
+	jss, err := c.DB.FetchAll("summaries")
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch throttle summaries from DB: %v", err)
+	}
+
+	for _, js := range jss {
+		s := &throttleSummary{}
+
+		err = s.Unmarshal(js)
+		if err != nil {
+			return nil, fmt.Errorf("Could not unmarshal throttle summary from DB.  Err: %v  JSON: %v", err, js)
+		}
+
+		ss = append(ss, s)
+	}
+
+	return ss, nil
+}
+
+// Store a throttle summary in the DB
+func (c *ChickenLittle) StoreThrottleSummary(s *throttleSummary) error {
+	js, err := s.Marshal()
+	if err != nil {
+		return fmt.Errorf("Could not marshal throttle summary %+v", s)
+	}
+
+	err = c.DB.Store("summaries", s.UUID, string(js))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete a throttle summary from the DB
+func (c *ChickenLittle) DeleteThrottleSummary(id string) error {
+	err := c.DB.Delete("summaries", id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Drops the start times that are older than the period
+func prune(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	return times[i:]
+}
+
+// Checks a new notification for a person against the limits.  If it's allowed, it's counted and "" is returned.
+// Otherwise the name of the limit that it's over is returned, and nothing is counted.
+func (rl *rateLimiter) allow(username string, cfg RateLimitConfig) string {
+	if cfg.PerPerson == 0 && cfg.Global == 0 {
+		return ""
+	}
+
+	period := cfg.Period
+	if period == 0 {
+		period = defaultRateLimitPeriod
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	since := now.Add(-period)
+	rl.started[username] = prune(rl.started[username], since)
+	rl.all = prune(rl.all, since)
+
+	if cfg.PerPerson > 0 && len(rl.started[username]) >= cfg.PerPerson {
+		return SuppressedByPersonLimit
+	}
+	if cfg.Global > 0 && len(rl.all) >= cfg.Global {
+		return SuppressedByGlobalLimit
+	}
+
+	rl.count(username, now)
+
+	return ""
+}
+
+// Counts a notification that was started for a person.  rl.mu must be held.
+func (rl *rateLimiter) count(username string, t time.Time) {
+	rl.started[username] = append(rl.started[username], t)
+	rl.all = append(rl.all, t)
+}
+
+// Folds a throttled request into the person's next summary, returning the summary's UUID.  The first request
+// that's throttled schedules the summary for the end of the period.
+func (rl *rateLimiter) throttle(username, title string, cfg RateLimitConfig) string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	s, exists := rl.summaries[username]
+	if !exists {
+		period := cfg.Period
+		if period == 0 {
+			period = defaultRateLimitPeriod
+		}
+
+		s = &throttleSummary{UUID: uuid.NewV4().String(), Username: username, Due: time.Now().Add(period)}
+		rl.summaries[username] = s
+		rl.schedule(s)
+	}
+
+	s.Count++
+	s.Latest = title
+
+	err := c.StoreThrottleSummary(s)
+	if err != nil {
+		logger.Error("Could not store throttle summary", "uuid", s.UUID, "username", username, "err", err)
+	}
+
+	return s.UUID
+}
+
+// Arranges for a summary to be sent when it's due
+func (rl *rateLimiter) schedule(s *throttleSummary) {
+	time.AfterFunc(time.Until(s.Due), func() { rl.sendSummary(s) })
+}
+
+// The number of throttled requests that are waiting for a summary
+func (rl *rateLimiter) pending() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	n := 0
+	for _, s := range rl.summaries {
+		n += s.Count
+	}
+	return n
+}
+
+// Starts a person's summary notification for the requests that were throttled.  The summary isn't subject to the
+// limits, but it counts towards them.
+func (rl *rateLimiter) sendSummary(s *throttleSummary) {
+	username := s.Username
+
+	// Anything throttled from now on goes in the next summary
+	rl.mu.Lock()
+	if rl.summaries[username] == s {
+		delete(rl.summaries, username)
+	}
+	rl.count(username, time.Now())
+	rl.mu.Unlock()
+
+	nlog := logger.With("uuid", s.UUID, "username", username, "throttled", s.Count)
+
+	nr, err := s.request()
+	if err != nil {
+		nlog.Error("Could not send summary of throttled notifications", "err", err)
+		c.DeleteThrottleSummary(s.UUID)
+		return
+	}
+
+	// The engine isn't taking new notifications.  The summary stays in the DB, to be sent when we start up again.
+	if draining() || !startNotification(nr) {
+		nlog.Info("Shutting down.  Leaving summary of throttled notifications for the restart.")
+		return
+	}
+
+	nlog.Info("Sent summary of throttled notifications")
+	metrics.ThrottleSummaries.Inc()
+
+	err = c.DeleteThrottleSummary(s.UUID)
+	if err != nil {
+		nlog.Error("Could not delete throttle summary", "err", err)
+	}
+}
+
+// Builds the request that starts a summary notification
+func (s *throttleSummary) request() (*NotificationRequest, error) {
+	plan, err := c.GetNotificationPlan(s.Username)
+	if err != nil {
+		return nil, fmt.Errorf("There's no notification plan: %v", err)
+	}
+
+	plan.ID, err = uuid.Parse(s.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := c.GetPerson(s.Username)
+	if err != nil {
+		logger.Warn("Could not fetch person for notification", "uuid", s.UUID, "username", s.Username, "err", err)
+		p = &Person{Username: s.Username}
+	}
+
+	return &NotificationRequest{
+		Content: s.content(),
+		Plan:    plan,
+		Person:  p,
+	}, nil
+}
+
+// Schedules the summaries of throttled notifications that were waiting when we last shut down.  Those that fell
+// due while we were down are sent now.  The notification engine must be running.
+func resumeThrottleSummaries() {
+	ss, err := c.GetThrottleSummaries()
+	if err != nil {
+		// There's nothing waiting
+		return
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	for _, s := range ss {
+		logger.Info("Resuming summary of throttled notifications", "uuid", s.UUID, "username", s.Username, "due", s.Due)
+
+		// New requests join the person's latest summary
+		if other, exists := limiter.summaries[s.Username]; !exists || other.Due.Before(s.Due) {
+			limiter.summaries[s.Username] = s
+		}
+		limiter.schedule(s)
+	}
+}
+
+// e.g. "37 more alerts suppressed.  The latest: The castle is on fire"
+func (s *throttleSummary) content() string {
+	alerts := "alerts"
+	if s.Count == 1 {
+		alerts = "alert"
+	}
+	return fmt.Sprintf("%d more %v suppressed.  The latest: %v", s.Count, alerts, s.Latest)
+}
+
+// Records a request that was throttled, under the UUID it's already been given, and returns the UUID of the
+// summary that will include it.  It's over as far as anyone is concerned, but it points to the summary.
+func throttleNotification(nr *NotificationRequest, limit string) (string, error) {
+	metrics.NotificationsSuppressed.Inc(limit)
+
+	summary := limiter.throttle(nr.Plan.Username, nr.headline(), c.CurrentConfig().RateLimits)
+
+	now := time.Now()
+	return summary, c.StoreNotificationRecord(&NotificationRecord{
+		UUID:          nr.Plan.ID.String(),
+		Username:      nr.Plan.Username,
+		Content:       nr.Content,
+		ContentFields: nr.ContentFields,
+		Outcome:       OutcomeThrottled,
+		Started:       now,
+		Ended:         now,
+		FallbackFor:   nr.FallbackFor,
+		Group:         nr.Group,
+		Summary:       summary,
+	})
+}
+
+// Holds back a notification that was started on someone else's behalf, like a group member's or a fallback
+// person's, if it's in a maintenance window or over a rate limit.  Returns false if it should be sent to the
+// notification engine as usual.
+func holdBack(nr *NotificationRequest) bool {
+	nlog := logger.With("uuid", nr.Plan.ID.String(), "username", nr.Plan.Username)
+	if nr.Group != "" {
+		nlog = nlog.With("group", nr.Group)
+	}
+
+	if mw := openMaintenanceWindow(nr.Plan.Username, nr.Content); mw != nil {
+		err := suppressNotification(mw, nr)
+		if err != nil {
+			// Better to page them than to lose them
+			nlog.Error("Could not record suppressed notification", "window", mw.Name, "err", err)
+			return false
+		}
+		nlog.Info("Notification suppressed by maintenance window", "window", mw.Name, "deliver", mw.Deliver)
+		return true
+	}
+
+	if limit := limiter.allow(nr.Plan.Username, c.CurrentConfig().RateLimits); limit != "" {
+		summary, err := throttleNotification(nr, limit)
+		if err != nil {
+			nlog.Error("Could not record throttled notification", "err", err)
+			return false
+		}
+		nlog.Warn("Notification throttled", "limit", limit, "summary", summary)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimits(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	saved := c.CurrentConfig()
+	defer func() { c.Config = saved }()
+	defer func() { limiter = newRateLimiter() }()
+
+	for _, u := range []string{"lancelot", "galahad"} {
+		w := testAPIRequest(t, "POST", "http://localhost/people", `{"username": "`+u+`", "fullname": "Sir `+strings.Title(u)+`"}`)
+		if w.Code != 200 {
+			t.Fatalf("CreatePerson request failed: %s", w.Body)
+		}
+		w = testAPIRequest(t, "POST", "http://localhost/plan/"+u, `[{"method": "email://`+u+`@camelot.example.com", "notify_every_period": "1h"}]`)
+		if w.Code != 200 {
+			t.Fatalf("CreateNotificationPlan request failed: %s", w.Body)
+		}
+	}
+
+	notify := func(username, content string) NotifyPersonResponse {
+		w := testAPIRequest(t, "POST", "http://localhost/people/"+username+"/notify", `{"content": "`+content+`"}`)
+		if w.Code != 200 {
+			t.Fatalf("NotifyPerson request failed: %s", w.Body)
+		}
+		var res NotifyPersonResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+	status := func(id string) NotificationStatusResponse {
+		var res NotificationStatusResponse
+		w := testAPIRequest(t, "GET", "http://localhost/notifications/"+id, "")
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+
+	c.Config.RateLimits = RateLimitConfig{PerPerson: 2, Global: 3, Period: 300 * time.Millisecond}
+
+	var started []string
+	for _, content := range []string{"The castle is on fire", "The moat is empty"} {
+		res := notify("lancelot", content)
+		if res.Message != "Notification initiated" {
+			t.Errorf("Expected a notification under the limit to start: %+v", res)
+		}
+		started = append(started, res.UUID)
+	}
+
+	// Over the per-person limit, requests are folded into a summary instead of paging
+	first := notify("lancelot", "The drawbridge is stuck")
+	second := notify("lancelot", "The dragon is back")
+	if !strings.Contains(first.Message, SuppressedByPersonLimit) {
+		t.Errorf("Expected the notification to be throttled: %+v", first)
+	}
+	s := status(first.UUID)
+	if s.Outcome != OutcomeThrottled || s.Summary == "" || status(second.UUID).Summary != s.Summary {
+		t.Errorf("Expected throttled notifications to share a summary: %+v", s)
+	}
+
+	// Everyone else is still notified until the global limit is reached
+	started = append(started, notify("galahad", "The grail is missing").UUID)
+	res := notify("galahad", "The grail is still missing")
+	if !strings.Contains(res.Message, SuppressedByGlobalLimit) {
+		t.Errorf("Expected the notification to be throttled by the global limit: %+v", res)
+	}
+	started = append(started, status(res.UUID).Summary)
+
+	waitFor(t, "summaries", func() bool { return len(mockProvider.SentEmails()) == 5 })
+
+	var summary string
+	for _, e := range mockProvider.SentEmails() {
+		if strings.Contains(e.Plain, "2 more alerts suppressed.  The latest: The dragon is back") {
+			summary = e.Plain
+		}
+	}
+	if summary == "" {
+		t.Errorf("Expected a summary of lancelot's throttled notifications: %+v", mockProvider.SentEmails())
+	}
+	if st := status(s.Summary); st.State != StateNotifying || st.Username != "lancelot" {
+		t.Errorf("Unexpected status of the summary notification: %+v", st)
+	}
+
+	w := testAPIRequest(t, "GET", "http://localhost/metrics", "")
+	for _, want := range []string{
+		`chickenlittle_notifications_suppressed_total{reason="per_person_limit"} 2`,
+		`chickenlittle_notifications_suppressed_total{reason="global_limit"} 1`,
+		`chickenlittle_throttled_pending 0`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %q in metrics", want)
+		}
+	}
+
+	for _, id := range append(started, s.Summary) {
+		testAPIRequest(t, "DELETE", "http://localhost/notifications/"+id, "")
+	}
+	for _, id := range append(started, s.Summary) {
+		waitFor(t, "acknowledgement", func() bool { return !notificationInProgress(id) })
+	}
+
+	// Group members are held to the same limits
+	limiter = newRateLimiter()
+	c.Config.RateLimits = RateLimitConfig{PerPerson: 1, Period: 300 * time.Millisecond}
+	emails := len(mockProvider.SentEmails())
+
+	first = notify("lancelot", "The castle is on fire")
+	w = testAPIRequest(t, "POST", "http://localhost/notify", `{"content": "The drawbridge is stuck", "usernames": ["lancelot", "galahad"]}`)
+	if w.Code != 200 {
+		t.Fatalf("NotifyGroup request failed: %s", w.Body)
+	}
+	var g NotificationGroupResponse
+	json.Unmarshal(w.Body.Bytes(), &g)
+	if !strings.Contains(g.Message, "1 of 2 members suppressed") {
+		t.Errorf("Expected one member to be throttled: %+v", g)
+	}
+
+	members := make(map[string]string)
+	for _, m := range g.Members {
+		members[m.Username] = m.UUID
+	}
+	s = status(members["lancelot"])
+	if s.Outcome != OutcomeThrottled || s.Group != g.UUID || s.Summary == "" {
+		t.Errorf("Unexpected status of a throttled group member: %+v", s)
+	}
+
+	waitFor(t, "summary", func() bool { return len(mockProvider.SentEmails()) == emails+3 })
+
+	for _, id := range []string{first.UUID, members["galahad"], s.Summary} {
+		testAPIRequest(t, "DELETE", "http://localhost/notifications/"+id, "")
+		waitFor(t, "acknowledgement", func() bool { return !notificationInProgress(id) })
+	}
+
+	// Summaries that are waiting are kept in the DB
+	limiter = newRateLimiter()
+	c.Config.RateLimits = RateLimitConfig{PerPerson: 1, Period: time.Hour}
+
+	first = notify("lancelot", "The castle is on fire")
+	summary = status(notify("lancelot", "The drawbridge is stuck").UUID).Summary
+
+	ss, err := c.GetThrottleSummaries()
+	if err != nil || len(ss) != 1 || ss[0].UUID != summary || ss[0].Count != 1 {
+		t.Fatalf("Expected the summary to be stored: %+v %v", ss, err)
+	}
+
+	// Start over as if we'd been restarted after it fell due
+	limiter = newRateLimiter()
+	ss[0].Due = time.Now()
+	c.StoreThrottleSummary(ss[0])
+	resumeThrottleSummaries()
+
+	waitFor(t, "resumed summary", func() bool { return notificationInProgress(summary) })
+	waitFor(t, "summary to be removed once it was sent", func() bool {
+		ss, _ := c.GetThrottleSummaries()
+		return len(ss) == 0
+	})
+
+	for _, id := range []string{first.UUID, summary} {
+		testAPIRequest(t, "DELETE", "http://localhost/notifications/"+id, "")
+		waitFor(t, "acknowledgement", func() bool { return !notificationInProgress(id) })
+	}
+}
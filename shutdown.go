@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+)
+
+// How long we wait for in-flight requests and notifications to finish when shutting down, unless
+// the config file says otherwise
+const defaultShutdownTimeout = 30 * time.Second
+
+// NotificationCheckpoint records how far a notification-in-progress got before a shutdown, so that
+// it can be resumed when we start up again
+type NotificationCheckpoint struct {
+	UUID    string `json:"uuid"`
+	Content string `json:"content"`
+	ContentFields
+	Username      string             `json:"username"`
+	Steps         []NotificationStep `json:"steps"`
+	Person        *Person            `json:"person,omitempty"`
+	Step          int                `json:"step"`
+	Escalations   int                `json:"escalations"`
+	Attempts      int                `json:"attempts,omitempty"`
+	RetriggerAt   *time.Time         `json:"retrigger_at,omitempty"` // Set if it was acknowledged until a re-trigger
+	Retriggers    int                `json:"retriggers,omitempty"`
+	Conversations []string           `json:"conversations,omitempty"` // SMS conversation keys, so that sent codes keep working
+	OnExhausted   *ExhaustedAction   `json:"on_exhausted,omitempty"`
+	FallbackFor   string             `json:"fallback_for,omitempty"`
+	Group         string             `json:"group,omitempty"`
+	Window        string             `json:"window,omitempty"`
+}
+
+func (cp *NotificationCheckpoint) Marshal() ([]byte, error) {
+	jcp, err := json.Marshal(cp)
+	return jcp, err
+}
+
+func (cp *NotificationCheckpoint) Unmarshal(jcp string) error {
+	err := json.Unmarshal([]byte(jcp), cp)
+	return err
+}
+
+// Fetch every NotificationCheckpoint from the DB
+func (c *ChickenLittle) GetNotificationCheckpoints() ([]*NotificationCheckpoint, error) {
+	var cps []*NotificationCheckpoint
+
+	jcps, err := c.DB.FetchAll("checkpoints")
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch notification checkpoints from DB: %v", err)
+	}
+
+	for _, jcp := range jcps {
+		cp := &NotificationCheckpoint{}
+
+		err = cp.Unmarshal(jcp)
+		if err != nil {
+			return nil, fmt.Errorf("Could not unmarshal notification checkpoint from DB.  Err: %v  JSON: %v", err, jcp)
+		}
+
+		cps = append(cps, cp)
+	}
+
+	return cps, nil
+}
+
+// Store a NotificationCheckpoint in the DB
+func (c *ChickenLittle) StoreNotificationCheckpoint(cp *NotificationCheckpoint) error {
+	jcp, err := cp.Marshal()
+	if err != nil {
+		return fmt.Errorf("Could not marshal notification checkpoint %+v", cp)
+	}
+
+	err = c.DB.Store("checkpoints", cp.UUID, string(jcp))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete a NotificationCheckpoint from the DB
+func (c *ChickenLittle) DeleteNotificationCheckpoint(id string) error {
+	err := c.DB.Delete("checkpoints", id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Shuts everything down in an orderly fashion: the HTTP servers stop accepting requests and finish the
+// ones they're handling, the plan processors stop where they are, every notification-in-progress is
+// checkpointed to the DB, and finally the DB is closed.  We give up waiting once timeout has passed.
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Requests that are being handled may need the notification engine, so the servers go first
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			err := s.Shutdown(ctx)
+			if err != nil {
+				logger.Error("Error shutting down server", "address", s.Addr, "err", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	err := StopNotificationEngine(ctx)
+	if err != nil {
+		logger.Error("Error checkpointing notifications", "err", err)
+	}
+
+	c.DB.Close()
+
+	logger.Info("Shutdown complete")
+}
+
+// Stops the notification engine and its plan processors, waiting for any contact attempts that are
+// underway to finish, and then checkpoints every notification-in-progress to the DB
+func StopNotificationEngine(ctx context.Context) error {
+	shutdownChan <- struct{}{}
+
+	done := make(chan struct{})
+	go func() {
+		notificationHandlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warn("Timed out waiting for notifications to stop.  Checkpointing them as they are.")
+	}
+
+	return checkpointNotifications()
+}
+
+// Saves every notification-in-progress to the DB
+func checkpointNotifications() error {
+	var cps []*NotificationCheckpoint
+
+	NIP.Mu.Lock()
+	for id, nr := range NIP.Requests {
+		cp := newCheckpoint(nr)
+		cp.Step = NIP.Steps[id]
+		if s, exists := NIP.Status[id]; exists {
+			cp.Escalations = s.Escalations
+			cp.Attempts = s.Attempts
+			cp.RetriggerAt = s.RetriggerAt
+			cp.Retriggers = s.Retriggers
+		}
+		for key, cid := range NIP.Conversations {
+			if cid == id {
+				cp.Conversations = append(cp.Conversations, key)
+			}
+		}
+
+		cps = append(cps, cp)
+	}
+	NIP.Mu.Unlock()
+
+	var failed []string
+	for _, cp := range cps {
+		logger.Info("Checkpointing notification", "uuid", cp.UUID, "username", cp.Username, "step", cp.Step)
+
+		err := c.StoreNotificationCheckpoint(cp)
+		if err != nil {
+			logger.Error("Checkpoint failed", "uuid", cp.UUID, "err", err)
+			failed = append(failed, cp.UUID)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Could not checkpoint notifications %v", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// Saves a notification request that the notification engine never started, so that it starts from the
+// beginning when we start up again
+func checkpointRequest(nr *NotificationRequest) error {
+	cp := newCheckpoint(nr)
+	logger.Info("Checkpointing notification that hasn't started", "uuid", cp.UUID, "username", cp.Username)
+
+	return c.StoreNotificationCheckpoint(cp)
+}
+
+func newCheckpoint(nr *NotificationRequest) *NotificationCheckpoint {
+	return &NotificationCheckpoint{
+		UUID:          nr.Plan.ID.String(),
+		Content:       nr.Content,
+		ContentFields: nr.ContentFields,
+		Username:      nr.Plan.Username,
+		Steps:         nr.Plan.Steps,
+		Person:        nr.Person,
+		OnExhausted:   nr.Plan.OnExhausted,
+		FallbackFor:   nr.FallbackFor,
+		Group:         nr.Group,
+		Window:        nr.Window,
+	}
+}
+
+// Restarts the notifications that were checkpointed when we last shut down.  The notification engine
+// must be running.
+func resumeNotifications() {
+	cps, err := c.GetNotificationCheckpoints()
+	if err != nil {
+		// There's nothing to resume
+		return
+	}
+
+	for _, cp := range cps {
+		id, err := uuid.Parse(cp.UUID)
+		if err != nil {
+			logger.Error("Could not resume notification", "uuid", cp.UUID, "err", err)
+			c.DeleteNotificationCheckpoint(cp.UUID)
+			continue
+		}
+
+		logger.Info("Resuming notification", "uuid", cp.UUID, "username", cp.Username, "step", cp.Step)
+
+		nr := &NotificationRequest{
+			Content:       cp.Content,
+			ContentFields: cp.ContentFields,
+			Plan:          &NotificationPlan{ID: id, Username: cp.Username, Steps: cp.Steps, OnExhausted: cp.OnExhausted},
+			Person:        cp.Person,
+			Checkpoint:    cp,
+			FallbackFor:   cp.FallbackFor,
+			Group:         cp.Group,
+			Window:        cp.Window,
+		}
+
+		// Remove the checkpoint first, so that a crash can't resume it twice
+		err = c.DeleteNotificationCheckpoint(cp.UUID)
+		if err != nil {
+			logger.Error("Could not delete checkpoint", "uuid", cp.UUID, "err", err)
+		}
+
+		// The group may have been taken or timed out while we were shutting down
+		var g *NotificationGroup
+		if cp.Group != "" {
+			g, err = c.GetNotificationGroup(cp.Group)
+			switch {
+			case err != nil:
+				g = nil
+			case g.Mode != GroupModeAll && g.AcknowledgedBy != "":
+				logger.Info("Not resuming notification.  Its group was taken.", "uuid", cp.UUID, "group", cp.Group, "taken_by", g.AcknowledgedBy)
+				endCheckpoint(cp, OutcomeTaken, g.AcknowledgedBy)
+				continue
+			case g.Deadline != nil && time.Now().After(*g.Deadline):
+				logger.Info("Not resuming notification.  Its group timed out.", "uuid", cp.UUID, "group", cp.Group)
+				endCheckpoint(cp, OutcomeUnacknowledged, "")
+				continue
+			}
+		}
+
+		planChan <- nr
+
+		if g != nil {
+			scheduleGroupExpiry(g)
+		}
+	}
+}
+
+// Keeps a record of a checkpointed notification that won't be resumed
+func endCheckpoint(cp *NotificationCheckpoint, outcome, takenBy string) {
+	metrics.NotificationsEnded.Inc(outcome)
+
+	err := c.StoreNotificationRecord(&NotificationRecord{
+		UUID:          cp.UUID,
+		Username:      cp.Username,
+		Content:       cp.Content,
+		ContentFields: cp.ContentFields,
+		Outcome:       outcome,
+		Step:          cp.Step,
+		Attempts:      cp.Attempts,
+		Escalations:   cp.Escalations,
+		Retriggers:    cp.Retriggers,
+		Ended:         time.Now(),
+		FallbackFor:   cp.FallbackFor,
+		Group:         cp.Group,
+		TakenBy:       takenBy,
+		Window:        cp.Window,
+	})
+	if err != nil {
+		logger.Error("Could not store notification record", "uuid", cp.UUID, "err", err)
+	}
+
+	if cp.Group != "" {
+		groupMemberEnded(cp.Group)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed: %s", w.Body)
+	}
+
+	// Get a notification to its second step
+	uuid := testMockNotify(t, "lancelot", testSMSCommandsNotificationPlanJson)
+	waitFor(t, "SMS notification", func() bool { return len(mockProvider.SentSMS()) == 1 })
+
+	code := regexp.MustCompile(`Reply with "(\d+)"`).FindStringSubmatch(mockProvider.SentSMS()[0].Body)
+	if code == nil {
+		t.Fatalf("SMS contained no acknowledgement code: %s", mockProvider.SentSMS()[0].Body)
+	}
+
+	err := mockProvider.ReplySMS("+12108675309", "ESC "+code[1])
+	if err != nil {
+		t.Fatalf("SMS reply failed: %s", err)
+	}
+	waitFor(t, "escalation to a phone call", func() bool { return len(mockProvider.PlacedCalls()) == 1 })
+
+	// Serve the API like main() does so that we can shut it down
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	server := &http.Server{Handler: apiRouter()}
+	go server.Serve(ln)
+
+	shutdown([]*http.Server{server}, 5*time.Second)
+
+	_, err = http.Get("http://" + ln.Addr().String() + "/people")
+	if err == nil {
+		t.Errorf("API server is still running after shutdown")
+	}
+
+	// The notification should have been checkpointed at its second step
+	c.DB.Open(dbfile)
+
+	cps, err := c.GetNotificationCheckpoints()
+	if err != nil {
+		t.Fatalf("Could not fetch checkpoints: %s", err)
+	}
+
+	var cp *NotificationCheckpoint
+	for _, saved := range cps {
+		if saved.UUID == uuid {
+			cp = saved
+		}
+	}
+	if cp == nil {
+		t.Fatalf("Notification %s was not checkpointed", uuid)
+	}
+	if cp.Step != 2 || cp.Escalations != 1 || len(cp.Conversations) != 1 {
+		t.Errorf("Unexpected checkpoint: %+v", cp)
+	}
+
+	// A fallback that's due now has to wait for the restart
+	NIP.Mu.Lock()
+	nr := NIP.Requests[uuid]
+	NIP.Mu.Unlock()
+
+	fallback := make(chan string)
+	go func() {
+		fid, err := notifyFallback(nr, "lancelot")
+		if err != nil {
+			t.Errorf("Could not notify fallback person: %s", err)
+		}
+		fallback <- fid
+	}()
+
+	var fid string
+	select {
+	case fid = <-fallback:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Notifying a fallback person blocked during shutdown")
+	}
+
+	cps, err = c.GetNotificationCheckpoints()
+	if err != nil || len(cps) != 2 {
+		t.Fatalf("Expected the fallback notification to be checkpointed: %+v %v", cps, err)
+	}
+
+	// So does a suppressed notification whose window ended just before we started draining
+	sn := &SuppressedNotification{UUID: "5c8b2f4e-1d2a-4c3b-9e7f-0a1b2c3d4e5f", Username: "lancelot", Content: "Held back", Window: "gone", Received: time.Now()}
+	err = c.StoreSuppressedNotification(sn)
+	if err != nil {
+		t.Fatalf("Could not store suppressed notification: %s", err)
+	}
+
+	NIP.Mu.Lock()
+	NIP.Draining = false
+	NIP.Mu.Unlock()
+
+	delivered := make(chan struct{})
+	go func() {
+		deliverSuppressedNotification(sn.UUID)
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Delivering a suppressed notification blocked during shutdown")
+	}
+
+	if _, err := c.GetSuppressedNotification(sn.UUID); err != nil {
+		t.Errorf("Suppressed notification was dropped during shutdown: %s", err)
+	}
+
+	// And so does a summary of throttled notifications
+	defer func() { limiter = newRateLimiter() }()
+	summary := limiter.throttle("lancelot", "The castle is on fire", RateLimitConfig{PerPerson: 1, Period: time.Hour})
+
+	limiter.mu.Lock()
+	ts := limiter.summaries["lancelot"]
+	ts.Due = time.Now()
+	limiter.mu.Unlock()
+	c.StoreThrottleSummary(ts)
+
+	sent := make(chan struct{})
+	go func() {
+		limiter.sendSummary(ts)
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Sending a throttle summary blocked during shutdown")
+	}
+
+	if ss, err := c.GetThrottleSummaries(); err != nil || len(ss) != 1 {
+		t.Fatalf("Throttle summary was dropped during shutdown: %+v %v", ss, err)
+	}
+
+	// Start up again and carry on from the second step
+	go StartNotificationEngine()
+	resumeNotifications()
+	resumeMaintenanceWindows()
+	resumeThrottleSummaries()
+
+	waitFor(t, "fallback notification", func() bool { return notificationInProgress(fid) })
+	w = testAPIRequest(t, "GET", "http://localhost/notifications/"+fid, "")
+	if !strings.Contains(w.Body.String(), `"fallback_for":"`+uuid+`"`) {
+		t.Errorf("Unexpected status for fallback notification: %s", w.Body)
+	}
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+fid, "")
+	waitFor(t, "fallback notification to stop", func() bool { return !notificationInProgress(fid) })
+
+	waitFor(t, "suppressed notification", func() bool { return notificationInProgress(sn.UUID) })
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+sn.UUID, "")
+	waitFor(t, "suppressed notification to stop", func() bool { return !notificationInProgress(sn.UUID) })
+
+	waitFor(t, "throttle summary", func() bool { return notificationInProgress(summary) })
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+summary, "")
+	waitFor(t, "throttle summary to stop", func() bool { return !notificationInProgress(summary) })
+
+	waitFor(t, "resumed phone call", func() bool { return len(mockProvider.PlacedCalls()) >= 2 })
+
+	w = testAPIRequest(t, "GET", "http://localhost/notifications/"+uuid, "")
+	if !strings.Contains(w.Body.String(), `"step":2`) || !strings.Contains(w.Body.String(), `"escalations":1`) {
+		t.Errorf("Unexpected status for resumed notification: %s", w.Body)
+	}
+
+	if _, err := c.GetNotificationCheckpoints(); err == nil {
+		t.Errorf("Checkpoint was not removed after resuming")
+	}
+
+	// The code from before the shutdown still works
+	err = mockProvider.ReplySMS("+12108675309", code[1])
+	if err != nil {
+		t.Fatalf("SMS reply failed: %s", err)
+	}
+	waitFor(t, "SMS acknowledgement", func() bool { return !notificationInProgress(uuid) })
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The commands that can be sent by SMS in reply to a notification
+const (
+	AckCommand      = "ACK"
+	SnoozeCommand   = "SNOOZE"
+	EscalateCommand = "ESC"
+	StatusCommand   = "STATUS"
+	OffCommand      = "OFF"
+)
+
+// Acknowledgement codes are three digits: 100 to 999
+const (
+	ackCodeMin   = 100
+	ackCodeCount = 900
+)
+
+// Other words that people are likely to use for our commands
+var smsCommandAliases = map[string]string{
+	"ACKNOWLEDGE": AckCommand,
+	"ESCALATE":    EscalateCommand,
+}
+
+// SMSCommand is a parsed SMS reply
+type SMSCommand struct {
+	Verb   string
+	Code   string        // The acknowledgement code of the notification that the command applies to
+	Snooze time.Duration // How long to snooze for, for SnoozeCommand, or to acknowledge for, for AckCommand
+}
+
+// PageSummary describes one of a person's open notifications for the STATUS and OFF replies
+type PageSummary struct {
+	UUID    string
+	Code    string
+	Content string // The title, or the content if there is no title
+	Step    int
+	State   string
+}
+
+// Parses an SMS reply.  Commands are case-insensitive and take these forms:
+//
+//	123               acknowledge the notification with code 123
+//	ACK 123           same as above
+//	ACK               acknowledge the sender's only open notification
+//	ACK [123] 1h      acknowledge, but re-trigger the notification in an hour unless it's resolved by then
+//	SNOOZE 123 [30m]  snooze the notification, for 15 minutes unless a duration is given
+//	ESC 123           escalate the notification to the next step of its plan
+//	STATUS            list the sender's open notifications
+//	OFF               escalate all of the sender's open notifications
+func parseSMSCommand(body string) (SMSCommand, error) {
+	var cmd SMSCommand
+
+	fields := strings.Fields(strings.ToUpper(body))
+	if len(fields) == 0 {
+		return cmd, fmt.Errorf("Empty SMS command")
+	}
+
+	// A bare code is an acknowledgement
+	if isAckCode(fields[0]) {
+		fields = append([]string{AckCommand}, fields...)
+	}
+
+	cmd.Verb = fields[0]
+	if v, ok := smsCommandAliases[cmd.Verb]; ok {
+		cmd.Verb = v
+	}
+	args := fields[1:]
+
+	switch cmd.Verb {
+	case StatusCommand, OffCommand:
+		if len(args) != 0 {
+			return cmd, fmt.Errorf("%v does not take any arguments", cmd.Verb)
+		}
+	case AckCommand:
+		// A bare ACK is fine if the sender only has one notification open
+		if len(args) > 0 && isAckCode(args[0]) {
+			cmd.Code = args[0]
+			args = args[1:]
+		}
+		// A number on its own would be a mistyped code, so the duration needs a unit
+		if len(args) > 1 || (len(args) == 1 && strings.Trim(args[0], "0123456789") == "") {
+			return cmd, fmt.Errorf("%v needs the code from a notification and, optionally, a duration like 1h", cmd.Verb)
+		}
+		if len(args) == 1 {
+			d, err := parseSnoozeDuration(args[0])
+			if err != nil {
+				return cmd, err
+			}
+			cmd.Snooze = d
+		}
+	case EscalateCommand:
+		if len(args) != 1 || !isAckCode(args[0]) {
+			return cmd, fmt.Errorf("%v needs the code from a notification", cmd.Verb)
+		}
+		cmd.Code = args[0]
+	case SnoozeCommand:
+		if len(args) < 1 || len(args) > 2 || !isAckCode(args[0]) {
+			return cmd, fmt.Errorf("%v needs the code from a notification and, optionally, a duration", cmd.Verb)
+		}
+		cmd.Code = args[0]
+
+		cmd.Snooze = defaultSnoozePeriod
+		if len(args) == 2 {
+			d, err := parseSnoozeDuration(args[1])
+			if err != nil {
+				return cmd, err
+			}
+			cmd.Snooze = d
+		}
+	default:
+		return cmd, fmt.Errorf("Unknown SMS command %v", cmd.Verb)
+	}
+
+	return cmd, nil
+}
+
+// Reports whether s looks like the acknowledgement code sent with an SMS notification
+func isAckCode(s string) bool {
+	return len(s) == 3 && strings.Trim(s, "0123456789") == ""
+}
+
+// Parses a snooze duration like "30m" or "1h".  A plain number is taken as minutes.
+func parseSnoozeDuration(s string) (time.Duration, error) {
+	var d time.Duration
+
+	if m, err := strconv.Atoi(s); err == nil {
+		d = time.Duration(m) * time.Minute
+	} else {
+		d, err = time.ParseDuration(strings.ToLower(s))
+		if err != nil {
+			return 0, fmt.Errorf("Invalid snooze duration %v", s)
+		}
+	}
+
+	if d <= 0 || d > maxSnoozePeriod {
+		return 0, fmt.Errorf("Snooze duration must be between 1 minute and %v", maxSnoozePeriod)
+	}
+
+	return d, nil
+}
+
+// Returned when every acknowledgement code for a phone number is taken.  Codes are freed as their
+// notifications end, so it's worth trying again later.
+type ackCodesInUseError struct{}
+
+func (ackCodesInUseError) Error() string {
+	return "Every acknowledgement code for this number is in use"
+}
+func (ackCodesInUseError) Temporary() bool { return true }
+
+// Finds the acknowledgement code that the notification with the given UUID uses for a phone number.  A
+// notification keeps the same code for every SMS it sends to a number, so the first one sent picks an
+// unguessable code that isn't in use by any other notification sent to that number and reserves it.
+// fresh reports whether the code was reserved by this call.  Codes are released when their
+// notification ends.
+func reserveAckCode(phoneNumber, uuid string) (code string, fresh bool, err error) {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	var free []string
+	for n := ackCodeMin; n < ackCodeMin+ackCodeCount; n++ {
+		code := strconv.Itoa(n)
+		other, taken := NIP.Conversations[fmt.Sprint(phoneNumber, "::", code)]
+		if taken && other == uuid {
+			return code, false, nil
+		}
+		if !taken {
+			free = append(free, code)
+		}
+	}
+
+	if len(free) == 0 {
+		return "", false, ackCodesInUseError{}
+	}
+
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(free))))
+	if err != nil {
+		return "", false, fmt.Errorf("Could not generate an acknowledgement code: %v", err)
+	}
+
+	code = free[i.Int64()]
+	NIP.Conversations[fmt.Sprint(phoneNumber, "::", code)] = uuid
+
+	return code, true, nil
+}
+
+// Frees up an acknowledgement code that was reserved for an SMS that couldn't be sent
+func releaseAckCode(phoneNumber, code string) {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	delete(NIP.Conversations, fmt.Sprint(phoneNumber, "::", code))
+}
+
+// Makes an acknowledgement code reserved for one spelling of a phone number work for another
+func aliasAckCode(phoneNumber, alias, code string) {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	uuid := NIP.Conversations[fmt.Sprint(phoneNumber, "::", code)]
+	key := fmt.Sprint(alias, "::", code)
+
+	if other, taken := NIP.Conversations[key]; taken && other != uuid {
+		logger.Warn("Acknowledgement code is already in use for the number Twilio reported", "uuid", uuid, "code", code, "other_uuid", other)
+		return
+	}
+
+	NIP.Conversations[key] = uuid
+}
+
+// Looks up the notification that an acknowledgement code sent to a phone number belongs to
+func smsConversation(phoneNumber, code string) (string, bool) {
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	uuid, exists := NIP.Conversations[fmt.Sprint(phoneNumber, "::", code)]
+	if !exists {
+		return "", false
+	}
+
+	// The conversation may outlive its notification
+	if _, exists := NIP.Stoppers[uuid]; !exists {
+		return "", false
+	}
+
+	return uuid, true
+}
+
+// Lists the notifications-in-progress that have texted or whose plans contact a phone number, ordered by code
+func openPages(phoneNumber string) []PageSummary {
+	var pages []PageSummary
+
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	// Find the codes that we've sent to this number.  A notification normally has just the one, but it
+	// may have more if it was texted under several spellings of the number; we pick the lowest.
+	codes := make(map[string]string)
+	for key, uuid := range NIP.Conversations {
+		if !strings.HasPrefix(key, phoneNumber+"::") {
+			continue
+		}
+		code := strings.TrimPrefix(key, phoneNumber+"::")
+		if c, exists := codes[uuid]; !exists || code < c {
+			codes[uuid] = code
+		}
+	}
+
+	for uuid, nr := range NIP.Requests {
+		// Twilio may have texted the number under another spelling than the plan's
+		if _, texted := codes[uuid]; !texted && !planContacts(nr.Plan, phoneNumber) {
+			continue
+		}
+
+		p := PageSummary{
+			UUID:    uuid,
+			Code:    codes[uuid],
+			Content: nr.headline(),
+			Step:    NIP.Steps[uuid],
+		}
+		if s, exists := NIP.Status[uuid]; exists {
+			p.State = s.State
+		}
+
+		pages = append(pages, p)
+	}
+
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].Code != pages[j].Code {
+			return pages[i].Code < pages[j].Code
+		}
+		return pages[i].UUID < pages[j].UUID
+	})
+
+	return pages
+}
+
+// Lists the notifications-in-progress that have sent an SMS to a phone number, and so have a code it
+// could be replying to
+func textedPages(phoneNumber string) []PageSummary {
+	var pages []PageSummary
+	for _, p := range openPages(phoneNumber) {
+		if p.Code != "" {
+			pages = append(pages, p)
+		}
+	}
+	return pages
+}
+
+// Reports whether any step of a plan sends an SMS to or calls a phone number
+func planContacts(np *NotificationPlan, phoneNumber string) bool {
+	if np == nil {
+		return false
+	}
+
+	for _, s := range np.Steps {
+		for _, m := range s.AllMethods() {
+			u, err := url.Parse(m)
+			if err != nil {
+				continue
+			}
+
+			if (u.Scheme == "sms" || u.Scheme == "phone") && u.Host == phoneNumber {
+				return true
+			}
+		}
+	}
+
+	return false
+}
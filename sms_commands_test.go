@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSMSCommandsNotificationPlanJson = `
+[
+  {
+    "method": "sms://+12108675309",
+    "notify_every_period": 0,
+    "notify_until_period": 3600000000000
+  },
+  {
+    "method": "phone://+12108675309",
+    "notify_every_period": 3600000000000,
+    "notify_until_period": 0
+  }
+]
+`
+
+const testSMSCommandsCallFirstNotificationPlanJson = `
+[
+  {
+    "method": "phone://+12108675309",
+    "notify_every_period": 0,
+    "notify_until_period": 3600000000000
+  },
+  {
+    "method": "sms://+12108675309",
+    "notify_every_period": 3600000000000,
+    "notify_until_period": 0
+  }
+]
+`
+
+func TestParseSMSCommand(t *testing.T) {
+	tests := []struct {
+		body   string
+		verb   string
+		code   string
+		snooze time.Duration
+		valid  bool
+	}{
+		{"123", AckCommand, "123", 0, true},
+		{" ack 123 ", AckCommand, "123", 0, true},
+		{"Acknowledge 123", AckCommand, "123", 0, true},
+		{"SNOOZE 123", SnoozeCommand, "123", 15 * time.Minute, true},
+		{"snooze 123 30m", SnoozeCommand, "123", 30 * time.Minute, true},
+		{"SNOOZE 123 45", SnoozeCommand, "123", 45 * time.Minute, true},
+		{"SNOOZE 123 1H", SnoozeCommand, "123", time.Hour, true},
+		{"SNOOZE 123 0", "", "", 0, false},
+		{"SNOOZE 123 48h", "", "", 0, false},
+		{"SNOOZE 123 soon", "", "", 0, false},
+		{"esc 123", EscalateCommand, "123", 0, true},
+		{"ESCALATE 123", EscalateCommand, "123", 0, true},
+		{"status", StatusCommand, "", 0, true},
+		{"OFF", OffCommand, "", 0, true},
+		{"ack", AckCommand, "", 0, true},
+		{"ACK 123 1h", AckCommand, "123", time.Hour, true},
+		{"123 30m", AckCommand, "123", 30 * time.Minute, true},
+		{"ack 2h", AckCommand, "", 2 * time.Hour, true},
+		{"ACK 123 48h", "", "", 0, false},
+		{"ACK 123 456", "", "", 0, false},
+		{"ACK 12", "", "", 0, false},
+		{"STATUS 123", "", "", 0, false},
+		{"Hello?", "", "", 0, false},
+		{"", "", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		cmd, err := parseSMSCommand(tt.body)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("parseSMSCommand(%q) accepted an invalid command: %+v", tt.body, cmd)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseSMSCommand(%q) failed: %s", tt.body, err)
+			continue
+		}
+		if cmd.Verb != tt.verb || cmd.Code != tt.code || cmd.Snooze != tt.snooze {
+			t.Errorf("parseSMSCommand(%q) = %+v, expected %v %v %v", tt.body, cmd, tt.verb, tt.code, tt.snooze)
+		}
+	}
+}
+
+func TestSMSCommands(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed: %s", w.Body)
+	}
+
+	uuid := testMockNotify(t, "lancelot", testSMSCommandsNotificationPlanJson)
+	waitFor(t, "SMS notification", func() bool { return len(mockProvider.SentSMS()) == 1 })
+
+	code := regexp.MustCompile(`Reply with "(\d+)"`).FindStringSubmatch(mockProvider.SentSMS()[0].Body)
+	if code == nil {
+		t.Fatalf("SMS contained no acknowledgement code: %s", mockProvider.SentSMS()[0].Body)
+	}
+
+	// reply sends an SMS from the person and returns our answer
+	reply := func(body string) string {
+		n := len(mockProvider.SentSMS())
+		err := mockProvider.ReplySMS("+12108675309", body)
+		if err != nil {
+			t.Fatalf("SMS reply failed: %s", err)
+		}
+		waitFor(t, "SMS reply to "+body, func() bool { return len(mockProvider.SentSMS()) > n })
+		return mockProvider.SentSMS()[n].Body
+	}
+
+	if m := reply("STATUS"); !strings.Contains(m, code[1]+": The castle is on fire (step 1, notifying)") {
+		t.Errorf("Unexpected STATUS reply: %s", m)
+	}
+
+	if m := reply("what?"); !strings.Contains(m, "don't recognize") {
+		t.Errorf("Unexpected reply to an unknown command: %s", m)
+	}
+
+	if m := reply("ACK 999"); !strings.Contains(m, "don't recognize") {
+		t.Errorf("Unexpected reply to an unknown code: %s", m)
+	}
+
+	if m := reply("snooze " + code[1] + " 30m"); !strings.Contains(m, "snoozed for 30 minutes") {
+		t.Errorf("Unexpected SNOOZE reply: %s", m)
+	}
+	waitFor(t, "snooze", func() bool {
+		return strings.Contains(reply("STATUS"), "(step 1, snoozed)")
+	})
+
+	if m := reply("ESC " + code[1]); !strings.Contains(m, "escalated") {
+		t.Errorf("Unexpected ESC reply: %s", m)
+	}
+	waitFor(t, "escalation to a phone call", func() bool { return len(mockProvider.PlacedCalls()) == 1 })
+
+	// There's nowhere left to escalate to
+	if m := reply("ESC " + code[1]); !strings.Contains(m, "no one left") {
+		t.Errorf("Unexpected ESC reply on the last step: %s", m)
+	}
+	if m := reply("OFF"); !strings.Contains(m, "no notifications that can be handed off") {
+		t.Errorf("Unexpected OFF reply on the last step: %s", m)
+	}
+
+	if m := reply("ack " + code[1]); !strings.Contains(m, "received your acknowledgment") {
+		t.Errorf("Unexpected ACK reply: %s", m)
+	}
+	waitFor(t, "SMS acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	if m := reply("STATUS"); !strings.Contains(m, "no open notifications") {
+		t.Errorf("Unexpected STATUS reply with nothing open: %s", m)
+	}
+
+	// Hand off: every open notification moves to its next step
+	mockProvider.Reset()
+	uuid = testMockNotify(t, "lancelot", testSMSCommandsNotificationPlanJson)
+	waitFor(t, "SMS notification", func() bool { return len(mockProvider.SentSMS()) == 1 })
+
+	if m := reply("OFF"); !strings.Contains(m, "Handed off 1 notification(s)") {
+		t.Errorf("Unexpected OFF reply: %s", m)
+	}
+	waitFor(t, "hand-off to a phone call", func() bool { return len(mockProvider.PlacedCalls()) == 1 })
+
+	// A bare ACK needs to know which notification it's for
+	other := testMockNotify(t, "lancelot", testSMSCommandsNotificationPlanJson)
+	waitFor(t, "second SMS notification", func() bool { return len(mockProvider.SentSMS()) == 3 })
+
+	if m := reply("ACK"); !strings.Contains(m, "You have 2 open notifications") {
+		t.Errorf("Unexpected reply to an ambiguous ACK: %s", m)
+	}
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+other, "")
+	waitFor(t, "notification to stop", func() bool { return !notificationInProgress(other) })
+
+	if m := reply("ACK"); !strings.Contains(m, "received your acknowledgment") {
+		t.Errorf("Unexpected reply to a bare ACK: %s", m)
+	}
+	waitFor(t, "SMS acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	// A bare ACK can't be for a notification that has only called
+	uuid = testMockNotify(t, "lancelot", testSMSCommandsCallFirstNotificationPlanJson)
+	waitFor(t, "phone call", func() bool { return len(mockProvider.PlacedCalls()) == 2 })
+
+	if m := reply("ACK"); !strings.Contains(m, "You have no open notifications") {
+		t.Errorf("Unexpected reply to a bare ACK with nothing texted: %s", m)
+	}
+	if !notificationInProgress(uuid) {
+		t.Errorf("A bare ACK acknowledged a notification that hasn't texted")
+	}
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+uuid, "")
+	waitFor(t, "notification to stop", func() bool { return !notificationInProgress(uuid) })
+}
+
+func TestAckCodes(t *testing.T) {
+	startTestNotificationEngine()
+
+	// Stand in for notifications-in-progress
+	uuids := make([]string, ackCodeCount+1)
+	NIP.Mu.Lock()
+	for i := range uuids {
+		uuids[i] = fmt.Sprint("test-ack-codes-", i)
+		NIP.Stoppers[uuids[i]] = make(chan NotificationControl, 4)
+	}
+	NIP.Mu.Unlock()
+	defer func() {
+		for _, uuid := range uuids {
+			endNotification(uuid, OutcomeAcknowledged)
+		}
+	}()
+
+	// Every code should be handed out exactly once
+	seen := make(map[string]bool)
+	var first string
+	for i := 0; i < ackCodeCount; i++ {
+		code, fresh, err := reserveAckCode("+15550001234", uuids[i])
+		if err != nil {
+			t.Fatalf("reserveAckCode() failed after %d codes: %s", i, err)
+		}
+		if !isAckCode(code) || seen[code] || !fresh {
+			t.Fatalf("reserveAckCode() returned a bad or duplicate code: %s", code)
+		}
+		seen[code] = true
+		if i == 0 {
+			first = code
+		}
+	}
+
+	_, _, err := reserveAckCode("+15550001234", uuids[ackCodeCount])
+	if err == nil {
+		t.Errorf("reserveAckCode() returned a code when all of them were in use")
+	} else if !IsTemporary(err) {
+		t.Errorf("Running out of codes should be a temporary error: %s", err)
+	}
+
+	// A notification keeps its code for every SMS it sends to a number
+	code, fresh, err := reserveAckCode("+15550001234", uuids[0])
+	if err != nil || code != first || fresh {
+		t.Errorf("Expected %s to keep code %s, got %s (fresh %v, err %v)", uuids[0], first, code, fresh, err)
+	}
+
+	// Other numbers have codes of their own
+	code, _, err = reserveAckCode("+15550004321", uuids[0])
+	if err != nil {
+		t.Fatalf("reserveAckCode() failed for another number: %s", err)
+	}
+
+	if uuid, exists := smsConversation("+15550004321", code); !exists || uuid != uuids[0] {
+		t.Errorf("Expected code %s to belong to %s, got %q", code, uuids[0], uuid)
+	}
+
+	// Codes are released when their notification ends
+	for _, uuid := range uuids {
+		endNotification(uuid, OutcomeAcknowledged)
+	}
+
+	n := 0
+	NIP.Mu.Lock()
+	for _, uuid := range NIP.Conversations {
+		if strings.HasPrefix(uuid, "test-ack-codes-") {
+			n++
+		}
+	}
+	NIP.Mu.Unlock()
+	if n != 0 {
+		t.Errorf("Expected every code to be released, %d remain", n)
+	}
+}
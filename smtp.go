@@ -3,25 +3,29 @@ package main
 import (
 	"fmt"
 	"github.com/jpoehls/gophermail"
-	"log"
 	"net/mail"
 	"net/smtp"
 	"time"
 )
 
-func SendEmailSMTP(address, subject, plain, html string) {
+// Sends a multipart text and HTML e-mail through our SMTP server.  replyTo and messageID are only set if
+// replies can acknowledge the notification.
+func SendEmailSMTP(sc SMTP, address, subject, plain, html, replyTo, messageID string) error {
 	// Set up authentication information
 	auth := smtp.PlainAuth(
 		"",
-		c.Config.Integrations.SMTP.Login,
-		c.Config.Integrations.SMTP.Password,
-		c.Config.Integrations.SMTP.Hostname,
+		sc.Login,
+		sc.Password,
+		sc.Hostname,
 	)
 
-	from := mail.Address{Address: c.Config.Integrations.SMTP.Sender}
+	from := mail.Address{Address: sc.Sender}
 	to := mail.Address{Address: address}
 	headers := mail.Header{}
 	headers["Date"] = []string{time.Now().Format(time.RFC822Z)}
+	if messageID != "" {
+		headers["Message-ID"] = []string{messageID}
+	}
 
 	message := &gophermail.Message{
 		From:     from,
@@ -31,15 +35,22 @@ func SendEmailSMTP(address, subject, plain, html string) {
 		HTMLBody: html,
 		Headers:  headers,
 	}
+	if replyTo != "" {
+		message.ReplyTo = mail.Address{Address: replyTo}
+	}
 
 	// Connect to the server, auth and send
-	host := fmt.Sprintf("%s:%d", c.Config.Integrations.SMTP.Hostname, c.Config.Integrations.SMTP.Port)
+	host := fmt.Sprintf("%s:%d", sc.Hostname, sc.Port)
 	err := gophermail.SendMail(
 		host,
 		auth,
 		message,
 	)
 	if err != nil {
-		log.Println("SMTP-Error:", err)
+		logger.Error("Sending e-mail by SMTP failed", "err", err)
+		metrics.ProviderErrors.Inc("smtp", "send")
+		return err
 	}
+
+	return nil
 }
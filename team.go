@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Team is a named group of people who can be notified together
+type Team struct {
+	Name    string   `yaml:"name" json:"name"`
+	Members []string `yaml:"members" json:"members"` // Usernames
+}
+
+func (t *Team) Marshal() ([]byte, error) {
+	jt, err := json.Marshal(&t)
+	return jt, err
+}
+
+func (t *Team) Unmarshal(jt string) error {
+	err := json.Unmarshal([]byte(jt), &t)
+	return err
+}
+
+// Fetch a Team from the DB
+func (c *ChickenLittle) GetTeam(name string) (*Team, error) {
+	jt, err := c.DB.Fetch("teams", name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch team %v from DB", name)
+	}
+
+	t := &Team{}
+
+	err = t.Unmarshal(jt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal team from DB.  Err: %v  JSON: %v", err, jt)
+	}
+
+	return t, nil
+}
+
+// Fetch every Team from the DB
+func (c *ChickenLittle) GetAllTeams() ([]*Team, error) {
+	var teams []*Team
+
+	jts, err := c.DB.FetchAll("teams")
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch all teams from DB")
+	}
+
+	for _, jt := range jts {
+		t := &Team{}
+
+		err = t.Unmarshal(jt)
+		if err != nil {
+			return nil, fmt.Errorf("Could not unmarshal team from DB.  Err: %v  JSON: %v", err, jt)
+		}
+
+		teams = append(teams, t)
+	}
+
+	return teams, nil
+}
+
+// Store a Team in the DB
+func (c *ChickenLittle) StoreTeam(t *Team) error {
+	jt, err := t.Marshal()
+	if err != nil {
+		return fmt.Errorf("Could not marshal team %+v", t)
+	}
+
+	err = c.DB.Store("teams", t.Name, string(jt))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete a Team from the DB
+func (c *ChickenLittle) DeleteTeam(name string) error {
+	err := c.DB.Delete("teams", name)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"text/template"
+)
+
+// The language whose templates apply when a person hasn't chosen one, or when their
+// language doesn't define a particular template
+const defaultTemplateLanguage = "default"
+
+// MessageTemplates holds the Go templates used to render notifications for each channel.
+// Every template is executed with a MessageData.  EmailHTML is an html/template; the rest are text/templates.
+type MessageTemplates struct {
+	SMS               string `yaml:"sms" json:"sms,omitempty"`
+	SMSAcknowledged   string `yaml:"sms_acknowledged" json:"sms_acknowledged,omitempty"`
+	SMSRetrigger      string `yaml:"sms_retrigger" json:"sms_retrigger,omitempty"`
+	SMSUnrecognized   string `yaml:"sms_unrecognized" json:"sms_unrecognized,omitempty"`
+	SMSAckWhich       string `yaml:"sms_ack_which" json:"sms_ack_which,omitempty"`
+	SMSSnoozed        string `yaml:"sms_snoozed" json:"sms_snoozed,omitempty"`
+	SMSEscalated      string `yaml:"sms_escalated" json:"sms_escalated,omitempty"`
+	SMSNoEscalation   string `yaml:"sms_no_escalation" json:"sms_no_escalation,omitempty"`
+	SMSStatus         string `yaml:"sms_status" json:"sms_status,omitempty"`
+	SMSHandedOff      string `yaml:"sms_handed_off" json:"sms_handed_off,omitempty"`
+	SMSTaken          string `yaml:"sms_taken" json:"sms_taken,omitempty"`
+	VoiceIntro        string `yaml:"voice_intro" json:"voice_intro,omitempty"`
+	VoiceMessage      string `yaml:"voice_message" json:"voice_message,omitempty"`
+	VoicePrompt       string `yaml:"voice_prompt" json:"voice_prompt,omitempty"`
+	VoiceAcknowledged string `yaml:"voice_acknowledged" json:"voice_acknowledged,omitempty"`
+	VoiceRetrigger    string `yaml:"voice_retrigger" json:"voice_retrigger,omitempty"`
+	VoiceRejected     string `yaml:"voice_rejected" json:"voice_rejected,omitempty"`
+	VoicePINPrompt    string `yaml:"voice_pin_prompt" json:"voice_pin_prompt,omitempty"`
+	VoicePINRejected  string `yaml:"voice_pin_rejected" json:"voice_pin_rejected,omitempty"`
+	VoiceEscalated    string `yaml:"voice_escalated" json:"voice_escalated,omitempty"`
+	VoiceNoEscalation string `yaml:"voice_no_escalation" json:"voice_no_escalation,omitempty"`
+	VoiceSnoozed      string `yaml:"voice_snoozed" json:"voice_snoozed,omitempty"`
+	EmailSubject      string `yaml:"email_subject" json:"email_subject,omitempty"`
+	EmailText         string `yaml:"email_text" json:"email_text,omitempty"`
+	EmailHTML         string `yaml:"email_html" json:"email_html,omitempty"`
+	EmailTakenSubject string `yaml:"email_taken_subject" json:"email_taken_subject,omitempty"`
+	EmailTakenText    string `yaml:"email_taken_text" json:"email_taken_text,omitempty"`
+}
+
+// MessageData holds the variables available to message templates
+type MessageData struct {
+	Username      string
+	FullName      string
+	Language      string
+	Content       string
+	Title         string // The notification's title, or its content if it doesn't have one
+	Details       string
+	Source        string
+	Severity      string
+	Links         []Link
+	UUID          string
+	AckCode       string
+	AckDigit      string
+	RequirePIN    bool
+	SnoozeMinutes int
+	StopURL       string
+	AckByReply    bool // Whether replying to an e-mail with "ack" acknowledges it
+	Step          int
+	Pages         []PageSummary // The person's open notifications, for sms_status, sms_ack_which and sms_handed_off
+	TakenBy       string        // The full name of whoever took a group notification, for sms_taken and email_taken_*
+
+	// How long until an acknowledged notification is re-triggered, for sms_retrigger and voice_retrigger.  For
+	// voice_prompt, how long an acknowledgement with the re-trigger key lasts.
+	RetriggerMinutes int
+}
+
+// The messages we send when nobody has configured anything else
+var builtinTemplates = MessageTemplates{
+	SMS:               `{{.Title}} - Reply with "{{.AckCode}}" to acknowledge`,
+	SMSAcknowledged:   `Chicken Little has received your acknowledgment.  Thanks!`,
+	SMSRetrigger:      `Chicken Little has received your acknowledgment.  If notification {{.AckCode}} isn't resolved in {{.RetriggerMinutes}} minutes, you'll be notified again.`,
+	SMSUnrecognized:   `I'm sorry but I don't recognize that response.  Reply with the three-digit code from the notification you received to acknowledge it, or with ACK, SNOOZE or ESC and the code.  Add a duration like 1h to an ACK to be notified again if it isn't resolved by then.  STATUS lists your open notifications and OFF hands them all off.`,
+	SMSAckWhich:       "{{if .Pages}}You have {{len .Pages}} open notifications.  Reply ACK with the code of the one you're acknowledging:{{range .Pages}}\n{{if .Code}}{{.Code}}{{else}}---{{end}}: {{.Content}}{{end}}{{else}}You have no open notifications.{{end}}",
+	SMSSnoozed:        `Notification {{.AckCode}} has been snoozed for {{.SnoozeMinutes}} minutes.`,
+	SMSEscalated:      `Notification {{.AckCode}} is being escalated.`,
+	SMSNoEscalation:   `Sorry, there is no one left to escalate notification {{.AckCode}} to.`,
+	SMSStatus:         "{{if .Pages}}Your open notifications:{{range .Pages}}\n{{if .Code}}{{.Code}}{{else}}---{{end}}: {{.Content}} (step {{.Step}}, {{.State}}){{end}}{{else}}You have no open notifications.{{end}}",
+	SMSHandedOff:      "{{if .Pages}}Handed off {{len .Pages}} notification(s):{{range .Pages}}\n{{if .Code}}{{.Code}}{{else}}---{{end}}: {{.Content}}{{end}}{{else}}You have no notifications that can be handed off.{{end}}",
+	SMSTaken:          `{{.TakenBy}} has acknowledged "{{.Title}}".  You don't need to respond.`,
+	VoiceIntro:        `This is Chicken Little with a message for you.`,
+	VoiceMessage:      `{{.Title}}`,
+	VoicePrompt:       `Press {{.AckDigit}} to acknowledge receipt of this message, 2 to escalate it, 3 to snooze it for {{.SnoozeMinutes}} minutes, 4 to acknowledge it but be called again in {{.RetriggerMinutes}} minutes if it isn't resolved, or 9 to hear it again.`,
+	VoiceAcknowledged: `Thank you. This message has been acknowledged. Goodbye!`,
+	VoiceRetrigger:    `Thank you. This message has been acknowledged. If it isn't resolved in {{.RetriggerMinutes}} minutes, you'll be called again. Goodbye!`,
+	VoiceRejected:     `Sorry, that is not one of the choices.`,
+	VoicePINPrompt:    `Enter your PIN, followed by the pound key, to acknowledge this message.`,
+	VoicePINRejected:  `Sorry, that PIN is not correct.`,
+	VoiceEscalated:    `This message is being escalated. Goodbye!`,
+	VoiceNoEscalation: `Sorry, there is no one left to escalate this message to.`,
+	VoiceSnoozed:      `This message has been snoozed for {{.SnoozeMinutes}} minutes. Goodbye!`,
+	EmailSubject:      `Chicken Little message received`,
+	EmailText:         "You've received a message from the Chicken Little alert system:\n\n{{if ne .Title .Content}}{{.Title}}\n\n{{end}}{{.Content}}{{if .Details}}\n\n{{.Details}}{{end}}{{if .Severity}}\n\nSeverity: {{.Severity}}{{end}}{{if .Source}}\n\nSource: {{.Source}}{{end}}{{if .Links}}\n{{range .Links}}\n{{if .Text}}{{.Text}}: {{end}}{{.URL}}{{end}}{{end}}\n\nStop notifications for this alert: {{.StopURL}}\n\nAcknowledge it, but be notified again in an hour if it isn't resolved: {{.StopURL}}?snooze=1h{{if .AckByReply}}\n\nYou can also reply to this e-mail with \"ack\" to stop notifications.{{end}}",
+	EmailHTML:         `<HTML><BODY>You've received a message from the Chicken Little alert system:<BR><BR>{{if ne .Title .Content}}<B>{{.Title}}</B><BR><BR>{{end}}{{.Content}}{{if .Details}}<BR><BR>{{.Details}}{{end}}{{if .Severity}}<BR><BR>Severity: {{.Severity}}{{end}}{{if .Source}}<BR><BR>Source: {{.Source}}{{end}}{{if .Links}}<BR>{{range .Links}}<BR><A HREF='{{.URL}}'>{{or .Text .URL}}</A>{{end}}{{end}}<BR><BR><A HREF='{{.StopURL}}'>Stop notifications for this alert</A><BR><A HREF='{{.StopURL}}?snooze=1h'>Acknowledge it, but be notified again in an hour if it isn't resolved</A>{{if .AckByReply}}<BR><BR>You can also reply to this e-mail with "ack" to stop notifications.{{end}}</BODY></HTML>`,
+	EmailTakenSubject: `Chicken Little message acknowledged by {{.TakenBy}}`,
+	EmailTakenText:    "{{.TakenBy}} has acknowledged this message from the Chicken Little alert system, so you don't need to respond:\n\n{{.Content}}",
+}
+
+func (mt *MessageTemplates) Marshal() ([]byte, error) {
+	jmt, err := json.Marshal(mt)
+	return jmt, err
+}
+
+func (mt *MessageTemplates) Unmarshal(jmt string) error {
+	err := json.Unmarshal([]byte(jmt), mt)
+	return err
+}
+
+// Maps each template's name to its source
+func (mt *MessageTemplates) byName() map[string]*string {
+	return map[string]*string{
+		"sms":                 &mt.SMS,
+		"sms_acknowledged":    &mt.SMSAcknowledged,
+		"sms_retrigger":       &mt.SMSRetrigger,
+		"sms_unrecognized":    &mt.SMSUnrecognized,
+		"sms_ack_which":       &mt.SMSAckWhich,
+		"sms_snoozed":         &mt.SMSSnoozed,
+		"sms_escalated":       &mt.SMSEscalated,
+		"sms_no_escalation":   &mt.SMSNoEscalation,
+		"sms_status":          &mt.SMSStatus,
+		"sms_handed_off":      &mt.SMSHandedOff,
+		"sms_taken":           &mt.SMSTaken,
+		"voice_intro":         &mt.VoiceIntro,
+		"voice_message":       &mt.VoiceMessage,
+		"voice_prompt":        &mt.VoicePrompt,
+		"voice_acknowledged":  &mt.VoiceAcknowledged,
+		"voice_retrigger":     &mt.VoiceRetrigger,
+		"voice_rejected":      &mt.VoiceRejected,
+		"voice_pin_prompt":    &mt.VoicePINPrompt,
+		"voice_pin_rejected":  &mt.VoicePINRejected,
+		"voice_escalated":     &mt.VoiceEscalated,
+		"voice_no_escalation": &mt.VoiceNoEscalation,
+		"voice_snoozed":       &mt.VoiceSnoozed,
+		"email_subject":       &mt.EmailSubject,
+		"email_text":          &mt.EmailText,
+		"email_html":          &mt.EmailHTML,
+		"email_taken_subject": &mt.EmailTakenSubject,
+		"email_taken_text":    &mt.EmailTakenText,
+	}
+}
+
+// Copies every template that's set in o over the top of mt
+func (mt *MessageTemplates) merge(o *MessageTemplates) {
+	if o == nil {
+		return
+	}
+
+	dst := mt.byName()
+	for name, src := range o.byName() {
+		if *src != "" {
+			*dst[name] = *src
+		}
+	}
+}
+
+// Make sure that every template parses and can be executed
+func (mt *MessageTemplates) Validate() error {
+	sample := &MessageData{
+		Username:      "lancelot",
+		FullName:      "Sir Lancelot",
+		Content:       "Test",
+		Title:         "Test",
+		Details:       "Test details",
+		Source:        "test",
+		Severity:      "critical",
+		Links:         []Link{{Text: "Runbook", URL: "https://runbooks.example.com/test"}},
+		UUID:          "00000000-0000-0000-0000-000000000000",
+		AckCode:       "123",
+		AckDigit:      "1",
+		SnoozeMinutes: 15,
+		StopURL:       "http://localhost/00000000-0000-0000-0000-000000000000/stop",
+		Step:          1,
+		Pages:         []PageSummary{{Code: "123", Content: "Test", Step: 1, State: StateNotifying}},
+		TakenBy:       "Sir Galahad",
+
+		RetriggerMinutes: 60,
+	}
+
+	for name, src := range mt.byName() {
+		if *src == "" {
+			continue
+		}
+
+		_, err := executeTemplate(name, *src, sample)
+		if err != nil {
+			return fmt.Errorf("Template %v is invalid: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Executes a template with d.  email_html is treated as an html/template; everything else is plain text.
+func executeTemplate(name, src string, d *MessageData) (string, error) {
+	if name == "email_html" {
+		return executeHTMLTemplate(name, src, d)
+	}
+	return executeTextTemplate(name, src, d)
+}
+
+func executeTextTemplate(name, src string, d *MessageData) (string, error) {
+	var b bytes.Buffer
+
+	t, err := template.New(name).Parse(src)
+	if err != nil {
+		return "", err
+	}
+
+	err = t.Execute(&b, d)
+	if err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+func executeHTMLTemplate(name, src string, d *MessageData) (string, error) {
+	var b bytes.Buffer
+
+	t, err := htmltemplate.New(name).Parse(src)
+	if err != nil {
+		return "", err
+	}
+
+	err = t.Execute(&b, d)
+	if err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Fetch the stored MessageTemplates for a language from the DB
+func (c *ChickenLittle) GetMessageTemplates(language string) (*MessageTemplates, error) {
+	jmt, err := c.DB.Fetch("templates", language)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch message templates from DB: templates for %v do not exist", language)
+	}
+
+	mt := &MessageTemplates{}
+
+	err = mt.Unmarshal(jmt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal message templates from DB.  Err: %v  JSON: %v", err, jmt)
+	}
+
+	return mt, nil
+}
+
+// Store the MessageTemplates for a language in the DB
+func (c *ChickenLittle) StoreMessageTemplates(language string, mt *MessageTemplates) error {
+	jmt, err := mt.Marshal()
+	if err != nil {
+		return fmt.Errorf("Could not marshal message templates %+v", mt)
+	}
+
+	err = c.DB.Store("templates", language, string(jmt))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete the MessageTemplates for a language from the DB
+func (c *ChickenLittle) DeleteMessageTemplates(language string) error {
+	err := c.DB.Delete("templates", language)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the templates to use for a language.  Templates are layered, with each layer overriding
+// the one before it: the built-in templates, the default templates from the config file and then
+// the DB, and finally the language's own templates from the config file and then the DB.
+func (c *ChickenLittle) MessageTemplatesFor(language string) MessageTemplates {
+	mt := builtinTemplates
+
+	languages := []string{defaultTemplateLanguage}
+	if language != "" && language != defaultTemplateLanguage {
+		languages = append(languages, language)
+	}
+
+	configured := c.CurrentConfig().Templates
+
+	for _, l := range languages {
+		if ct, ok := configured[l]; ok {
+			mt.merge(&ct)
+		}
+
+		// The DB handle is not available during some tests and config checks
+		if c.DB.Handle == nil {
+			continue
+		}
+
+		dt, err := c.GetMessageTemplates(l)
+		if err == nil {
+			mt.merge(dt)
+		}
+	}
+
+	return mt
+}
+
+// Renders one of the message templates for d.Language.  If the template can't be rendered,
+// the error is logged and the built-in template is used instead.
+func RenderMessage(name string, d *MessageData) string {
+	mt := c.MessageTemplatesFor(d.Language)
+
+	src, ok := mt.byName()[name]
+	if !ok {
+		logger.Error("Unknown message template", "template", name)
+		return d.Content
+	}
+
+	out, err := executeTemplate(name, *src, d)
+	if err != nil {
+		logger.Error("Could not render message template.  Using the built-in template.", "template", name, "language", d.Language, "err", err)
+		out, _ = executeTemplate(name, *builtinTemplates.byName()[name], d)
+	}
+
+	return out
+}
+
+// Gathers the template variables for a notification-in-progress
+func messageData(uuid string) *MessageData {
+	d := &MessageData{UUID: uuid}
+
+	if uuid == "" {
+		return d
+	}
+
+	d.StopURL = fmt.Sprint(c.CurrentConfig().Service.ClickURLBase, "/", uuid, "/stop")
+
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	d.Content = NIP.Messages[uuid]
+	d.Title = d.Content
+	d.Step = NIP.Steps[uuid]
+
+	if nr, exists := NIP.Requests[uuid]; exists {
+		d.Title = nr.headline()
+		d.Details = nr.Details
+		d.Source = nr.Source
+		d.Severity = nr.Severity
+		d.Links = nr.Links
+
+		if nr.Person != nil {
+			d.Username = nr.Person.Username
+			d.FullName = nr.Person.FullName
+			d.Language = nr.Person.Language
+		}
+	}
+
+	return d
+}
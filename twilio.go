@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"math/rand"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"bitbucket.org/ckvist/twilio/twiml"
 	"github.com/gorilla/mux"
@@ -39,85 +41,90 @@ type SMSResponse struct {
 	Uri         string
 }
 
+// How many times we'll attempt a Twilio API request before giving up, and how long we wait
+// before the first retry.  The wait doubles with every subsequent retry.
+var (
+	twilioMaxAttempts  = 3
+	twilioRetryBackoff = 2 * time.Second
+)
+
 // Sends an SMS text message to a phone number using the Twilio API,
 // optionally including a method for acknowledging receipt of the message.
-func SendSMS(phoneNumber, message, uuid string, dontSendAckRequest bool) {
+func SendSMS(phoneNumber, message, uuid string, dontSendAckRequest bool) error {
 	var cr SMSResponse
 
-	if uuid != "" {
-		log.Println("[", uuid, "]", "Sending SMS to", phoneNumber, "with message:", message)
-	} else {
-		log.Println("Sending SMS to", phoneNumber, "with message:", message)
-	}
+	l := notificationLogger(uuid)
+	l.Info("Sending SMS")
+	l.Debug("SMS details", "to", phoneNumber, "content", message)
 
-	// Generate an int in the range 100 <= n <= 999
-	ackReply := rand.Intn(899) + 100
+	// Every part of the send uses the same config, even if it's reloaded while we're sending
+	cfg := c.CurrentConfig()
 
 	// Builds a form that will be posted to Twilio API
 	u := url.Values{}
-	u.Set("From", c.Config.Integrations.Twilio.CallFromNumber)
+	u.Set("From", cfg.Integrations.Twilio.CallFromNumber)
 	u.Set("To", phoneNumber)
 
 	// Sometimes we send texts that don't require ACKing.  This handles that.
+	var ackReply string
+	var freshAckReply bool
 	if dontSendAckRequest {
 		u.Set("Body", message)
 	} else {
-		u.Set("Body", fmt.Sprint(message, " - Reply with \"", ackReply, "\" to acknowledge"))
+		var err error
+
+		ackReply, freshAckReply, err = reserveAckCode(phoneNumber, uuid)
+		if err != nil {
+			l.Error("Could not reserve an acknowledgement code", "err", err)
+			return err
+		}
 
+		d := messageData(uuid)
+		d.Content = message
+		d.AckCode = ackReply
+		u.Set("Body", RenderMessage("sms", d))
 	}
 
 	// If we have a UUID, we can request status callbacks for this SMS
 	if uuid != "" {
-		u.Set("StatusCallback", fmt.Sprint(c.Config.Service.CallbackURLBase, "/", uuid, "/callback"))
+		u.Set("StatusCallback", fmt.Sprint(cfg.Service.CallbackURLBase, "/", uuid, "/callback"))
 	}
 
-	// Post the request to the Twilio API
-	body := *strings.NewReader(u.Encode())
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", fmt.Sprint(c.Config.Integrations.Twilio.APIBaseURL, c.Config.Integrations.Twilio.AccountSID, "/Messages.json"), &body)
-	req.SetBasicAuth(c.Config.Integrations.Twilio.AccountSID, c.Config.Integrations.Twilio.AuthToken)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := client.Do(req)
+	err := postToTwilio(cfg.Integrations.Twilio, "/Messages.json", u, &cr)
 	if err != nil {
-		log.Println("SendSMS() Request error:", err)
-	}
-
-	// Get the response
-	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*20))
-	resp.Body.Close()
-
-	err = json.Unmarshal(b, &cr)
-	if err != nil {
-		log.Fatalln("SendSMS() Error unmarshalling JSON:", err)
+		l.Error("Sending SMS failed", twilioErrorFields(err)...)
+		// A code that earlier texts went out with still has to work for them
+		if freshAckReply {
+			releaseAckCode(phoneNumber, ackReply)
+		}
+		return err
 	}
 
-	if uuid != "" {
-		// We create conversation key that's a combination of our recipient's phone number and the random 3-digit key
-		// that we generated above
-		conversationKey := fmt.Sprint(cr.To, "::", ackReply)
-
-		NIP.Mu.Lock()
-		defer NIP.Mu.Unlock()
-
-		NIP.Conversations[conversationKey] = uuid
+	// Replies come from the number as Twilio formatted it, which might not be how it's written in the plan
+	if ackReply != "" && cr.To != "" && cr.To != phoneNumber {
+		aliasAckCode(phoneNumber, cr.To, ackReply)
 	}
 
+	return nil
 }
 
 // Makes a phone call to a phone number using the Twilio API.  Sends Twilio a URL for
 // retrieving the TwiML that defines the interaction in the call.
-func MakePhoneCall(phoneNumber, message, uuid string) {
+func MakePhoneCall(phoneNumber, message, uuid string) error {
 	var cr map[string]interface{}
 
-	log.Println("[", uuid, "] Calling", phoneNumber, "with message:", message)
+	l := notificationLogger(uuid)
+	l.Info("Placing phone call")
+	l.Debug("Phone call details", "to", phoneNumber, "content", message)
+
+	// Every part of the call setup uses the same config, even if it's reloaded while we're calling
+	cfg := c.CurrentConfig()
 
 	// Build a form that we'll POST to the Twilio API to initiate a phone call
 	u := url.Values{}
-	u.Set("From", c.Config.Integrations.Twilio.CallFromNumber)
+	u.Set("From", cfg.Integrations.Twilio.CallFromNumber)
 	u.Set("To", phoneNumber)
-	u.Set("Url", fmt.Sprint(c.Config.Service.CallbackURLBase, "/", uuid, "/twiml/notify"))
+	u.Set("Url", fmt.Sprint(cfg.Service.CallbackURLBase, "/", uuid, "/twiml/notify"))
 	// Optional status callbacks are enabled below...
 	// u.Set("StatusCallback", fmt.Sprint(c.Config.Service.CallbackURLBase, "/", uuid, "/callback"))
 	// u.Add("StatusCallbackEvent", "ringing")
@@ -125,82 +132,237 @@ func MakePhoneCall(phoneNumber, message, uuid string) {
 	// u.Add("StatusCallbackEvent", "completed")
 	u.Set("IfMachine", "Hangup")
 	u.Set("Timeout", "20")
-	body := *strings.NewReader(u.Encode())
 
-	// Send our form to Twilio
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", fmt.Sprint(c.Config.Integrations.Twilio.APIBaseURL, c.Config.Integrations.Twilio.AccountSID, "/Calls.json"), &body)
-	req.SetBasicAuth(c.Config.Integrations.Twilio.AccountSID, c.Config.Integrations.Twilio.AuthToken)
+	// We get the response back but don't currently do anything with it.
+	err := postToTwilio(cfg.Integrations.Twilio, "/Calls.json", u, &cr)
+	if err != nil {
+		l.Error("Placing phone call failed", twilioErrorFields(err)...)
+		return err
+	}
+
+	return nil
+}
+
+// POSTs a form to a resource under the Twilio account in tc and decodes the JSON response into v.
+// Requests that couldn't be sent, and rate limiting and 5xx responses, are retried with an
+// exponential backoff until we start shutting down.  Any failure is returned as a *TwilioError.
+func postToTwilio(tc Twilio, resource string, form url.Values, v interface{}) error {
+	var err error
+
+	backoff := twilioRetryBackoff
+
+	for attempt := 1; attempt <= twilioMaxAttempts; attempt++ {
+		err = doTwilioRequest(tc, resource, form, v)
+		if te, ok := err.(*TwilioError); ok {
+			metrics.ProviderErrors.Inc("twilio", strings.Replace(te.Kind.String(), " ", "_", -1))
+			if te.Body != "" {
+				logger.Debug("Twilio error response", "resource", resource, "status", te.StatusCode, "body", te.Body)
+			}
+		}
+		if te, ok := err.(*TwilioError); !ok || !te.retryable() {
+			return err
+		}
+
+		if attempt < twilioMaxAttempts {
+			logger.Warn("Twilio request failed.  Retrying.", "resource", resource, "attempt", attempt, "max_attempts", twilioMaxAttempts, "err", err, "backoff", backoff)
+
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-shuttingDown():
+				timer.Stop()
+				logger.Warn("Shutting down.  Not retrying Twilio request.", "resource", resource)
+				return err
+			}
+			backoff *= 2
+		}
+	}
+
+	return err
+}
+
+// Makes a single POST to the Twilio API
+func doTwilioRequest(tc Twilio, resource string, form url.Values, v interface{}) error {
+	body := strings.NewReader(form.Encode())
+	req, err := http.NewRequest("POST", fmt.Sprint(tc.APIBaseURL, tc.AccountSID, resource), body)
+	if err != nil {
+		return &TwilioError{Kind: TwilioRequestError, Err: err}
+	}
+	req.SetBasicAuth(tc.AccountSID, tc.AuthToken)
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
+	// Note whether the request made it out, since a failure after that doesn't mean that Twilio didn't act on it
+	var sent int32
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		WroteRequest: func(wri httptrace.WroteRequestInfo) {
+			if wri.Err == nil {
+				atomic.StoreInt32(&sent, 1)
+			}
+		},
+	}))
+
+	client := &http.Client{Timeout: 30 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("MakePhoneCall() Request error:", err)
+		return &TwilioError{Kind: TwilioNetworkError, Sent: atomic.LoadInt32(&sent) == 1, Err: err}
 	}
+	defer resp.Body.Close()
 
+	// Get the response
 	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*20))
-	resp.Body.Close()
-
-	// We get the response back but don't currently do anything with it.   TO DO: implement error handling
-	err = json.Unmarshal(b, &cr)
 	if err != nil {
-		log.Fatalln("MakePhoneCall() Error unmarshalling JSON:", err)
+		return &TwilioError{Kind: TwilioNetworkError, StatusCode: resp.StatusCode, Sent: true, Err: err}
 	}
 
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		te := &TwilioError{StatusCode: resp.StatusCode, Body: string(b)}
+		// Twilio describes the error in a JSON body but we can still classify the error without it
+		json.Unmarshal(b, te)
+		classifyTwilioError(te)
+		return te
+	}
+
+	if v != nil {
+		err = json.Unmarshal(b, v)
+		if err != nil {
+			return &TwilioError{Kind: TwilioResponseError, StatusCode: resp.StatusCode, Err: fmt.Errorf("Error unmarshalling JSON: %v", err)}
+		}
+	}
+
+	return nil
 }
 
-// Receives the SMS reply callback from Twilio and deletes the notification if the
-// response text matches the code sent with the original SMS notification
+// Receives the SMS reply callback from Twilio and carries out the command in the reply.
+// People can acknowledge, snooze or escalate a notification by replying with its code,
+// ask for a list of their open notifications, or hand all of them off.
 func ReceiveSMSReply(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		log.Println("ReceiveSMSReply() r.ParseForm() error:", err)
+		logger.Error("Could not parse SMS reply", "err", err)
 	}
 
 	// We should have a "From" parameter being passed from Twilio
 	recipient := r.FormValue("From")
 	if recipient == "" {
-		log.Println("ReceiveSMSReply() error: 'From' parameter was not provided in response")
+		logger.Error("SMS reply has no From parameter")
 		return
 	}
 
-	NIP.Mu.Lock()
+	cmd, err := parseSMSCommand(r.FormValue("Body"))
+	if err != nil {
+		logger.Info("Unrecognized SMS reply", "err", err)
+		logger.Debug("Unrecognized SMS reply details", "from", recipient, "body", r.FormValue("Body"))
+		SendSMS(recipient, RenderMessage("sms_unrecognized", messageData("")), "", true)
+		return
+	}
 
-	// Our conversation key is a combination of the recipient's phone number and the 3-digit code
-	// that they sent in reply
-	conversationKey := fmt.Sprint(recipient, "::", r.FormValue("Body"))
+	switch cmd.Verb {
+	case StatusCommand:
+		pages := openPages(recipient)
 
-	// See if this SMS conversation is active.  If it is, look up the UUID with the conversation key.
-	if _, exists := NIP.Conversations[conversationKey]; exists {
-		uuid := NIP.Conversations[conversationKey]
+		d := smsReplyData(pages)
+		d.Pages = pages
+		SendSMS(recipient, RenderMessage("sms_status", d), "", true)
+		return
+	case OffCommand:
+		pages := openPages(recipient)
+
+		// Without on-call rotations, handing off means passing each notification along to the next
+		// step of its plan.  Notifications on their last step have nowhere else to go.
+		d := smsReplyData(pages)
+		for _, p := range pages {
+			if canEscalate(p.UUID) {
+				notificationLogger(p.UUID).Info("Hand-off requested by SMS")
+				controlChan <- NotificationControl{UUID: p.UUID, Action: EscalateAction}
+				d.Pages = append(d.Pages, p)
+			}
+		}
+		SendSMS(recipient, RenderMessage("sms_handed_off", d), "", true)
+		return
+	}
 
-		log.Println("[", uuid, "]", "Recieved a SMS reply from", recipient, ":", r.FormValue("Body"))
+	// The rest of our commands apply to the notification that the code was sent for
+	var uuid string
+	var exists bool
 
-		if _, exists := NIP.Stoppers[uuid]; !exists {
-			log.Println("ReceiveSMSReply(): No active notifications for this UUID:", uuid)
-			http.Error(w, "", http.StatusNotFound)
-			NIP.Mu.Unlock()
+	if cmd.Code != "" {
+		uuid, exists = smsConversation(recipient, cmd.Code)
+	} else {
+		// A bare ACK needs to be unambiguous, and can only be a reply to a page that texted this number
+		pages := textedPages(recipient)
+		if len(pages) != 1 {
+			d := smsReplyData(pages)
+			d.Pages = pages
+			SendSMS(recipient, RenderMessage("sms_ack_which", d), "", true)
 			return
 		}
+		uuid, exists = pages[0].UUID, true
+		cmd.Code = pages[0].Code
+	}
 
-		// Delete the conversation key from the in-progress store
-		delete(NIP.Conversations, conversationKey)
+	if !exists {
+		logger.Info("SMS reply does not match an active notification", "code", cmd.Code)
+		logger.Debug("Unmatched SMS reply details", "from", recipient)
+		SendSMS(recipient, RenderMessage("sms_unrecognized", messageData("")), "", true)
+		return
+	}
 
-		// Unlock our mutex so the notification engine can take it
-		NIP.Mu.Unlock()
+	l := notificationLogger(uuid)
+	l.Info("Received an SMS reply", "command", cmd.Verb, "code", cmd.Code)
+	l.Debug("SMS reply details", "from", recipient, "body", r.FormValue("Body"))
 
-		log.Println("[", uuid, "] Attempting to stop notifications")
+	// Render our reply before the notification is changed
+	d := messageData(uuid)
+	d.AckCode = cmd.Code
 
-		// Attempt to stop the notification by sending the UUID to the notification engine
-		stopChan <- uuid
+	switch cmd.Verb {
+	case AckCommand:
+		reply := RenderMessage("sms_acknowledged", d)
 
-		SendSMS(recipient, "Chicken Little has received your acknowledgment.  Thanks!", uuid, true)
+		if cmd.Snooze > 0 {
+			d.RetriggerMinutes = int(cmd.Snooze.Minutes())
+			reply = RenderMessage("sms_retrigger", d)
+			l.Info("Acknowledged by SMS until a re-trigger", "for", cmd.Snooze)
+		} else {
+			l.Info("Acknowledged by SMS.  Attempting to stop notifications.")
+		}
 
-	} else {
-		SendSMS(recipient, "I'm sorry but I don't recognize that response.   Please acknowledge with the three-digit code from the notfication you received.", "", true)
+		acknowledgeNotification(uuid, AckChannelSMS, cmd.Snooze)
+
+		SendSMS(recipient, reply, uuid, true)
+	case SnoozeCommand:
+		l.Info("Snooze requested by SMS", "for", cmd.Snooze)
+		controlChan <- NotificationControl{UUID: uuid, Action: SnoozeAction, Snooze: cmd.Snooze}
+
+		d.SnoozeMinutes = int(cmd.Snooze.Minutes())
+		SendSMS(recipient, RenderMessage("sms_snoozed", d), uuid, true)
+	case EscalateCommand:
+		if !canEscalate(uuid) {
+			SendSMS(recipient, RenderMessage("sms_no_escalation", d), uuid, true)
+			return
+		}
+
+		l.Info("Escalation requested by SMS")
+		controlChan <- NotificationControl{UUID: uuid, Action: EscalateAction}
+
+		SendSMS(recipient, RenderMessage("sms_escalated", d), uuid, true)
 	}
+}
 
+// The template variables for a reply that isn't about one notification in particular.  The reply is
+// written in the language of the person who was sent the first of pages.
+func smsReplyData(pages []PageSummary) *MessageData {
+	if len(pages) == 0 {
+		return messageData("")
+	}
+
+	d := messageData(pages[0].UUID)
+	return &MessageData{
+		Username: d.Username,
+		FullName: d.FullName,
+		Language: d.Language,
+	}
 }
 
 // Receives call progress callbacks from the Twilio API.  Not currently used.
@@ -225,7 +387,9 @@ func ReceiveCallback(w http.ResponseWriter, r *http.Request) {
 }
 
 // Receives digits pressed during a phone call via callback by the Twilio API.
-// Stops the notification if the user pressed any keys.
+// The person can acknowledge the notification (after entering their PIN, if their
+// voice options require one), either for good or until it's re-triggered, escalate it
+// to the next plan step, snooze it or hear the message again.
 func ReceiveDigits(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
@@ -233,45 +397,135 @@ func ReceiveDigits(w http.ResponseWriter, r *http.Request) {
 
 	err := r.ParseForm()
 	if err != nil {
-		log.Println("ReceiveDigits() r.ParseForm() error:", err)
+		logger.Error("Could not parse digits from call", "uuid", uuid, "err", err)
 	}
 
 	// Fetch some form values we'll need from Twilio's request
 	digits := r.FormValue("Digits")
 	callSid := r.FormValue("CallSid")
 
-	// If digits has been set, user has answered the phone and pressed (any) key to acknowledge the message
-	if digits != "" {
+	// If digits has been set, user has answered the phone and pressed a key
+	if digits == "" {
+		return
+	}
 
-		if _, exists := NIP.Stoppers[uuid]; !exists {
-			log.Println("ReceiveDigits(): No active notifications for this UUID:", uuid)
-			http.Error(w, "", http.StatusNotFound)
+	if !notificationInProgress(uuid) {
+		logger.Info("Digits received for a notification that is not active", "uuid", uuid)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	l := notificationLogger(uuid)
+	cfg := c.CurrentConfig()
+
+	v, pin := callOptions(uuid)
+	d := voiceMessageData(uuid, v)
+
+	say := func(name string) twiml.Say {
+		return twiml.Say{
+			Voice:    sayVoice(v, "woman"),
+			Language: v.Language,
+			Text:     RenderMessage(name, d),
+		}
+	}
+	startOver := twiml.Redirect{
+		Url: fmt.Sprint(cfg.Service.CallbackURLBase, "/", uuid, "/twiml/notify"),
+	}
+
+	resp := twiml.NewResponse()
+
+	// The person has entered their PIN after choosing to acknowledge
+	if menu := r.FormValue("menu"); menu == "pin" || menu == "pin-retrigger" {
+		if !acceptsPIN(pin, digits) {
+			// A pocket-dial or the wrong person answering shouldn't acknowledge the message, so
+			// we tell them so and start the message over.
+			l.Info("PIN entered does not acknowledge this notification")
+			resp.Action(say("voice_pin_rejected"), startOver)
+			resp.Send(w)
 			return
 		}
+		var snooze time.Duration
+		if menu == "pin-retrigger" {
+			snooze = defaultRetriggerPeriod
+		}
+		acknowledgeCall(uuid, callSid, d, v, snooze)
+		return
+	}
 
-		// We matched a valid notification-in-progress and the user pressed digits when prompted
-		// so we'll do a POST to Twilio that points the call at a TwiML routine that confirms
-		// their acknowledgement and sends them on their way.
-		u := url.Values{}
-		u.Set("Url", fmt.Sprint(c.Config.Service.CallbackURLBase, "/", uuid, "/twiml/acknowledged"))
-
-		// Send our POST to Twilio
-		body := *strings.NewReader(u.Encode())
-		client := &http.Client{}
-		req, _ := http.NewRequest("POST", fmt.Sprint(c.Config.Integrations.Twilio.APIBaseURL, c.Config.Integrations.Twilio.AccountSID, "/Calls/", callSid), &body)
-		req.SetBasicAuth(c.Config.Integrations.Twilio.AccountSID, c.Config.Integrations.Twilio.AuthToken)
-		req.Header.Add("Accept", "application/json")
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-		// Send the POST request
-		_, err := client.Do(req)
-		if err != nil {
-			log.Println("ReceiveDigits() TwiML POST Request error:", err)
+	switch digits {
+	case ackDigit(v), retriggerDigit:
+		var snooze time.Duration
+		menu := "pin"
+		if digits == retriggerDigit {
+			snooze = defaultRetriggerPeriod
+			menu = "pin-retrigger"
 		}
 
-		// Attempt to stop the notification by sending the UUID to the notification engine
-		stopChan <- uuid
+		if v.RequirePIN {
+			resp.Gather(twiml.Gather{
+				Action:      fmt.Sprint(cfg.Service.CallbackURLBase, "/", uuid, "/digits?menu=", menu),
+				Timeout:     15,
+				NumDigits:   maxPINLength, // We only have the hash, so we can't tell how long the PIN is
+				FinishOnKey: "#",
+			}, say("voice_pin_prompt"))
+			resp.Action(startOver)
+			break
+		}
+		acknowledgeCall(uuid, callSid, d, v, snooze)
+		return
+	case escalateDigit:
+		if !canEscalate(uuid) {
+			resp.Action(say("voice_no_escalation"), startOver)
+			break
+		}
+		l.Info("Escalation requested by phone")
+		controlChan <- NotificationControl{UUID: uuid, Action: EscalateAction}
+		resp.Action(say("voice_escalated"), twiml.Hangup{})
+	case snoozeDigit:
+		l.Info("Snooze requested by phone", "for", defaultSnoozePeriod)
+		controlChan <- NotificationControl{UUID: uuid, Action: SnoozeAction, Snooze: defaultSnoozePeriod}
+		resp.Action(say("voice_snoozed"), twiml.Hangup{})
+	case repeatDigit:
+		resp.Action(startOver)
+	default:
+		l.Info("Digits entered are not a menu choice")
+		resp.Action(say("voice_rejected"), startOver)
+	}
+
+	resp.Send(w)
+}
+
+// Points an acknowledged call at a TwiML routine that confirms the acknowledgement and sends
+// the person on their way, then stops the notification, or acknowledges it until a re-trigger
+// if there's a snooze.
+func acknowledgeCall(uuid, callSid string, d *MessageData, v VoiceOptions, snooze time.Duration) {
+	cfg := c.CurrentConfig()
+
+	// The notification will be gone by the time that TwiML is requested, so we pass along
+	// how it should be spoken.
+	u := url.Values{}
+	ack := url.Values{}
+	ack.Set("language", d.Language)
+	ack.Set("voice", v.Voice)
+	ack.Set("voice_language", v.Language)
+	if snooze > 0 {
+		ack.Set("retrigger", strconv.Itoa(int(snooze.Minutes())))
+	}
+	u.Set("Url", fmt.Sprint(cfg.Service.CallbackURLBase, "/", uuid, "/twiml/acknowledged?", ack.Encode()))
+
+	// Send our POST to Twilio
+	err := postToTwilio(cfg.Integrations.Twilio, fmt.Sprint("/Calls/", callSid), u, nil)
+	if err != nil {
+		logger.Error("Could not redirect acknowledged call", append([]interface{}{"uuid", uuid}, twilioErrorFields(err)...)...)
+	}
+
+	if snooze > 0 {
+		notificationLogger(uuid).Info("Acknowledged by phone until a re-trigger", "for", snooze)
+	} else {
+		notificationLogger(uuid).Info("Acknowledged by phone.  Attempting to stop notifications.")
 	}
+
+	acknowledgeNotification(uuid, AckChannelPhone, snooze)
 }
 
 // This Twilio callback generates TwiML that is used to describe the flow of the phone call.
@@ -285,43 +539,82 @@ func GenerateTwiML(w http.ResponseWriter, r *http.Request) {
 	switch action {
 	case "notify":
 		// This is a request for a TwiML script for a standard message notification
-		if _, exists := NIP.Stoppers[uuid]; !exists {
+		if !notificationInProgress(uuid) {
 			http.Error(w, "No active notifications for this UUID", http.StatusNotFound)
 			return
 		}
 
+		v, _ := callOptions(uuid)
+		d := voiceMessageData(uuid, v)
+
 		intro := twiml.Say{
-			Voice: "woman",
-			Text:  "This is Chicken Little with a message for you.",
+			Voice:    sayVoice(v, "woman"),
+			Language: v.Language,
+			Text:     RenderMessage("voice_intro", d),
 		}
 
 		gather := twiml.Gather{
-			Action:    fmt.Sprint(c.Config.Service.CallbackURLBase, "/", uuid, "/digits"),
+			Action:    fmt.Sprint(c.CurrentConfig().Service.CallbackURLBase, "/", uuid, "/digits"),
 			Timeout:   15,
 			NumDigits: 1,
 		}
 
 		theMessage := twiml.Say{
-			Voice: "man",
-			Text:  NIP.Messages[uuid],
+			Voice:    sayVoice(v, "man"),
+			Language: v.Language,
+			Text:     RenderMessage("voice_message", d),
 		}
 
 		pressAny := twiml.Say{
-			Voice: "woman",
-			Text:  "Press any key to acknowledge receipt of this message",
+			Voice:    sayVoice(v, "woman"),
+			Language: v.Language,
+			Text:     RenderMessage("voice_prompt", d),
+		}
+
+		// Read the message out as many times as the person asked for
+		var nested []interface{}
+		for i := 0; i < v.Repeat || i == 0; i++ {
+			nested = append(nested, theMessage, pressAny)
 		}
 
 		resp.Action(intro)
-		resp.Gather(gather, theMessage, pressAny)
+		resp.Gather(gather, nested...)
 
 	case "acknowledged":
-		// This is a request for the end-of-call wrap-up message
+		// This is a request for the end-of-call wrap-up message.  The notification has usually been
+		// stopped by now, so ReceiveDigits passes along the language to use.
+		d := messageData(uuid)
+		if d.Language == "" {
+			d.Language = r.FormValue("language")
+		}
+
+		v := VoiceOptions{
+			Voice:    r.FormValue("voice"),
+			Language: r.FormValue("voice_language"),
+		}
+
+		// Acknowledgements that run out have their own wrap-up
+		name := "voice_acknowledged"
+		if m, _ := strconv.Atoi(r.FormValue("retrigger")); m > 0 {
+			d.RetriggerMinutes = m
+			name = "voice_retrigger"
+		}
+
 		resp.Action(twiml.Say{
-			Voice: "woman",
-			Text:  "Thank you. This message has been acknowledged. Goodbye!",
+			Voice:    sayVoice(v, "woman"),
+			Language: v.Language,
+			Text:     RenderMessage(name, d),
 		})
 	}
 
 	// Reply to the callback with the TwiML content
 	resp.Send(w)
 }
+
+// The TTS voice to use for a Say, falling back to our usual voice when none was chosen
+func sayVoice(v VoiceOptions, fallback string) string {
+	if v.Voice != "" {
+		return v.Voice
+	}
+	return fallback
+}
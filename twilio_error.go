@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+type TwilioErrorKind int
+
+const (
+	TwilioNetworkError       TwilioErrorKind = iota // 0
+	TwilioAuthError                                 // 1
+	TwilioInvalidNumberError                        // 2
+	TwilioRateLimitedError                          // 3
+	TwilioServerError                               // 4
+	TwilioRequestError                              // 5
+	TwilioResponseError                             // 6
+)
+
+// Twilio error codes that indicate the recipient's number can never be reached.
+// See https://www.twilio.com/docs/api/errors
+var twilioInvalidNumberCodes = map[int]bool{
+	13223: true, // Dial: Invalid phone number format
+	13224: true, // Dial: Invalid phone number
+	21211: true, // Invalid 'To' phone number
+	21214: true, // 'To' phone number cannot be reached
+	21217: true, // Phone number does not appear to be valid
+	21401: true, // Invalid phone number
+	21407: true, // This phone number type does not support SMS
+	21610: true, // Message cannot be sent to the 'To' number because the customer has replied with STOP
+	21614: true, // 'To' number is not a valid mobile number
+}
+
+// Twilio's error messages often quote the phone number that it couldn't reach
+var phoneNumberPattern = regexp.MustCompile(`\+?[0-9][0-9 ().-]{5,}[0-9]`)
+
+// TwilioError describes a failed request to the Twilio API
+type TwilioError struct {
+	Kind       TwilioErrorKind
+	StatusCode int    // HTTP status code returned by Twilio, if we got that far
+	Code       int    `json:"code"`    // Twilio's own error code
+	Message    string `json:"message"` // Twilio's description of the error
+	Body       string `json:"-"`       // The raw response body.  It can contain phone numbers, so only log it at Debug.
+	Sent       bool   `json:"-"`       // Set for network errors once the request was sent, so Twilio may have acted on it
+	Err        error  // The underlying error, if any
+}
+
+// The error, with any phone numbers in Twilio's message taken out so that it's safe to log
+func (e *TwilioError) Error() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprint("Twilio ", e.Kind, ": ", e.Err)
+	case e.Code != 0:
+		return fmt.Sprint("Twilio ", e.Kind, " (HTTP ", e.StatusCode, ", code ", e.Code, "): ", redactPhoneNumbers(e.Message))
+	default:
+		return fmt.Sprint("Twilio ", e.Kind, " (HTTP ", e.StatusCode, "): ", redactPhoneNumbers(e.Message))
+	}
+}
+
+func redactPhoneNumbers(s string) string {
+	return phoneNumberPattern.ReplaceAllString(s, "[redacted]")
+}
+
+// The fields to log a failed Twilio request with.  Twilio's error code says what went wrong without giving
+// away who we were trying to reach.
+func twilioErrorFields(err error) []interface{} {
+	if te, ok := err.(*TwilioError); ok {
+		return []interface{}{"code", te.Code, "status", te.StatusCode, "err", err}
+	}
+	return []interface{}{"err", err}
+}
+
+// Temporary reports whether the request might succeed if it were retried
+func (e *TwilioError) Temporary() bool {
+	switch e.Kind {
+	case TwilioNetworkError, TwilioRateLimitedError, TwilioServerError:
+		return true
+	}
+	return false
+}
+
+// Reports whether postToTwilio should try the request again.  Only requests that never reached Twilio, or that it
+// turned away because it was busy or broken, are retried.  Otherwise we could send the same SMS or place the same
+// call twice.
+func (e *TwilioError) retryable() bool {
+	switch e.Kind {
+	case TwilioNetworkError:
+		return !e.Sent
+	case TwilioRateLimitedError, TwilioServerError:
+		return true
+	}
+	return false
+}
+
+func (k TwilioErrorKind) String() string {
+	switch k {
+	case TwilioNetworkError:
+		return "network error"
+	case TwilioAuthError:
+		return "authentication error"
+	case TwilioInvalidNumberError:
+		return "invalid number"
+	case TwilioRateLimitedError:
+		return "rate limited"
+	case TwilioServerError:
+		return "server error"
+	case TwilioRequestError:
+		return "request rejected"
+	case TwilioResponseError:
+		return "invalid response"
+	}
+	return "unknown error"
+}
+
+// Classify a non-2xx response from the Twilio API.  te should already contain whatever
+// code and message Twilio sent back in the response body.
+func classifyTwilioError(te *TwilioError) {
+	switch {
+	case te.StatusCode == http.StatusUnauthorized || te.StatusCode == http.StatusForbidden:
+		te.Kind = TwilioAuthError
+	case te.StatusCode == http.StatusTooManyRequests || te.Code == 20429:
+		te.Kind = TwilioRateLimitedError
+	case twilioInvalidNumberCodes[te.Code]:
+		te.Kind = TwilioInvalidNumberError
+	case te.StatusCode >= 500:
+		te.Kind = TwilioServerError
+	default:
+		te.Kind = TwilioRequestError
+	}
+
+	if te.Message == "" {
+		te.Message = http.StatusText(te.StatusCode)
+	}
+}
+
+// IsTemporary reports whether err is a transient failure that may succeed on a later attempt
+func IsTemporary(err error) bool {
+	if te, ok := err.(interface{ Temporary() bool }); ok {
+		return te.Temporary()
+	}
+	return false
+}
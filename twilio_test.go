@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testTwilioSMSResponseJson = `
+{
+  "sid": "SM1234567890",
+  "to": "+12108675309",
+  "from": "+15005550006",
+  "body": "Hello World",
+  "status": "queued"
+}
+`
+
+const testTwilioCallResponseJson = `
+{
+  "sid": "CA1234567890",
+  "to": "+12108675309",
+  "from": "+15005550006",
+  "status": "queued"
+}
+`
+
+// A fake Twilio API.  Each request is answered by the next handler in responses;
+// the last handler is reused once the list is exhausted.
+type fakeTwilio struct {
+	responses []http.HandlerFunc
+	requests  int
+}
+
+func (f *fakeTwilio) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := f.requests
+	if n >= len(f.responses) {
+		n = len(f.responses) - 1
+	}
+	f.requests++
+	f.responses[n](w, r)
+}
+
+func twilioReply(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}
+}
+
+// Reads the request and closes the connection without answering, like Twilio timing out after it got the request
+func twilioHangUp(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func TestTwilioErrors(t *testing.T) {
+	// Don't make the tests wait on real backoff periods
+	twilioRetryBackoff = time.Millisecond
+
+	c.Config.Integrations.Twilio.AccountSID = "AC123"
+	c.Config.Integrations.Twilio.AuthToken = "secret"
+	c.Config.Integrations.Twilio.CallFromNumber = "+15005550006"
+
+	tests := []struct {
+		name      string
+		responses []http.HandlerFunc
+		kind      TwilioErrorKind
+		ok        bool
+		requests  int
+	}{
+		{
+			name:      "success",
+			responses: []http.HandlerFunc{twilioReply(201, testTwilioSMSResponseJson)},
+			ok:        true,
+			requests:  1,
+		},
+		{
+			name:      "bad credentials",
+			responses: []http.HandlerFunc{twilioReply(401, `{"code": 20003, "message": "Authenticate", "status": 401}`)},
+			kind:      TwilioAuthError,
+			requests:  1,
+		},
+		{
+			name:      "invalid number",
+			responses: []http.HandlerFunc{twilioReply(400, `{"code": 21211, "message": "The 'To' number 555 is not a valid phone number.", "status": 400}`)},
+			kind:      TwilioInvalidNumberError,
+			requests:  1,
+		},
+		{
+			name:      "rate limited then recovers",
+			responses: []http.HandlerFunc{twilioReply(429, `{"code": 20429, "message": "Too Many Requests", "status": 429}`), twilioReply(201, testTwilioSMSResponseJson)},
+			ok:        true,
+			requests:  2,
+		},
+		{
+			name:      "rate limited",
+			responses: []http.HandlerFunc{twilioReply(429, `{"code": 20429, "message": "Too Many Requests", "status": 429}`)},
+			kind:      TwilioRateLimitedError,
+			requests:  twilioMaxAttempts,
+		},
+		{
+			name:      "server error",
+			responses: []http.HandlerFunc{twilioReply(503, "")},
+			kind:      TwilioServerError,
+			requests:  twilioMaxAttempts,
+		},
+		{
+			name:      "connection dropped after the request was sent",
+			responses: []http.HandlerFunc{twilioHangUp},
+			kind:      TwilioNetworkError,
+			requests:  1,
+		},
+		{
+			name:      "malformed response",
+			responses: []http.HandlerFunc{twilioReply(201, "this is not JSON")},
+			kind:      TwilioResponseError,
+			requests:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, method := range []string{"sms", "phone"} {
+			f := &fakeTwilio{responses: tt.responses}
+			ts := httptest.NewServer(f)
+			c.Config.Integrations.Twilio.APIBaseURL = ts.URL + "/"
+
+			var err error
+			if method == "sms" {
+				err = SendSMS("+12108675309", "Hello World", "", false)
+			} else {
+				err = MakePhoneCall("+12108675309", "Hello World", "")
+			}
+			ts.Close()
+
+			if f.requests != tt.requests {
+				t.Errorf("%s (%s): expected %d requests to Twilio, got %d", tt.name, method, tt.requests, f.requests)
+			}
+
+			if tt.ok {
+				if err != nil {
+					t.Errorf("%s (%s): unexpected error: %v", tt.name, method, err)
+				}
+				continue
+			}
+
+			te, ok := err.(*TwilioError)
+			if !ok {
+				t.Errorf("%s (%s): expected a *TwilioError, got %v", tt.name, method, err)
+				continue
+			}
+			if te.Kind != tt.kind {
+				t.Errorf("%s (%s): expected error kind %q, got %q", tt.name, method, tt.kind, te.Kind)
+			}
+		}
+	}
+
+	// Twilio's message is kept out of the error, since it's logged, but its code isn't
+	te := &TwilioError{StatusCode: 400, Code: 21211, Message: "The 'To' number +1 (210) 867-5309 is not a valid phone number."}
+	classifyTwilioError(te)
+	if got, want := te.Error(), "Twilio invalid number (HTTP 400, code 21211): The 'To' number [redacted] is not a valid phone number."; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// A Twilio API that can't be reached at all
+	ts := httptest.NewServer(http.NotFoundHandler())
+	c.Config.Integrations.Twilio.APIBaseURL = ts.URL + "/"
+	ts.Close()
+
+	err := SendSMS("+12108675309", "Hello World", "", false)
+	if te, ok := err.(*TwilioError); !ok || te.Kind != TwilioNetworkError || te.Sent {
+		t.Errorf("unreachable API: expected a network error before the request was sent, got %v", err)
+	}
+	if !IsTemporary(err) {
+		t.Errorf("unreachable API: expected a network error to be temporary")
+	}
+}
+
+func TestTwilioRetryShutdown(t *testing.T) {
+	// A shutdown cuts the backoff short instead of waiting it out
+	twilioRetryBackoff = time.Hour
+	defer func() { twilioRetryBackoff = time.Millisecond }()
+
+	NIP.Mu.Lock()
+	running := NIP.Stopping
+	NIP.Stopping = make(chan struct{})
+	close(NIP.Stopping)
+	NIP.Mu.Unlock()
+	defer func() {
+		NIP.Mu.Lock()
+		NIP.Stopping = running
+		NIP.Mu.Unlock()
+	}()
+
+	f := &fakeTwilio{responses: []http.HandlerFunc{twilioReply(503, "")}}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	c.Config.Integrations.Twilio.APIBaseURL = ts.URL + "/"
+
+	err := SendSMS("+12108675309", "Hello World", "", false)
+	if te, ok := err.(*TwilioError); !ok || te.Kind != TwilioServerError {
+		t.Errorf("Expected a server error, got %v", err)
+	}
+	if f.requests != 1 {
+		t.Errorf("Expected 1 request to Twilio, got %d", f.requests)
+	}
+}
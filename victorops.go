@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"time"
 
@@ -45,12 +44,12 @@ func NotifyPersonViaVictorops(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vo := victorops.NewClient(c.Config.Integrations.VictorOps.APIKey)
+	vo := victorops.NewClient(c.CurrentConfig().Integrations.VictorOps.APIKey)
 
 	p, err := c.GetPerson(username)
 	if err != nil {
 		res.Error = err.Error()
-		log.Println("config.GetPerson() Error:", err)
+		logger.Error("Could not fetch person for VictorOps", "username", username, "err", err)
 		json.NewEncoder(w).Encode(res)
 		return
 	}
@@ -65,11 +64,11 @@ func NotifyPersonViaVictorops(w http.ResponseWriter, r *http.Request) {
 	resp, err := vo.SendAlert(e)
 	if err != nil {
 		res.Error = err.Error()
-		log.Println("Error:", err)
+		logger.Error("Sending VictorOps alert failed", "err", err)
 		json.NewEncoder(w).Encode(res)
 		return
 	}
-	log.Println("VO Response - Result:", resp.Result, "EntityID:", resp.EntityID, "Message:", resp.EntityID)
+	logger.Info("Sent VictorOps alert", "result", resp.Result, "entity_id", resp.EntityID)
 	return
 
 }
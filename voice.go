@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The keys of the menu that's read out during a notification call.  The acknowledgement key
+// defaults to 1 but can be changed with VoiceOptions.AckDigit.
+const (
+	defaultAckDigit = "1"
+	escalateDigit   = "2"
+	snoozeDigit     = "3"
+	retriggerDigit  = "4"
+	repeatDigit     = "9"
+)
+
+// VoiceOptions controls how a phone call is carried out.  They can be set on a Person and
+// overridden for an individual NotificationStep.
+type VoiceOptions struct {
+	Voice      string `yaml:"voice" json:"voice,omitempty"`             // Twilio TTS voice, e.g. "alice" or "Polly.Joanna"
+	Language   string `yaml:"language" json:"language,omitempty"`       // TTS language, e.g. "en-GB"
+	Repeat     int    `yaml:"repeat" json:"repeat,omitempty"`           // How many times the message is read out
+	AckDigit   string `yaml:"ack_digit" json:"ack_digit,omitempty"`     // The key that must be pressed to acknowledge
+	RequirePIN bool   `yaml:"require_pin" json:"require_pin,omitempty"` // Require the person's PIN to acknowledge
+}
+
+// Copies every option that's set in o over the top of v
+func (v *VoiceOptions) merge(o *VoiceOptions) {
+	if o == nil {
+		return
+	}
+
+	if o.Voice != "" {
+		v.Voice = o.Voice
+	}
+	if o.Language != "" {
+		v.Language = o.Language
+	}
+	if o.Repeat != 0 {
+		v.Repeat = o.Repeat
+	}
+	if o.AckDigit != "" {
+		v.AckDigit = o.AckDigit
+	}
+	if o.RequirePIN {
+		v.RequirePIN = true
+	}
+}
+
+// Make sure that the options describe a call that can actually be acknowledged
+func (v *VoiceOptions) Validate() error {
+	if v == nil {
+		return nil
+	}
+
+	if v.Repeat < 0 || v.Repeat > 10 {
+		return fmt.Errorf("voice repeat must be between 0 and 10")
+	}
+
+	if v.AckDigit != "" && (len(v.AckDigit) != 1 || !strings.Contains("0123456789*#", v.AckDigit)) {
+		return fmt.Errorf("voice ack_digit must be a single key: 0-9, * or #")
+	}
+
+	switch v.AckDigit {
+	case escalateDigit, snoozeDigit, retriggerDigit, repeatDigit:
+		return fmt.Errorf("voice ack_digit cannot be %v, %v, %v or %v; those keys escalate, snooze, acknowledge until a re-trigger and repeat the message", escalateDigit, snoozeDigit, retriggerDigit, repeatDigit)
+	}
+
+	return nil
+}
+
+// How many digits a PIN can have
+const (
+	minPINLength = 4
+	maxPINLength = 10
+)
+
+// Checks that a PIN is usable for acknowledging calls
+func validatePIN(pin string) error {
+	if pin == "" {
+		return nil
+	}
+
+	if len(pin) < minPINLength || len(pin) > maxPINLength || strings.Trim(pin, "0123456789") != "" {
+		return fmt.Errorf("pin must be between %v and %v digits", minPINLength, maxPINLength)
+	}
+
+	return nil
+}
+
+// The voice options and PIN in effect for a call placed for a notification-in-progress
+func callOptions(uuid string) (VoiceOptions, string) {
+	var v VoiceOptions
+	var pin string
+
+	NIP.Mu.Lock()
+	defer NIP.Mu.Unlock()
+
+	nr, exists := NIP.Requests[uuid]
+	if !exists {
+		return v, ""
+	}
+
+	if nr.Person != nil {
+		v.merge(nr.Person.VoiceOptions)
+		pin = nr.Person.storedPIN()
+	}
+
+	if step := NIP.Steps[uuid]; nr.Plan != nil && step > 0 && step <= len(nr.Plan.Steps) {
+		v.merge(nr.Plan.Steps[step-1].VoiceOptions)
+	}
+
+	// We can't ask for a PIN that the person doesn't have
+	if pin == "" {
+		v.RequirePIN = false
+	}
+
+	return v, pin
+}
+
+// The key that acknowledges a call
+func ackDigit(v VoiceOptions) string {
+	if v.AckDigit != "" {
+		return v.AckDigit
+	}
+	return defaultAckDigit
+}
+
+// Reports whether the digits entered during a call match the person's stored PIN, which is a bcrypt hash unless
+// it was stored before PINs were hashed
+func acceptsPIN(pin, digits string) bool {
+	if pin == "" {
+		return false
+	}
+
+	entered := strings.TrimSuffix(digits, "#")
+	if strings.HasPrefix(pin, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(pin), []byte(entered)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(entered), []byte(pin)) == 1
+}
+
+// Gathers the template variables for a notification call
+func voiceMessageData(uuid string, v VoiceOptions) *MessageData {
+	d := messageData(uuid)
+	d.AckDigit = ackDigit(v)
+	d.RequirePIN = v.RequirePIN
+	d.SnoozeMinutes = int(defaultSnoozePeriod.Minutes())
+	d.RetriggerMinutes = int(defaultRetriggerPeriod.Minutes())
+	return d
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testCreatePersonWithPINJson = `
+{
+  "username": "galahad",
+  "fullname": "Sir Galahad",
+  "pin": "4321",
+  "voice_options": {
+    "voice": "alice",
+    "language": "en-GB",
+    "repeat": 2
+  }
+}
+`
+
+const testVoicePINNotificationPlanJson = `
+[
+  {
+    "method": "phone://+12108675309",
+    "notify_every_period": 3600000000000,
+    "notify_until_period": 0,
+    "voice_options": {
+      "require_pin": true
+    }
+  }
+]
+`
+
+const testVoiceMenuNotificationPlanJson = `
+[
+  {
+    "method": "phone://+12108675309",
+    "notify_every_period": 0,
+    "notify_until_period": 3600000000000
+  },
+  {
+    "method": "sms://+12108675309",
+    "notify_every_period": 3600000000000,
+    "notify_until_period": 0
+  }
+]
+`
+
+func TestVoiceOptions(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	// A PIN that can't be entered on a phone should be refused
+	w := testAPIRequest(t, "POST", "http://localhost/people", `{"username": "galahad", "fullname": "Sir Galahad", "pin": "abcd"}`)
+	if w.Code != 422 {
+		t.Errorf("CreatePerson accepted an invalid PIN: %d", w.Code)
+	}
+
+	w = testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonWithPINJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed: %s", w.Body)
+	}
+
+	uuid := testMockNotify(t, "galahad", testVoicePINNotificationPlanJson)
+	waitFor(t, "phone call", func() bool { return len(mockProvider.PlacedCalls()) == 1 })
+
+	call := mockProvider.PlacedCalls()[0]
+
+	// A key that isn't on the menu shouldn't acknowledge the call
+	err := mockProvider.PressDigits(call.Sid, "7")
+	if err != nil {
+		t.Fatalf("Digit press failed: %s", err)
+	}
+
+	// Neither should the wrong PIN
+	err = mockProvider.PressDigits(call.Sid, "1", "1234")
+	if err != nil {
+		t.Fatalf("Digit press failed: %s", err)
+	}
+
+	if !notificationInProgress(uuid) {
+		t.Fatalf("Notification was acknowledged without the PIN")
+	}
+	if len(mockProvider.PlacedCalls()[0].Redirects) != 0 {
+		t.Errorf("Call was redirected without the PIN")
+	}
+
+	// The PIN is only stored hashed, so the prompt takes as many digits as any PIN can have, up to the pound key
+	b, err := mockCallbackBody(c.Config.Service.CallbackURLBase+"/"+uuid+"/digits", url.Values{"CallSid": {call.Sid}, "Digits": {"1"}})
+	if err != nil {
+		t.Fatalf("Digits callback failed: %s", err)
+	}
+	var prompt struct {
+		Gather struct {
+			NumDigits   int    `xml:"numDigits,attr"`
+			FinishOnKey string `xml:"finishOnKey,attr"`
+		} `xml:"Gather"`
+	}
+	err = xml.Unmarshal(b, &prompt)
+	if err != nil || prompt.Gather.NumDigits != maxPINLength || prompt.Gather.FinishOnKey != "#" {
+		t.Errorf("Unexpected PIN prompt: %s", b)
+	}
+
+	err = mockProvider.PressDigits(call.Sid, "1", "4321#")
+	if err != nil {
+		t.Fatalf("Digit press failed: %s", err)
+	}
+	waitFor(t, "phone acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	redirects := mockProvider.PlacedCalls()[0].Redirects
+	if len(redirects) != 1 || !strings.Contains(redirects[0], "voice=alice") || !strings.Contains(redirects[0], "voice_language=en-GB") {
+		t.Errorf("Expected the acknowledgement to keep the person's voice, got %v", redirects)
+	}
+
+	// The escalate, snooze and repeat keys can't be used to acknowledge
+	w = testAPIRequest(t, "PUT", "http://localhost/people/galahad", `{"fullname": "Sir Galahad", "voice_options": {"ack_digit": "2"}}`)
+	if w.Code != 422 {
+		t.Errorf("UpdatePerson accepted a menu key as the ack_digit: %d", w.Code)
+	}
+
+	// The PIN is stored hashed and never shown
+	w = testAPIRequest(t, "GET", "http://localhost/people/galahad", "")
+	if !strings.Contains(w.Body.String(), `"has_pin":true`) || strings.Contains(w.Body.String(), "4321") || strings.Contains(w.Body.String(), "pin_hash") {
+		t.Errorf("Expected the person to show only that they have a PIN: %s", w.Body)
+	}
+	p, err := c.GetPerson("galahad")
+	if err != nil {
+		t.Fatalf("Could not fetch person: %s", err)
+	}
+	if p.PIN != "" || !acceptsPIN(p.PINHash, "4321") {
+		t.Errorf("Expected the PIN to be stored as a hash: %+v", p)
+	}
+
+	// Updating them without a PIN keeps the one they have
+	w = testAPIRequest(t, "PUT", "http://localhost/people/galahad", `{"fullname": "Sir Galahad the Pure"}`)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"has_pin":true`) || strings.Contains(w.Body.String(), "$2") {
+		t.Errorf("Expected UpdatePerson to keep the PIN: %d %s", w.Code, w.Body)
+	}
+
+	// Their plan requires a PIN, so it can't be removed
+	w = testAPIRequest(t, "PUT", "http://localhost/people/galahad", `{"fullname": "Sir Galahad", "remove_pin": true}`)
+	if w.Code != 422 {
+		t.Errorf("UpdatePerson removed a PIN that the notification plan requires: %d", w.Code)
+	}
+}
+
+func TestVoiceMenu(t *testing.T) {
+	// create tempdir for fs based tests
+	tempdir, _ := ioutil.TempDir(os.TempDir(), "chickenlittle-tests-")
+	defer func() {
+		// remove tempdir
+		_ = os.RemoveAll(tempdir)
+	}()
+	dbfile := tempdir + "/db"
+
+	// open BoldDB handle
+	c.DB.Open(dbfile)
+	defer c.DB.Close()
+
+	defer startTestMockProvider()()
+
+	mockProvider.Reset()
+	startTestNotificationEngine()
+
+	w := testAPIRequest(t, "POST", "http://localhost/people", testCreatePersonJson)
+	if w.Code != 200 {
+		t.Fatalf("CreatePerson request failed: %s", w.Body)
+	}
+
+	// Escalate: the next plan step should start right away
+	uuid := testMockNotify(t, "lancelot", testVoiceMenuNotificationPlanJson)
+	waitFor(t, "phone call", func() bool { return len(mockProvider.PlacedCalls()) == 1 })
+
+	err := mockProvider.PressDigits(mockProvider.PlacedCalls()[0].Sid, "2")
+	if err != nil {
+		t.Fatalf("Digit press failed: %s", err)
+	}
+	waitFor(t, "escalation to SMS", func() bool { return len(mockProvider.SentSMS()) == 1 })
+
+	w = testAPIRequest(t, "GET", "http://localhost/notifications/"+uuid, "")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"step":2`) || !strings.Contains(w.Body.String(), `"escalations":1`) {
+		t.Errorf("Unexpected notification status after escalation: %s", w.Body)
+	}
+
+	testAPIRequest(t, "DELETE", "http://localhost/notifications/"+uuid, "")
+	waitFor(t, "notification to stop", func() bool { return !notificationInProgress(uuid) })
+
+	// There's nobody to escalate to from the last step, so the call carries on
+	mockProvider.Reset()
+	uuid = testMockNotify(t, "lancelot", testMockPhoneNotificationPlanJson)
+	waitFor(t, "phone call", func() bool { return len(mockProvider.PlacedCalls()) == 1 })
+	call := mockProvider.PlacedCalls()[0]
+
+	err = mockProvider.PressDigits(call.Sid, "2")
+	if err != nil {
+		t.Fatalf("Digit press failed: %s", err)
+	}
+
+	// Snooze
+	err = mockProvider.PressDigits(call.Sid, "3")
+	if err != nil {
+		t.Fatalf("Digit press failed: %s", err)
+	}
+	waitFor(t, "snooze", func() bool {
+		w := testAPIRequest(t, "GET", "http://localhost/notifications/"+uuid, "")
+		return strings.Contains(w.Body.String(), `"state":"snoozed"`)
+	})
+
+	w = testAPIRequest(t, "GET", "http://localhost/notifications/"+uuid, "")
+	if !strings.Contains(w.Body.String(), `"escalations":0`) || !strings.Contains(w.Body.String(), `"snoozed_until"`) {
+		t.Errorf("Unexpected notification status after snooze: %s", w.Body)
+	}
+
+	// Hear the message again, then acknowledge it
+	err = mockProvider.PressDigits(call.Sid, "9", "1")
+	if err != nil {
+		t.Fatalf("Digit press failed: %s", err)
+	}
+	waitFor(t, "phone acknowledgement", func() bool { return !notificationInProgress(uuid) })
+
+	// Only its record is left
+	w = testAPIRequest(t, "GET", "http://localhost/notifications/"+uuid, "")
+	if !strings.Contains(w.Body.String(), `"state":"ended"`) || !strings.Contains(w.Body.String(), `"outcome":"acknowledged"`) {
+		t.Errorf("Expected an acknowledged notification to have ended: %s", w.Body)
+	}
+}
+
+func TestAcceptsPIN(t *testing.T) {
+	tests := []struct {
+		pin    string
+		digits string
+		accept bool
+	}{
+		{"4321", "4321", true},
+		{"4321", "4321#", true},
+		{"4321", "432", false},
+		{"4321", "1", false},
+		{"", "", false},
+		{"$2a$04$2x2/fYiwZAGi9j7dN/pGleP6C/YAWfCgBSHVemC8ML47.nBSOKf8m", "4321#", true},
+		{"$2a$04$2x2/fYiwZAGi9j7dN/pGleP6C/YAWfCgBSHVemC8ML47.nBSOKf8m", "1234", false},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsPIN(tt.pin, tt.digits); got != tt.accept {
+			t.Errorf("acceptsPIN(%q, %q) = %v, expected %v", tt.pin, tt.digits, got, tt.accept)
+		}
+	}
+
+	if d := ackDigit(VoiceOptions{}); d != "1" {
+		t.Errorf("Expected the default ack digit to be 1, got %q", d)
+	}
+	if d := ackDigit(VoiceOptions{AckDigit: "5"}); d != "5" {
+		t.Errorf("Expected the ack digit to be 5, got %q", d)
+	}
+}